@@ -353,7 +353,7 @@ function cb_deployed(e){
 				ibc.block_stats(chain_stats.height - 1, cb_blockstats);
 				wss.broadcast({msg: 'reset'});
 				chaincode.query.read(['_marbleindex'], cb_got_index);
-				chaincode.query.read(['_opentrades'], cb_got_trades);
+				part2.get_open_trades(cb_got_trades);
 			}
 			
 			//got the block's stats, lets send the statistics
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var auctionStr = "auction~id" //composite key type of auctions
+
+var auctionOpen = "open"           //taking bids
+var auctionCancelled = "cancelled" //seller pulled the marble before anyone bid
+var auctionSold = "sold"           //settled with a winning bid
+var auctionUnsold = "unsold"       //settled without a bid
+
+var currencyMarbles = "marbles" //bids offer marbles, worth the number of marbles
+var currencyCoin = "coin"       //bids hold coins, worth the number of coins
+
+type Bid struct {
+	Bidder    string   `json:"bidder"`
+	Marbles   []string `json:"marbles"`   //marbles offered, locked until the bidder is outbid or the auction settles
+	Value     uint64   `json:"value"`     //worth of the bid, the number of marbles offered or coins held
+	TxID      string   `json:"tx_id"`     //transaction that placed the bid
+	Timestamp int64    `json:"timestamp"` //utc timestamp of the bid in ms
+}
+
+type Auction struct {
+	ID        string `json:"id"`     //tx id of start_auction
+	Marble    string `json:"marble"` //marble up for auction, locked while the auction is open
+	Seller    string `json:"seller"`
+	Currency  string `json:"currency"`  //what bids are made of, marbles or coin
+	Reserve   uint64 `json:"reserve"`   //lowest bid value the seller accepts
+	Ends      int64  `json:"ends"`      //utc timestamp in ms after which no bids are taken
+	Status    string `json:"status"`    //open, cancelled, sold or unsold
+	Timestamp int64  `json:"timestamp"` //utc timestamp of start_auction in ms
+	Bids      []Bid  `json:"bids"`      //every accepted bid, each one beats the one before
+}
+
+// highestBid is the bid currently winning the auction
+func (a Auction) highestBid() (Bid, bool) {
+	if len(a.Bids) == 0 {
+		return Bid{}, false
+	}
+	return a.Bids[len(a.Bids)-1], true
+}
+
+func auctionKey(id string) (string, error) {
+	return createCompositeKey(auctionStr, []string{id})
+}
+
+// ============================================================================================================================
+// Get Auction - read an auction by id
+// ============================================================================================================================
+func getAuction(stub shim.ChaincodeStubInterface, id string) (Auction, error) {
+	var auction Auction
+	key, err := auctionKey(id)
+	if err != nil {
+		return auction, err
+	}
+	auctionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return auction, errs.New(errs.Internal, "Failed to get auction "+id)
+	}
+	if auctionAsBytes == nil {
+		return auction, errs.New(errs.NotFound, "Auction not found: "+id)
+	}
+	err = json.Unmarshal(auctionAsBytes, &auction)
+	if err != nil {
+		return auction, errs.New(errs.Internal, "Corrupt auction record for "+id)
+	}
+	return auction, nil
+}
+
+func putAuction(stub shim.ChaincodeStubInterface, auction Auction) error {
+	key, err := auctionKey(auction.ID)
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(auction)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Start Auction - put a marble up for auction, the marble is locked until the auction is cancelled or settled
+// ============================================================================================================================
+func (t *SimpleChaincode) start_auction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1          2              3*
+	// "m1",   "2",  "1475323200000",  *"coin"*
+	// marble, reserve, ends (utc ms), currency (marbles by default)
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting marble, reserve, end time and optional currency")
+	}
+	reserve, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errs.Arg(1, "2nd argument must be a non-negative numeric string")
+	}
+	currency := currencyMarbles
+	if len(args) == 4 {
+		currency = args[3]
+	}
+	if currency != currencyMarbles && currency != currencyCoin {
+		return nil, errs.Arg(3, "Auction currency must be "+currencyMarbles+" or "+currencyCoin)
+	}
+	ends, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return nil, errs.Arg(2, "3rd argument must be a numeric string")
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	if ends <= now {
+		return nil, errs.Arg(2, "Auction has to end in the future")
+	}
+
+	marble, err := getMarble(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.authorizeUser(stub, marble.User, "auction marble "+marble.Name) //only the owner sells a marble
+	if err != nil {
+		return nil, err
+	}
+
+	auction := Auction{
+		ID:        stub.GetTxID(),
+		Marble:    marble.Name,
+		Seller:    normalizeUserID(marble.User),
+		Currency:  currency,
+		Reserve:   reserve,
+		Ends:      ends,
+		Status:    auctionOpen,
+		Timestamp: now,
+		Bids:      []Bid{},
+	}
+	err = lockMarble(stub, marble, auction.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("auction started", "auction", auction.ID, "marble", marble.Name, "user", auction.Seller)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Place Bid - offer marbles or coins for an open auction, the bid has to meet the reserve and beat the highest bid
+// ============================================================================================================================
+func (t *SimpleChaincode) place_bid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1       2      3*
+	// "tx5",  "bob",  "m2", *"m3"*
+	// auction, bidder, marbles offered, or the coins bid in a coin auction
+	if len(args) < 3 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction, bidder and at least one marble")
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != auctionOpen {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" is "+auction.Status)
+	}
+	if now >= auction.Ends {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" has ended")
+	}
+
+	bidder, err := requireUser(stub, args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	err = t.authorizeUser(stub, bidder, "bid as "+bidder)
+	if err != nil {
+		return nil, err
+	}
+	if bidder == auction.Seller {
+		return nil, errs.New(errs.InvalidArgument, "Cannot bid on your own auction")
+	}
+
+	bid := Bid{Bidder: bidder, Marbles: args[2:], Value: uint64(len(args[2:])), TxID: stub.GetTxID(), Timestamp: now}
+	if auction.Currency == currencyCoin {
+		if len(args) != 3 {
+			return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction, bidder and coins")
+		}
+		bid.Marbles = []string{}
+		bid.Value, err = parseAmount(args[2])
+		if err != nil {
+			return nil, errs.WithArg(err, 2)
+		}
+	}
+	if bid.Value < auction.Reserve {
+		return nil, errs.New(errs.Conflict, "Bid of "+strconv.FormatUint(bid.Value, 10)+" does not meet the reserve of "+strconv.FormatUint(auction.Reserve, 10))
+	}
+	highest, ok := auction.highestBid()
+	if ok && bid.Value <= highest.Value {
+		return nil, errs.New(errs.Conflict, "Bid of "+strconv.FormatUint(bid.Value, 10)+" does not beat the highest bid of "+strconv.FormatUint(highest.Value, 10))
+	}
+
+	if ok { //the outbid marbles or coins go back to their owner
+		err = releaseBid(stub, auction, highest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if auction.Currency == currencyCoin { //hold the coins until the bidder is outbid or the auction settles
+		record, err := newCoinRecord(stub, coinBid, bid.Value, "", auction.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = debitCoins(stub, bidder, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, name := range bid.Marbles {
+		for _, prev := range bid.Marbles[:i] {
+			if prev == name {
+				return nil, errs.Arg(i+2, "Marble "+name+" is offered twice")
+			}
+		}
+		marble, err := getMarble(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		if normalizeUserID(marble.User) != bidder {
+			return nil, errs.New(errs.Conflict, "Marble "+name+" is not owned by "+bidder)
+		}
+		err = lockMarble(stub, marble, auction.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auction.Bids = append(auction.Bids, bid)
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// releaseBid gives an outbid bidder their marbles or coins back
+func releaseBid(stub shim.ChaincodeStubInterface, auction Auction, bid Bid) error {
+	if auction.Currency != currencyCoin {
+		return unlockMarbles(stub, bid.Marbles, auction.ID)
+	}
+	record, err := newCoinRecord(stub, coinRefund, bid.Value, "", auction.ID)
+	if err != nil {
+		return err
+	}
+	return creditCoins(stub, bid.Bidder, record)
+}
+
+// refundOpenAuctions gives the winning bidder of every open coin auction the coins their bid holds, marble bids go
+// with the marbles
+func refundOpenAuctions(stub shim.ChaincodeStubInterface) error {
+	iter, err := getStateByPartialCompositeKey(stub, auctionStr, []string{})
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to get auctions")
+	}
+	open := []Auction{}
+	for iter.HasNext() {
+		_, auctionAsBytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return errs.New(errs.Internal, "Failed to get auctions")
+		}
+		var auction Auction
+		err = json.Unmarshal(auctionAsBytes, &auction)
+		if err != nil {
+			iter.Close()
+			return errs.New(errs.Internal, "Corrupt auction record")
+		}
+		if auction.Status == auctionOpen && auction.Currency == currencyCoin {
+			open = append(open, auction)
+		}
+	}
+	iter.Close()
+
+	for _, auction := range open {
+		bid, ok := auction.highestBid()
+		if !ok {
+			continue
+		}
+		err = releaseBid(stub, auction, bid) //only the highest bid holds coins, the ones it beat were refunded already
+		if err != nil {
+			return err
+		}
+		logFor(stub).Info("bid refunded", "auction", auction.ID, "user", bid.Bidder, "coins", strconv.FormatUint(bid.Value, 10))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Cancel Auction - the seller takes the marble back, only possible before the first bid
+// ============================================================================================================================
+func (t *SimpleChaincode) cancel_auction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "tx5"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction id")
+	}
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.authorizeUser(stub, auction.Seller, "cancel auction "+auction.ID)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != auctionOpen {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" is "+auction.Status)
+	}
+	if len(auction.Bids) > 0 {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" already has bids")
+	}
+
+	err = unlockMarbles(stub, []string{auction.Marble}, auction.ID)
+	if err != nil {
+		return nil, err
+	}
+	auction.Status = auctionCancelled
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Settle Auction - once the auction ended swap the marble and the winning bid, anybody can settle
+// ============================================================================================================================
+func (t *SimpleChaincode) settle_auction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "tx5"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction id")
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != auctionOpen {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" is "+auction.Status)
+	}
+	if now < auction.Ends {
+		return nil, errs.New(errs.Conflict, "Auction "+auction.ID+" has not ended yet")
+	}
+
+	highest, ok := auction.highestBid()
+	marbles := append([]string{auction.Marble}, highest.Marbles...)
+	err = unlockMarbles(stub, marbles, auction.ID) //nothing stays locked once the auction is over
+	if err != nil {
+		return nil, err
+	}
+
+	auction.Status = auctionUnsold
+	if ok {
+		auction.Status = auctionSold
+		err = transferMarble(stub, auction.Marble, highest.Bidder, reasonAuction, auction.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range highest.Marbles {
+			err = transferMarble(stub, name, auction.Seller, reasonAuction, auction.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if auction.Currency == currencyCoin { //the held coins go to the seller
+			record, err := newCoinRecord(stub, coinSale, highest.Value, highest.Bidder, auction.ID)
+			if err != nil {
+				return nil, err
+			}
+			err = creditCoins(stub, auction.Seller, record)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("auction settled", "auction", auction.ID, "marble", auction.Marble, "status", auction.Status)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get Auction (query) - return an auction with its bids
+// ============================================================================================================================
+func (t *SimpleChaincode) get_auction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction id")
+	}
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(auction)
+}
+
+// ============================================================================================================================
+// Active Auctions (query) - every auction that is still open, including ended ones waiting to be settled
+// ============================================================================================================================
+func (t *SimpleChaincode) active_auctions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	iter, err := getStateByPartialCompositeKey(stub, auctionStr, []string{})
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get auctions")
+	}
+	defer iter.Close()
+
+	auctions := []Auction{}
+	for iter.HasNext() {
+		_, auctionAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get auctions")
+		}
+		var auction Auction
+		err = json.Unmarshal(auctionAsBytes, &auction)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt auction record")
+		}
+		if auction.Status == auctionOpen {
+			auctions = append(auctions, auction)
+		}
+	}
+	return json.Marshal(auctions)
+}
+
+// ============================================================================================================================
+// Auction Bids (query) - the bid history of an auction, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) auction_bids(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting auction id")
+	}
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(auction.Bids)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getTestAuction(t *testing.T, stub *memStub, cc *SimpleChaincode, id string) Auction {
+	t.Helper()
+	res, err := stub.query(cc, "get_auction", id)
+	if err != nil {
+		t.Fatalf("get_auction %s failed: %s", id, err)
+	}
+	var auction Auction
+	if err := json.Unmarshal(res, &auction); err != nil {
+		t.Fatalf("get_auction %s returned %s: %s", id, res, err)
+	}
+	return auction
+}
+
+// startTestAuction puts bob's b1 up for an hour long auction with the given reserve
+func startTestAuction(t *testing.T, stub *memStub, cc *SimpleChaincode, reserve string) (string, time.Time) {
+	t.Helper()
+	ends := stub.txTime.Add(time.Hour)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "start_auction", "b1", reserve, strconv.FormatInt(ends.Unix()*1000, 10))
+	return stub.txID, ends
+}
+
+func TestStartAuction(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	id, ends := startTestAuction(t, stub, cc, "2")
+	auction := getTestAuction(t, stub, cc, id)
+	if auction.Marble != "b1" || auction.Seller != "bob" || auction.Reserve != 2 || auction.Ends != ends.Unix()*1000 || auction.Status != auctionOpen {
+		t.Errorf("auction = %+v", auction)
+	}
+	if storedMarble(t, stub, "b1").LockedBy != id {
+		t.Error("b1 should be locked by the auction")
+	}
+
+	//a marble up for auction stays put
+	mustBeLocked(t, stub, cc, "set_user", "b1", "carol")
+	mustBeLocked(t, stub, cc, "delete", "b1")
+	mustBeLocked(t, stub, cc, "start_auction", "b1", "1", strconv.FormatInt(ends.Unix()*1000, 10))
+
+	later := strconv.FormatInt(ends.Unix()*1000, 10)
+	mustFail(t, stub, cc, "start_auction", "b2", "1")
+	mustFail(t, stub, cc, "start_auction", "b2", "-1", later)
+	mustFail(t, stub, cc, "start_auction", "b2", "1", "soon")
+	mustFail(t, stub, cc, "start_auction", "b2", "1", strconv.FormatInt(stub.txTime.Unix()*1000, 10))
+	mustFail(t, stub, cc, "start_auction", "nope", "1", later)
+	mustBeUnauthorized(t, stub, cc, "start_auction", "a1", "1", later)
+}
+
+func TestPlaceBid(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "c1", "red", "35", "carol")
+	mustInvoke(t, stub, cc, "init_marble", "c2", "red", "35", "carol")
+	mustInvoke(t, stub, cc, "init_marble", "c3", "red", "35", "carol")
+	id, ends := startTestAuction(t, stub, cc, "1")
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "a1")
+	if storedMarble(t, stub, "a1").LockedBy != id {
+		t.Error("a1 should be locked by the bid")
+	}
+
+	stub.as("carol")
+	mustFail(t, stub, cc, "place_bid", id, "carol", "c1")
+	mustFail(t, stub, cc, "place_bid", id, "carol", "c1", "c1")
+	mustFail(t, stub, cc, "place_bid", id, "carol", "c1", "a2")
+	mustBeUnauthorized(t, stub, cc, "place_bid", id, "alice", "a2", "b2")
+	mustInvoke(t, stub, cc, "place_bid", id, "carol", "c1", "c2")
+	if storedMarble(t, stub, "a1").LockedBy != "" {
+		t.Error("alice was outbid, a1 should be unlocked")
+	}
+
+	//alice comes back with her freed marble and one more
+	stub.as("alice")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "a1", "a2")
+	mustInvoke(t, stub, cc, "init_marble", "a3", "blue", "16", "alice")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "a1", "a2", "a3")
+	if storedMarble(t, stub, "c1").LockedBy != "" || storedMarble(t, stub, "a3").LockedBy != id {
+		t.Error("locks should follow the highest bid")
+	}
+
+	res, err := stub.query(cc, "auction_bids", id)
+	var bids []Bid
+	if err != nil || json.Unmarshal(res, &bids) != nil || len(bids) != 3 {
+		t.Fatalf("auction_bids = %s, %v", res, err)
+	}
+	if bids[0].Bidder != "alice" || bids[1].Bidder != "carol" || bids[1].Value != 2 || bids[2].Value != 3 {
+		t.Errorf("bids = %+v", bids)
+	}
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "place_bid", id, "bob", "b2", "b3", "b4", "b5")
+	stub.as("carol")
+	stub.txTime = ends
+	mustFail(t, stub, cc, "place_bid", id, "carol", "c1", "c2", "c3", "c1")
+	mustFail(t, stub, cc, "place_bid", "nope", "carol", "c1")
+	mustFail(t, stub, cc, "place_bid", id, "carol")
+}
+
+func TestPlaceBidReserve(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+	id, _ := startTestAuction(t, stub, cc, "2")
+
+	stub.as("alice")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "a1")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "a1", "a2")
+}
+
+func TestSettleAuction(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+	id, ends := startTestAuction(t, stub, cc, "1")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "a1", "a2")
+
+	stub.as("carol")
+	mustFail(t, stub, cc, "settle_auction", id)
+
+	stub.txTime = ends
+	mustInvoke(t, stub, cc, "settle_auction", id)
+	for name, owner := range map[string]string{"b1": "alice", "a1": "bob", "a2": "bob"} {
+		if m := storedMarble(t, stub, name); m.User != owner || m.LockedBy != "" {
+			t.Errorf("%s = %+v, want %s's and unlocked", name, m, owner)
+		}
+	}
+	if getTestAuction(t, stub, cc, id).Status != auctionSold {
+		t.Error("auction should be sold")
+	}
+	if h := queryHistory(t, stub, cc, "b1"); h[len(h)-1].Reason != reasonAuction || h[len(h)-1].TradeID != id {
+		t.Errorf("b1 history = %+v", h)
+	}
+
+	mustFail(t, stub, cc, "settle_auction", id)
+	stub.as("alice")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "b2")
+	mustFail(t, stub, cc, "settle_auction", "nope")
+}
+
+func TestSettleAuctionUnsold(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	id, ends := startTestAuction(t, stub, cc, "1")
+
+	stub.txTime = ends.Add(time.Minute)
+	mustInvoke(t, stub, cc, "settle_auction", id)
+	if m := storedMarble(t, stub, "b1"); m.User != "bob" || m.LockedBy != "" {
+		t.Errorf("b1 = %+v", m)
+	}
+	if getTestAuction(t, stub, cc, id).Status != auctionUnsold {
+		t.Error("auction should be unsold")
+	}
+}
+
+func TestCancelAuction(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	id, _ := startTestAuction(t, stub, cc, "1")
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "cancel_auction", id)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "cancel_auction", id)
+	if storedMarble(t, stub, "b1").LockedBy != "" || getTestAuction(t, stub, cc, id).Status != auctionCancelled {
+		t.Error("cancelling should unlock b1")
+	}
+	mustFail(t, stub, cc, "cancel_auction", id)
+	mustFail(t, stub, cc, "settle_auction", id)
+
+	//once somebody bid the seller is committed
+	id, _ = startTestAuction(t, stub, cc, "1")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "a1")
+	stub.as("bob")
+	mustFail(t, stub, cc, "cancel_auction", id)
+}
+
+func TestActiveAuctions(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	first, _ := startTestAuction(t, stub, cc, "1")
+	later := strconv.FormatInt(stub.txTime.Add(time.Hour).Unix()*1000, 10)
+	mustInvoke(t, stub, cc, "start_auction", "b2", "1", later)
+	second := stub.txID
+	mustInvoke(t, stub, cc, "cancel_auction", first)
+
+	res, err := stub.query(cc, "active_auctions")
+	var auctions []Auction
+	if err != nil || json.Unmarshal(res, &auctions) != nil {
+		t.Fatalf("active_auctions = %s, %v", res, err)
+	}
+	if len(auctions) != 1 || auctions[0].ID != second {
+		t.Errorf("active auctions = %+v", auctions)
+	}
+
+	if _, err := stub.query(cc, "get_auction", "nope"); err == nil {
+		t.Error("get_auction of an unknown id should fail")
+	}
+	if _, err := stub.query(cc, "auction_bids"); err == nil {
+		t.Error("auction_bids without args should fail")
+	}
+}
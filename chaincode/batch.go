@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var maxBatchSize = 500 //most items one init_marbles or transfer_marbles takes
+
+type MarbleSpec struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Size  int    `json:"size"`
+	User  string `json:"user"` //owner, has to be registered
+}
+
+type MarbleTransfer struct {
+	Name string `json:"name"` //marble to give away, the caller has to own it
+	User string `json:"user"` //new owner, has to be registered
+}
+
+type BatchResult struct {
+	Index int    `json:"index"`          //position of the item in the batch
+	Name  string `json:"name"`           //marble the item is about
+	From  string `json:"from,omitempty"` //owner before a transfer
+	User  string `json:"user"`           //owner after the item
+}
+
+// checkBatch makes sure a batch holds something, and not more than one invoke takes
+func checkBatch(n int) error {
+	if n == 0 {
+		return errs.Arg(0, "1st argument must be a non-empty JSON array")
+	}
+	if n > maxBatchSize {
+		return errs.Arg(0, "A batch holds at most "+strconv.Itoa(maxBatchSize)+" items, got "+strconv.Itoa(n))
+	}
+	return nil
+}
+
+// batchProblems collects what is wrong with the items of a batch, so one failed invoke reports all of them
+type batchProblems struct {
+	code     errs.Code //code of the first problem
+	messages []string
+}
+
+func (p *batchProblems) add(i int, name string, err error) {
+	if len(p.messages) == 0 {
+		p.code = errs.CodeOf(err)
+	}
+	p.messages = append(p.messages, "item "+strconv.Itoa(i)+" ("+name+"): "+errs.From(err).Message)
+}
+
+func (p *batchProblems) err(items int) error {
+	if len(p.messages) == 0 {
+		return nil
+	}
+	message := strconv.Itoa(len(p.messages)) + " of " + strconv.Itoa(items) + " items are invalid, nothing was applied: " + strings.Join(p.messages, "; ")
+	return errs.WithArg(errs.New(p.code, message), 0)
+}
+
+// ============================================================================================================================
+// Init Marbles - create every marble of a batch, all of them or none, with a single update of the marble index
+// ============================================================================================================================
+func (t *SimpleChaincode) init_marbles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var specs []MarbleSpec
+
+	//   0
+	// "[{"name":"asdf","color":"blue","size":35,"user":"bob"}]"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting a JSON array of marbles")
+	}
+	if json.Unmarshal([]byte(args[0]), &specs) != nil {
+		return nil, errs.Arg(0, "1st argument must be a JSON array of marbles")
+	}
+	err := checkBatch(len(specs))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	//validate every item before writing anything
+	marbles := make([]Marble, len(specs))
+	seen := map[string]bool{}
+	var problems batchProblems
+	for i, spec := range specs {
+		marble, err := rules.validMarble(stub, spec.Name, spec.Color, strconv.Itoa(spec.Size), spec.User) //owner has to be registered
+		if err == nil && seen[marble.Name] {
+			err = errs.New(errs.InvalidArgument, "Marble "+marble.Name+" is in the batch twice")
+		}
+		if err == nil {
+			err = marbleNameFree(stub, marble.Name)
+		}
+		if err != nil {
+			problems.add(i, spec.Name, err)
+			continue
+		}
+		seen[marble.Name] = true
+		marbles[i] = marble
+	}
+	if err = problems.err(len(specs)); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(marbles))
+	names := make([]string, len(marbles))
+	for i, marble := range marbles {
+		err = createMarble(stub, marble)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = BatchResult{Index: i, Name: marble.Name, User: marble.User}
+		names[i] = marble.Name
+	}
+	err = addToMarbleIndex(stub, names...) //one index update for the whole batch
+	if err != nil {
+		return nil, err
+	}
+
+	logFor(stub).Info("marbles created", "marbles", strconv.Itoa(len(marbles)))
+	return json.Marshal(results)
+}
+
+// ============================================================================================================================
+// Transfer Marbles - give away every marble of a batch, all of them or none, the caller has to own them all
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_marbles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transfers []MarbleTransfer
+
+	//   0
+	// "[{"name":"asdf","user":"alice"}]"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting a JSON array of transfers")
+	}
+	if json.Unmarshal([]byte(args[0]), &transfers) != nil {
+		return nil, errs.Arg(0, "1st argument must be a JSON array of transfers")
+	}
+	err := checkBatch(len(transfers))
+	if err != nil {
+		return nil, err
+	}
+
+	//validate every item before writing anything
+	results := make([]BatchResult, len(transfers))
+	seen := map[string]bool{}
+	var problems batchProblems
+	for i, transfer := range transfers {
+		marble, err := getMarble(stub, transfer.Name)
+		if err == nil && seen[marble.Name] {
+			err = errs.New(errs.InvalidArgument, "Marble "+marble.Name+" is in the batch twice")
+		}
+		if err == nil {
+			err = t.authorizeUser(stub, marble.User, "transfer marble "+marble.Name) //only the owner gives a marble away
+		}
+		if err == nil && marble.LockedBy != "" {
+			err = errs.New(errs.Conflict, "Marble "+marble.Name+" is locked by "+marble.LockedBy)
+		}
+		var user string
+		if err == nil {
+			user, err = requireUser(stub, transfer.User) //new owner has to be registered
+		}
+		if err != nil {
+			problems.add(i, transfer.Name, err)
+			continue
+		}
+		seen[marble.Name] = true
+		results[i] = BatchResult{Index: i, Name: marble.Name, From: marble.User, User: user}
+	}
+	if err = problems.err(len(transfers)); err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		err = transferMarble(stub, result.Name, result.User, reasonTransfer, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logFor(stub).Info("marbles transferred", "marbles", strconv.Itoa(len(results)))
+	return json.Marshal(results)
+}
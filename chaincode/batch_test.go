@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+func batchResults(t *testing.T, res []byte) []BatchResult {
+	t.Helper()
+	var results []BatchResult
+	if err := json.Unmarshal(res, &results); err != nil {
+		t.Fatalf("batch returned %s: %s", res, err)
+	}
+	return results
+}
+
+func TestInitMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	before := stub.writes[marbleIndexStr]
+	res := mustInvoke(t, stub, cc, "init_marbles", `[
+		{"name":"m1","color":"Blue","size":16,"user":"bob"},
+		{"name":"m2","color":"red","size":35,"user":" Alice"},
+		{"name":"m3","color":"green","size":16,"user":"bob"}]`)
+
+	results := batchResults(t, res)
+	if len(results) != 3 || results[1] != (BatchResult{Index: 1, Name: "m2", User: "alice"}) {
+		t.Errorf("init_marbles = %s", res)
+	}
+	if writes := stub.writes[marbleIndexStr] - before; writes != 1 {
+		t.Errorf("the marble index was written %d times, want once", writes)
+	}
+	if index := storedMarbleIndex(t, stub); strings.Join(index, ",") != "m1,m2,m3" {
+		t.Errorf("marble index = %v", index)
+	}
+	if m1 := storedMarble(t, stub, "m1"); m1.Color != "blue" || m1.User != "bob" {
+		t.Errorf("m1 = %+v", m1)
+	}
+	res, _ = stub.query(cc, "marbles_by_owner", "bob")
+	if !strings.Contains(string(res), `"m1"`) || !strings.Contains(string(res), `"m3"`) {
+		t.Errorf("marbles_by_owner bob = %s", res)
+	}
+	if history := queryHistory(t, stub, cc, "m2"); len(history) != 1 || history[0].Reason != reasonCreate {
+		t.Errorf("m2 history = %+v", history)
+	}
+}
+
+func TestInitMarblesValidatesEveryItem(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	err := mustFail(t, stub, cc, "init_marbles", `[
+		{"name":"n1","color":"blue","size":16,"user":"bob"},
+		{"name":"n2","color":"plaid","size":16,"user":"bob"},
+		{"name":"b1","color":"blue","size":16,"user":"bob"},
+		{"name":"n3","color":"blue","size":16,"user":"zed"},
+		{"name":"n1","color":"red","size":35,"user":"alice"}]`)
+	e := errs.From(err)
+	if e.Code != errs.InvalidArgument || e.Arg == nil || *e.Arg != 0 || !strings.HasPrefix(e.Message, "4 of 5 items are invalid") {
+		t.Errorf("init_marbles = %v", err)
+	}
+	for _, item := range []string{"item 1 (n2)", "item 2 (b1)", "item 3 (n3)", "item 4 (n1)"} {
+		if !strings.Contains(e.Message, item) {
+			t.Errorf("%s should be reported, got %s", item, e.Message)
+		}
+	}
+	if _, ok := stub.state["n1"]; ok {
+		t.Error("a batch with invalid items should not create any marble")
+	}
+
+	defer func(max int) { maxBatchSize = max }(maxBatchSize)
+	maxBatchSize = 2
+	for _, args := range [][]string{{}, {"{}"}, {"[]"}, {`[{},{},{}]`}, {"[]", "[]"}} {
+		mustFail(t, stub, cc, "init_marbles", args...)
+	}
+}
+
+func TestTransferMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35")
+
+	stub.as("bob")
+	res := mustInvoke(t, stub, cc, "transfer_marbles", `[{"name":"b1","user":"alice"},{"name":"b2","user":"Carol"}]`)
+	results := batchResults(t, res)
+	if len(results) != 2 || results[1] != (BatchResult{Index: 1, Name: "b2", From: "bob", User: "carol"}) {
+		t.Errorf("transfer_marbles = %s", res)
+	}
+	if storedMarble(t, stub, "b1").User != "alice" || storedMarble(t, stub, "b2").User != "carol" {
+		t.Error("marbles were not transferred")
+	}
+	if history := queryHistory(t, stub, cc, "b1"); len(history) != 2 || history[1].Reason != reasonTransfer {
+		t.Errorf("b1 history = %+v", history)
+	}
+	if trades := getOpenTrades(t, stub); len(trades) != 0 {
+		t.Errorf("bob gave away his red 35, his trade should be gone: %+v", trades)
+	}
+}
+
+func TestTransferMarblesValidatesEveryItem(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	err := mustFail(t, stub, cc, "transfer_marbles", `[
+		{"name":"b1","user":"alice"},
+		{"name":"a1","user":"bob"},
+		{"name":"nope","user":"alice"},
+		{"name":"b2","user":"zed"},
+		{"name":"b1","user":"carol"}]`)
+	e := errs.From(err)
+	if e.Code != errs.Unauthorized || !strings.HasPrefix(e.Message, "4 of 5 items are invalid") {
+		t.Errorf("transfer_marbles = %v", err)
+	}
+	if storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("a batch with invalid items should not transfer any marble")
+	}
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1")
+	err = mustFail(t, stub, cc, "transfer_marbles", `[{"name":"b1","user":"alice"}]`)
+	if errs.CodeOf(err) != errs.Conflict {
+		t.Errorf("transfer of an escrowed marble = %v", err)
+	}
+}
+
+// seedMarblesOneByOne is how clients seeded demo marbles before init_marbles
+func seedMarblesOneByOne(b *testing.B, cc *SimpleChaincode, stub *memStub, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := stub.invoke(cc, "init_marble", "m"+strconv.Itoa(i), "blue", "16", "bob"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func seedMarblesAtOnce(b *testing.B, cc *SimpleChaincode, stub *memStub, n int) {
+	specs := []MarbleSpec{}
+	for i := 0; i < n; i++ {
+		specs = append(specs, MarbleSpec{Name: "m" + strconv.Itoa(i), Color: "blue", Size: 16, User: "bob"})
+	}
+	specsAsBytes, _ := json.Marshal(specs)
+	if _, err := stub.invoke(cc, "init_marbles", string(specsAsBytes)); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSeedMarbles(b *testing.B) {
+	captureLog(b) //a line per marble would drown the results
+	for _, bench := range []struct {
+		name string
+		seed func(*testing.B, *SimpleChaincode, *memStub, int)
+	}{
+		{"one_by_one", seedMarblesOneByOne},
+		{"batch", seedMarblesAtOnce},
+	} {
+		seed := bench.seed
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				cc, stub := new(SimpleChaincode), newMemStub()
+				stub.as(testAdmin)
+				if _, err := stub.deploy(cc); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := stub.invoke(cc, "register_user", "bob"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				seed(b, cc, stub, 500)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var bundleSeparator = "x" //"16x2" is two marbles of size 16
+
+// parseSizeQuantity reads a trade size that may carry a quantity, "16" is one marble and "16x3" three of them.
+// A single marble comes back as quantity 0 so trades without bundles look the same as before.
+func parseSizeQuantity(arg string) (int, int, error) {
+	parts := strings.SplitN(arg, bundleSeparator, 2)
+	size, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return size, 0, nil
+	}
+	qty, err := strconv.Atoi(parts[1])
+	if err != nil || qty < 1 {
+		return 0, 0, errs.New(errs.InvalidArgument, "Quantity must be a positive number: "+arg)
+	}
+	if qty == 1 {
+		qty = 0
+	}
+	return size, qty, nil
+}
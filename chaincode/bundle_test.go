@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSizeQuantity(t *testing.T) {
+	cases := []struct {
+		arg       string
+		size, qty int
+		ok        bool
+	}{
+		{"16", 16, 0, true},
+		{"16x1", 16, 0, true},
+		{"16x3", 16, 3, true},
+		{"x3", 0, 0, false},
+		{"16x", 0, 0, false},
+		{"16x0", 0, 0, false},
+		{"16x-2", 0, 0, false},
+	}
+	for _, c := range cases {
+		size, qty, err := parseSizeQuantity(c.arg)
+		if (err == nil) != c.ok || size != c.size || qty != c.qty {
+			t.Errorf("parseSizeQuantity(%q) = %d, %d, %v", c.arg, size, qty, err)
+		}
+	}
+}
+
+func TestOpenBundleTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "blue", "16x2", "red", "35", "green", "16x3")
+	open := getOpenTrades(t, stub)[0]
+	if open.Want != (Description{Color: "blue", Size: 16, Quantity: 2}) {
+		t.Errorf("want = %+v", open.Want)
+	}
+	want := []Description{{Color: "red", Size: 35}, {Color: "green", Size: 16, Quantity: 3}}
+	if !reflect.DeepEqual(open.Willing, want) {
+		t.Errorf("willing = %+v, want %+v", open.Willing, want)
+	}
+
+	mustFail(t, stub, cc, "open_trade", "bob", "blue", "16x0", "red", "35")
+	mustFail(t, stub, cc, "open_trade", "bob", "blue", "16", "red", "35xa")
+}
+
+func TestPerformBundleTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "red", "35", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a1", "blue", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "a3", "green", "16", "alice")
+
+	//two blue 16s for one red 35
+	mustInvoke(t, stub, cc, "open_trade", "bob", "blue", "16x2", "red", "35")
+	id := tradeID(t, stub, 0)
+
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "red", "35")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "red", "35", "a1")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "red", "35", "a3")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "red", "35", "a2", "a3")
+
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "red", "35", "a2")
+	for name, owner := range map[string]string{"a1": "bob", "a2": "bob", "a3": "alice", "b1": "alice"} {
+		if got := storedMarble(t, stub, name).User; got != owner {
+			t.Errorf("%s owned by %s, want %s", name, got, owner)
+		}
+	}
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("trade should be closed")
+	}
+}
+
+func TestPerformTradeOpenerGivesBundle(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b2", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b3", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a1", "red", "35", "alice")
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "red", "35", "blue", "16x2")
+	id := tradeID(t, stub, 0)
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+
+	given := 0
+	for _, name := range []string{"b1", "b2", "b3"} {
+		if storedMarble(t, stub, name).User == "alice" {
+			given++
+		}
+	}
+	if given != 2 || storedMarble(t, stub, "a1").User != "bob" {
+		t.Errorf("alice should get two blues for her red, got %d", given)
+	}
+}
+
+func TestCleanTradesChecksBundleQuantity(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b2", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "red", "35", "blue", "16x2", "blue", "16")
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b2", "carol")
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 1 || !reflect.DeepEqual(trades[0].Willing, []Description{{Color: "blue", Size: 16}}) {
+		t.Errorf("only the single blue option should be left, got %+v", trades)
+	}
+}
+
+func TestEscrowBundle(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b2", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b3", "red", "35", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1+b3")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1+b2")
+	open := getOpenTrades(t, stub)[0]
+	if !reflect.DeepEqual(open.Willing, []Description{{Color: "blue", Size: 16, Quantity: 2}}) {
+		t.Errorf("willing = %+v", open.Willing)
+	}
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", open.ID, "alice", "a1", "bob", "blue", "16")
+	for _, name := range []string{"b1", "b2"} {
+		if m := storedMarble(t, stub, name); m.User != "alice" || m.LockedBy != "" {
+			t.Errorf("%s = %+v", name, m)
+		}
+	}
+}
+
+func TestMatchTradesSkipsBundles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "a2", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16x2", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+	if got := queryMatches(t, stub, cc); len(got) != 0 {
+		t.Errorf("preview = %+v, want none", got)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var coinBalanceStr = "balance~user"           //composite key type of coin balances
+var coinHistoryStr = "coinhistory~user~tx~n"  //composite key type of one change to an account's coins
+var legacyCoinHistoryStr = "coinhistory~user" //composite key type of a whole coin history, before each change got its own key
+var coinSupplyStr = "_coinsupply"             //name for the key/value that stores the total supply
+var listingStr = "listing~name"               //composite key type of marbles for sale
+
+var coinMint = "mint"         //admin created coins
+var coinTransfer = "transfer" //coins sent with transfer
+var coinSale = "sale"         //coins paid for a marble
+var coinBid = "bid"           //coins held by an auction bid
+var coinRefund = "refund"     //coins of an outbid auction bid coming back
+
+type Account struct {
+	User    string `json:"user"`
+	Balance uint64 `json:"balance"`
+}
+
+type CoinRecord struct {
+	Reason       string `json:"reason"`                 //mint, transfer, sale, bid or refund
+	Credit       bool   `json:"credit"`                 //true when coins came in, false when they went out
+	Amount       uint64 `json:"amount"`                 //coins moved
+	Balance      uint64 `json:"balance"`                //balance after the change
+	Counterparty string `json:"counterparty,omitempty"` //other account, empty for mints and auction holds
+	Ref          string `json:"ref,omitempty"`          //marble or auction the coins paid for
+	TxID         string `json:"tx_id"`                  //transaction that made the change
+	Timestamp    int64  `json:"timestamp"`              //utc timestamp of the transaction in ms
+}
+
+type Listing struct {
+	ID        string `json:"id"`     //tx id of list_for_sale, the marble is locked by it
+	Marble    string `json:"marble"` //marble for sale
+	Seller    string `json:"seller"`
+	Price     uint64 `json:"price"`     //coins the seller wants
+	Timestamp int64  `json:"timestamp"` //utc timestamp of the listing in ms
+}
+
+// parseAmount reads a positive number of coins
+func parseAmount(arg string) (uint64, error) {
+	amount, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || amount == 0 {
+		return 0, errs.New(errs.InvalidArgument, "Amount must be a positive whole number of coins: "+arg)
+	}
+	return amount, nil
+}
+
+// addCoins adds two amounts, failing instead of wrapping around
+func addCoins(a uint64, b uint64) (uint64, error) {
+	if a > math.MaxUint64-b {
+		return 0, errs.New(errs.Conflict, "Coin amount overflows")
+	}
+	return a + b, nil
+}
+
+// ============================================================================================================================
+// Get Balance - the coins a user holds, users that never held coins have 0
+// ============================================================================================================================
+func getBalance(stub shim.ChaincodeStubInterface, user string) (uint64, error) {
+	key, err := createCompositeKey(coinBalanceStr, []string{normalizeUserID(user)})
+	if err != nil {
+		return 0, err
+	}
+	balanceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, errs.New(errs.Internal, "Failed to get balance of "+user)
+	}
+	if len(balanceAsBytes) == 0 {
+		return 0, nil
+	}
+	balance, err := strconv.ParseUint(string(balanceAsBytes), 10, 64)
+	if err != nil {
+		return 0, errs.New(errs.Internal, "Corrupt balance for "+user)
+	}
+	return balance, nil
+}
+
+func putBalance(stub shim.ChaincodeStubInterface, user string, balance uint64) error {
+	key, err := createCompositeKey(coinBalanceStr, []string{normalizeUserID(user)})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(strconv.FormatUint(balance, 10)))
+}
+
+func getSupply(stub shim.ChaincodeStubInterface) (uint64, error) {
+	supplyAsBytes, err := stub.GetState(coinSupplyStr)
+	if err != nil {
+		return 0, errs.New(errs.Internal, "Failed to get total supply")
+	}
+	if len(supplyAsBytes) == 0 {
+		return 0, nil
+	}
+	supply, err := strconv.ParseUint(string(supplyAsBytes), 10, 64)
+	if err != nil {
+		return 0, errs.New(errs.Internal, "Corrupt total supply")
+	}
+	return supply, nil
+}
+
+// ============================================================================================================================
+// Credit Coins - add coins to an account and note it in the account's history
+// ============================================================================================================================
+func creditCoins(stub shim.ChaincodeStubInterface, user string, record CoinRecord) error {
+	balance, err := getBalance(stub, user)
+	if err != nil {
+		return err
+	}
+	balance, err = addCoins(balance, record.Amount)
+	if err != nil {
+		return err
+	}
+	record.Credit = true
+	record.Balance = balance
+	err = putBalance(stub, user, balance)
+	if err != nil {
+		return err
+	}
+	return recordCoins(stub, user, record)
+}
+
+// ============================================================================================================================
+// Debit Coins - take coins from an account and note it in the account's history, the account can't go below 0
+// ============================================================================================================================
+func debitCoins(stub shim.ChaincodeStubInterface, user string, record CoinRecord) error {
+	balance, err := getBalance(stub, user)
+	if err != nil {
+		return err
+	}
+	if balance < record.Amount {
+		return errs.New(errs.Conflict, "Insufficient coins: "+user+" has "+strconv.FormatUint(balance, 10)+", needs "+strconv.FormatUint(record.Amount, 10))
+	}
+	record.Credit = false
+	record.Balance = balance - record.Amount
+	err = putBalance(stub, user, record.Balance)
+	if err != nil {
+		return err
+	}
+	return recordCoins(stub, user, record)
+}
+
+// newCoinRecord stamps a coin record with the running transaction
+func newCoinRecord(stub shim.ChaincodeStubInterface, reason string, amount uint64, counterparty string, ref string) (CoinRecord, error) {
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return CoinRecord{}, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	return CoinRecord{Reason: reason, Amount: amount, Counterparty: counterparty, Ref: ref, TxID: stub.GetTxID(), Timestamp: timestamp}, nil
+}
+
+// byTime orders coin records by their transaction, records of one transaction keep the order they were made in
+type byTime []CoinRecord
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTime) Less(i, j int) bool { return b[i].Timestamp < b[j].Timestamp }
+
+// ============================================================================================================================
+// Get Coin History - every change to a user's coins, oldest first
+// ============================================================================================================================
+func getCoinHistory(stub shim.ChaincodeStubInterface, user string) ([]CoinRecord, error) {
+	user = normalizeUserID(user)
+	history, err := getLegacyCoinHistory(stub, user)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := getStateByPartialCompositeKey(stub, coinHistoryStr, []string{user})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		_, recordAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get coin history of "+user)
+		}
+		var record CoinRecord
+		err = json.Unmarshal(recordAsBytes, &record)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt coin history for "+user)
+		}
+		history = append(history, record)
+	}
+	sort.Stable(byTime(history)) //keys are in tx id order, not in time order
+	return history, nil
+}
+
+// getLegacyCoinHistory reads the single history record of an account from before each change got its own key
+func getLegacyCoinHistory(stub shim.ChaincodeStubInterface, user string) ([]CoinRecord, error) {
+	key, err := createCompositeKey(legacyCoinHistoryStr, []string{user})
+	if err != nil {
+		return nil, err
+	}
+	historyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get coin history of "+user)
+	}
+	history := []CoinRecord{}
+	if len(historyAsBytes) > 0 {
+		err = json.Unmarshal(historyAsBytes, &history)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt coin history for "+user)
+		}
+	}
+	return history, nil
+}
+
+// recordCoins stores the record under its own key so balance changes of an account don't all rewrite one value,
+// n counts the records of the account in this transaction, a raised bid refunds and holds coins in one go
+func recordCoins(stub shim.ChaincodeStubInterface, user string, record CoinRecord) error {
+	user = normalizeUserID(user)
+	iter, err := getStateByPartialCompositeKey(stub, coinHistoryStr, []string{user, record.TxID})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ; iter.HasNext(); n++ {
+		_, _, err = iter.Next()
+		if err != nil {
+			iter.Close()
+			return errs.New(errs.Internal, "Failed to get coin history of "+user)
+		}
+	}
+	iter.Close()
+
+	key, err := createCompositeKey(coinHistoryStr, []string{user, record.TxID, fmt.Sprintf("%04d", n)}) //padded to keep key order
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(record)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Mint - create coins for a user, only the admin can do this
+// ============================================================================================================================
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0      1
+	// "bob", "100"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user and amount")
+	}
+	err := t.authorizeAdmin(stub, "mint coins")
+	if err != nil {
+		return nil, err
+	}
+	user, err := requireUser(stub, args[0])
+	if err != nil {
+		return nil, errs.WithArg(err, 0)
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+
+	supply, err := getSupply(stub)
+	if err != nil {
+		return nil, err
+	}
+	supply, err = addCoins(supply, amount)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(coinSupplyStr, []byte(strconv.FormatUint(supply, 10)))
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := newCoinRecord(stub, coinMint, amount, "", "")
+	if err != nil {
+		return nil, err
+	}
+	err = creditCoins(stub, user, record)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Transfer - send coins to another user, only the sender can do this
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0        1       2
+	// "bob", "alice", "25"
+	if len(args) != 3 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting from, to and amount")
+	}
+	from, err := requireUser(stub, args[0])
+	if err != nil {
+		return nil, errs.WithArg(err, 0)
+	}
+	to, err := requireUser(stub, args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	amount, err := parseAmount(args[2])
+	if err != nil {
+		return nil, errs.WithArg(err, 2)
+	}
+	err = t.authorizeUser(stub, from, "send coins from "+from)
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, errs.New(errs.InvalidArgument, "Cannot send coins to yourself")
+	}
+
+	err = moveCoins(stub, from, to, amount, coinTransfer, "")
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// moveCoins debits one account and credits the other, total supply stays the same
+func moveCoins(stub shim.ChaincodeStubInterface, from string, to string, amount uint64, reason string, ref string) error {
+	record, err := newCoinRecord(stub, reason, amount, to, ref)
+	if err != nil {
+		return err
+	}
+	err = debitCoins(stub, from, record)
+	if err != nil {
+		return err
+	}
+	record.Counterparty = from
+	return creditCoins(stub, to, record)
+}
+
+// ============================================================================================================================
+// Balance Of (query) - the coins a user holds
+// ============================================================================================================================
+func (t *SimpleChaincode) balance_of(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	balance, err := getBalance(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Account{User: normalizeUserID(args[0]), Balance: balance})
+}
+
+// ============================================================================================================================
+// Total Supply (query) - every coin ever minted
+// ============================================================================================================================
+func (t *SimpleChaincode) total_supply(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	supply, err := getSupply(stub)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.FormatUint(supply, 10)), nil
+}
+
+// ============================================================================================================================
+// Coin History (query) - every change to a user's balance, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) coin_history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	history, err := getCoinHistory(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(history)
+}
+
+func getListing(stub shim.ChaincodeStubInterface, name string) (Listing, error) {
+	var listing Listing
+	key, err := createCompositeKey(listingStr, []string{name})
+	if err != nil {
+		return listing, err
+	}
+	listingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return listing, errs.New(errs.Internal, "Failed to get listing for "+name)
+	}
+	if listingAsBytes == nil {
+		return listing, errs.New(errs.NotFound, "Marble "+name+" is not for sale")
+	}
+	err = json.Unmarshal(listingAsBytes, &listing)
+	if err != nil {
+		return listing, errs.New(errs.Internal, "Corrupt listing for "+name)
+	}
+	return listing, nil
+}
+
+// ============================================================================================================================
+// List For Sale - offer a marble for coins, the marble is locked until it is sold or unlisted
+// ============================================================================================================================
+func (t *SimpleChaincode) list_for_sale(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0      1
+	// "m1",  "50"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting marble and price")
+	}
+	price, err := parseAmount(args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	marble, err := getMarble(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.authorizeUser(stub, marble.User, "sell marble "+marble.Name) //only the owner sells a marble
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+
+	listing := Listing{ID: stub.GetTxID(), Marble: marble.Name, Seller: normalizeUserID(marble.User), Price: price, Timestamp: timestamp}
+	err = lockMarble(stub, marble, listing.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := createCompositeKey(listingStr, []string{marble.Name})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(listing)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Unlist Marble - take a marble off sale, only the seller can do this
+// ============================================================================================================================
+func (t *SimpleChaincode) unlist_marble(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "m1"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting marble")
+	}
+	listing, err := getListing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.authorizeUser(stub, listing.Seller, "unlist marble "+listing.Marble)
+	if err != nil {
+		return nil, err
+	}
+	err = closeListing(stub, listing)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// closeListing unlocks the marble and removes the listing
+func closeListing(stub shim.ChaincodeStubInterface, listing Listing) error {
+	err := unlockMarbles(stub, []string{listing.Marble}, listing.ID)
+	if err != nil {
+		return err
+	}
+	key, err := createCompositeKey(listingStr, []string{listing.Marble})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// ============================================================================================================================
+// Buy Marble - pay the asking price and take the marble, coins and marble move together or not at all
+// ============================================================================================================================
+func (t *SimpleChaincode) buy_marble(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	// "m1",  "alice"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting marble and buyer")
+	}
+	listing, err := getListing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	buyer, err := requireUser(stub, args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	err = t.authorizeUser(stub, buyer, "buy as "+buyer)
+	if err != nil {
+		return nil, err
+	}
+	if buyer == listing.Seller {
+		return nil, errs.New(errs.InvalidArgument, "Cannot buy your own marble")
+	}
+	marble, err := getMarble(stub, listing.Marble)
+	if err != nil {
+		return nil, err
+	}
+	if marble.LockedBy != listing.ID || normalizeUserID(marble.User) != listing.Seller {
+		return nil, errs.New(errs.Conflict, "Listing for "+listing.Marble+" is stale, the seller has to list it again")
+	}
+
+	err = moveCoins(stub, buyer, listing.Seller, listing.Price, coinSale, listing.Marble)
+	if err != nil {
+		return nil, err
+	}
+	err = closeListing(stub, listing)
+	if err != nil {
+		return nil, err
+	}
+	err = transferMarble(stub, listing.Marble, buyer, reasonSale, listing.ID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Marbles For Sale (query) - every listing ordered by marble name
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_for_sale(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	iter, err := getStateByPartialCompositeKey(stub, listingStr, []string{})
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get listings")
+	}
+	defer iter.Close()
+
+	listings := []Listing{}
+	for iter.HasNext() {
+		_, listingAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get listings")
+		}
+		var listing Listing
+		err = json.Unmarshal(listingAsBytes, &listing)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt listing")
+		}
+		listings = append(listings, listing)
+	}
+	return json.Marshal(listings)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCoinChaincode is a test chaincode where dave is the admin and alice and bob got 100 coins each
+func newCoinChaincode(t *testing.T) (*SimpleChaincode, *memStub) {
+	t.Helper()
+	cc, stub := newTestChaincode(t)
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "dave", "admin")
+	stub.as("dave")
+	mustInvoke(t, stub, cc, "mint", "alice", "100")
+	mustInvoke(t, stub, cc, "mint", "bob", "100")
+	return cc, stub
+}
+
+func balanceOf(t *testing.T, stub *memStub, cc *SimpleChaincode, user string) uint64 {
+	t.Helper()
+	res, err := stub.query(cc, "balance_of", user)
+	if err != nil {
+		t.Fatalf("balance_of %s failed: %s", user, err)
+	}
+	var account Account
+	if err := json.Unmarshal(res, &account); err != nil {
+		t.Fatalf("balance_of %s returned %s: %s", user, res, err)
+	}
+	return account.Balance
+}
+
+func queryCoinHistory(t *testing.T, stub *memStub, cc *SimpleChaincode, user string) []CoinRecord {
+	t.Helper()
+	res, err := stub.query(cc, "coin_history", user)
+	if err != nil {
+		t.Fatalf("coin_history %s failed: %s", user, err)
+	}
+	var history []CoinRecord
+	if err := json.Unmarshal(res, &history); err != nil {
+		t.Fatalf("coin_history %s returned %s: %s", user, res, err)
+	}
+	return history
+}
+
+func TestAdmin(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	//only admins mint
+	stub.as("dave")
+	mustBeUnauthorized(t, stub, cc, "mint", "alice", "1")
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "dave", "operator")
+	mustBeUnauthorized(t, stub, cc, "mint", "alice", "1")
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "dave", "admin")
+	mustInvoke(t, stub, cc, "mint", "alice", "1")
+}
+
+func TestMint(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+
+	if got := balanceOf(t, stub, cc, "alice"); got != 100 {
+		t.Errorf("alice has %d, want 100", got)
+	}
+	if got := balanceOf(t, stub, cc, "carol"); got != 0 {
+		t.Errorf("carol has %d, want 0", got)
+	}
+	res, err := stub.query(cc, "total_supply")
+	if err != nil || string(res) != "200" {
+		t.Errorf("total_supply = %s, %v", res, err)
+	}
+	history := queryCoinHistory(t, stub, cc, "alice")
+	if len(history) != 1 || history[0].Reason != coinMint || !history[0].Credit || history[0].Amount != 100 || history[0].Balance != 100 {
+		t.Errorf("alice history = %+v", history)
+	}
+
+	mustFail(t, stub, cc, "mint", "alice")
+	mustFail(t, stub, cc, "mint", "nobody", "5")
+	mustFail(t, stub, cc, "mint", "alice", "0")
+	mustFail(t, stub, cc, "mint", "alice", "-5")
+	mustFail(t, stub, cc, "mint", "alice", "lots")
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "mint", "alice", "5")
+}
+
+func TestMintOverflow(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	max := strconv.FormatUint(math.MaxUint64, 10)
+
+	//the supply overflows before any balance does
+	mustFail(t, stub, cc, "mint", "carol", max)
+	mustFail(t, stub, cc, "mint", "carol", "18446744073709551616")
+
+	cc, stub = newTestChaincode(t)
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "dave", "admin")
+	stub.as("dave")
+	mustInvoke(t, stub, cc, "mint", "carol", max)
+	mustFail(t, stub, cc, "mint", "carol", "1")
+	if got := balanceOf(t, stub, cc, "carol"); got != math.MaxUint64 {
+		t.Errorf("carol has %d", got)
+	}
+
+	if _, err := addCoins(math.MaxUint64, 1); err == nil {
+		t.Error("addCoins should catch overflows")
+	}
+	if got, err := addCoins(math.MaxUint64-1, 1); err != nil || got != math.MaxUint64 {
+		t.Errorf("addCoins = %d, %v", got, err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "transfer", "alice", "carol", "30")
+	transferTx, transferAt := stub.txID, stub.txTime.Unix()*1000
+	if a, c := balanceOf(t, stub, cc, "alice"), balanceOf(t, stub, cc, "carol"); a != 70 || c != 30 {
+		t.Errorf("alice %d, carol %d", a, c)
+	}
+	res, _ := stub.query(cc, "total_supply")
+	if string(res) != "200" {
+		t.Errorf("transfers should not change the supply, got %s", res)
+	}
+
+	history := queryCoinHistory(t, stub, cc, "carol")
+	want := CoinRecord{Reason: coinTransfer, Credit: true, Amount: 30, Balance: 30, Counterparty: "alice", TxID: transferTx, Timestamp: transferAt}
+	if len(history) != 1 || history[0] != want {
+		t.Errorf("carol history = %+v, want %+v", history, want)
+	}
+	if h := queryCoinHistory(t, stub, cc, "alice"); h[1].Credit || h[1].Counterparty != "carol" || h[1].Balance != 70 {
+		t.Errorf("alice history = %+v", h)
+	}
+
+	mustFail(t, stub, cc, "transfer", "alice", "carol", "71")
+	mustFail(t, stub, cc, "transfer", "alice", "alice", "1")
+	mustFail(t, stub, cc, "transfer", "alice", "nobody", "1")
+	mustFail(t, stub, cc, "transfer", "alice", "carol", "0")
+	mustFail(t, stub, cc, "transfer", "alice", "carol")
+	mustBeUnauthorized(t, stub, cc, "transfer", "bob", "alice", "1")
+	if got := balanceOf(t, stub, cc, "alice"); got != 70 {
+		t.Errorf("failed transfers should not move coins, alice has %d", got)
+	}
+}
+
+func TestCoinHistoryKeepsEveryChangeApart(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	legacyKey, _ := createCompositeKey(legacyCoinHistoryStr, []string{"alice"})
+	stub.state[legacyKey] = []byte(`[{"reason":"mint","credit":true,"amount":5,"balance":5,"tx_id":"old","timestamp":1}]`)
+
+	stub.as("alice")
+	for i := 0; i < 10; i++ { //tx10 sorts before tx2, the history still comes out in time order
+		mustInvoke(t, stub, cc, "transfer", "alice", "carol", "1")
+	}
+	for key, n := range stub.writes {
+		if strings.HasPrefix(key, compositeKeyNamespace+coinHistoryStr) && n != 1 {
+			t.Errorf("coin history key %q was written %d times, every change should get its own", key, n)
+		}
+	}
+	history := queryCoinHistory(t, stub, cc, "alice")
+	if len(history) != 12 || history[0].TxID != "old" || history[1].Reason != coinMint {
+		t.Fatalf("alice history = %+v", history)
+	}
+	for i, record := range history[2:] {
+		if record.Balance != uint64(99-i) {
+			t.Errorf("record %d = %+v, want a balance of %d", i+2, record, 99-i)
+		}
+	}
+}
+
+func TestBuyMarble(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "list_for_sale", "b1", "60")
+	listing := stub.txID
+	mustBeLocked(t, stub, cc, "set_user", "b1", "carol")
+
+	res, err := stub.query(cc, "marbles_for_sale")
+	var listings []Listing
+	if err != nil || json.Unmarshal(res, &listings) != nil || len(listings) != 1 || listings[0].Price != 60 || listings[0].Seller != "bob" {
+		t.Fatalf("marbles_for_sale = %s, %v", res, err)
+	}
+
+	mustFail(t, stub, cc, "buy_marble", "b1", "bob")
+	stub.as("carol")
+	mustFail(t, stub, cc, "buy_marble", "b1", "carol") //carol has no coins
+	mustBeUnauthorized(t, stub, cc, "buy_marble", "b1", "alice")
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "buy_marble", "b1", "alice")
+	if m := storedMarble(t, stub, "b1"); m.User != "alice" || m.LockedBy != "" {
+		t.Errorf("b1 = %+v", m)
+	}
+	if a, b := balanceOf(t, stub, cc, "alice"), balanceOf(t, stub, cc, "bob"); a != 40 || b != 160 {
+		t.Errorf("alice %d, bob %d", a, b)
+	}
+	if h := queryHistory(t, stub, cc, "b1"); h[len(h)-1].Reason != reasonSale || h[len(h)-1].TradeID != listing {
+		t.Errorf("b1 history = %+v", h)
+	}
+	if h := queryCoinHistory(t, stub, cc, "bob"); h[len(h)-1].Reason != coinSale || h[len(h)-1].Ref != "b1" {
+		t.Errorf("bob coin history = %+v", h)
+	}
+	mustFail(t, stub, cc, "buy_marble", "b1", "alice")
+	if res, _ := stub.query(cc, "marbles_for_sale"); string(res) != "[]" {
+		t.Errorf("marbles_for_sale = %s", res)
+	}
+}
+
+func TestBuyMarbleIsAtomic(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "list_for_sale", "b1", "60")
+
+	stub.as("alice")
+	stub.failPut["b1"] = true
+	mustFail(t, stub, cc, "buy_marble", "b1", "alice")
+	delete(stub.failPut, "b1")
+	if a := balanceOf(t, stub, cc, "alice"); a != 100 || storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("a failed purchase should move neither coins nor marble")
+	}
+}
+
+func TestListForSale(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "list_for_sale", "b1", "5")
+	stub.as("bob")
+	mustFail(t, stub, cc, "list_for_sale", "b1", "0")
+	mustFail(t, stub, cc, "list_for_sale", "nope", "5")
+	mustFail(t, stub, cc, "list_for_sale", "b1")
+	mustInvoke(t, stub, cc, "list_for_sale", "b1", "5")
+	mustBeLocked(t, stub, cc, "list_for_sale", "b1", "6")
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "unlist_marble", "b1")
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "unlist_marble", "b1")
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("unlisting should unlock b1")
+	}
+	mustFail(t, stub, cc, "unlist_marble", "b1")
+	mustFail(t, stub, cc, "buy_marble", "b1", "alice")
+}
+
+func TestCoinAuction(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "mint", "carol", "100")
+	ends := stub.txTime.Add(time.Hour)
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "start_auction", "b1", "10", strconv.FormatInt(ends.Unix()*1000, 10), "gold")
+	mustInvoke(t, stub, cc, "start_auction", "b1", "10", strconv.FormatInt(ends.Unix()*1000, 10), "coin")
+	id := stub.txID
+
+	stub.as("alice")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "5")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "a1")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "20", "30")
+	mustFail(t, stub, cc, "place_bid", id, "alice", "101")
+	mustInvoke(t, stub, cc, "place_bid", id, "alice", "20")
+	if got := balanceOf(t, stub, cc, "alice"); got != 80 {
+		t.Errorf("alice's bid should hold 20 coins, she has %d", got)
+	}
+
+	stub.as("carol")
+	mustFail(t, stub, cc, "place_bid", id, "carol", "20")
+	mustInvoke(t, stub, cc, "place_bid", id, "carol", "50")
+	if a, c := balanceOf(t, stub, cc, "alice"), balanceOf(t, stub, cc, "carol"); a != 100 || c != 50 {
+		t.Errorf("alice should be refunded, alice %d carol %d", a, c)
+	}
+
+	stub.txTime = ends
+	mustInvoke(t, stub, cc, "settle_auction", id)
+	if storedMarble(t, stub, "b1").User != "carol" || balanceOf(t, stub, cc, "bob") != 150 {
+		t.Errorf("carol should own b1 and bob get 50 coins, bob has %d", balanceOf(t, stub, cc, "bob"))
+	}
+	res, _ := stub.query(cc, "total_supply")
+	if string(res) != "300" {
+		t.Errorf("auctions should not change the supply, got %s", res)
+	}
+	reasons := []string{}
+	for _, r := range queryCoinHistory(t, stub, cc, "alice") {
+		reasons = append(reasons, r.Reason)
+	}
+	if len(reasons) != 3 || reasons[1] != coinBid || reasons[2] != coinRefund {
+		t.Errorf("alice coin history reasons = %v", reasons)
+	}
+}
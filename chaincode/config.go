@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+var featuresStr = "_features" //name for the key/value that stores the feature toggles
+
+// Config is what Init takes and get_config returns, Init leaves whatever a config doesn't mention as it is
+type Config struct {
+	Admins   []string     `json:"admins,omitempty"`    //users made admin, Init never demotes anybody
+	Rules    *MarbleRules `json:"rules,omitempty"`     //allowed colors and size/name limits
+	LogLevel string       `json:"log_level,omitempty"` //debug, info, warning or error
+	Features *Features    `json:"features,omitempty"`  //parts of the chaincode that can be switched off
+}
+
+// Features switch parts of the chaincode off, everything a config doesn't switch off stays on
+// winding down still works when a feature is off, trades can be removed and auctions cancelled or settled
+type Features struct {
+	Trades   bool `json:"trades"`   //open_trade, perform_trade and match_trades
+	Auctions bool `json:"auctions"` //start_auction and place_bid
+	Coins    bool `json:"coins"`    //mint, transfer, list_for_sale and buy_marble
+}
+
+var defaultFeatures = Features{Trades: true, Auctions: true, Coins: true}
+
+// featureOf is the feature an invoke function belongs to, functions not listed are always on
+var featureOf = map[string]string{
+	"open_trade":    "trades",
+	"perform_trade": "trades",
+	"match_trades":  "trades",
+	"start_auction": "auctions",
+	"place_bid":     "auctions",
+	"mint":          "coins",
+	"transfer":      "coins",
+	"list_for_sale": "coins",
+	"buy_marble":    "coins",
+}
+
+func (f Features) enabled(feature string) bool {
+	switch feature {
+	case "trades":
+		return f.Trades
+	case "auctions":
+		return f.Auctions
+	case "coins":
+		return f.Coins
+	}
+	return true
+}
+
+// ============================================================================================================================
+// Parse Config - read Init's arguments, no argument or the integer older clients send is an empty config
+// ============================================================================================================================
+func parseConfig(args []string) (Config, error) {
+	var config Config
+	if len(args) > 1 {
+		return config, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting the config as json")
+	}
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return config, nil
+	}
+	if _, err := strconv.Atoi(args[0]); err == nil { //deploy scripts used to send a number
+		return config, nil
+	}
+	var sections map[string]json.RawMessage
+	err := json.Unmarshal([]byte(args[0]), &sections)
+	if err != nil {
+		return config, errs.Arg(0, "Config is not valid json: "+err.Error())
+	}
+	if _, ok := sections["features"]; ok {
+		features := defaultFeatures //switches the config leaves out stay on
+		config.Features = &features
+	}
+	err = json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return config, errs.Arg(0, "Config is not valid json: "+err.Error())
+	}
+	for i, admin := range config.Admins {
+		config.Admins[i] = normalizeUserID(admin)
+		if config.Admins[i] == "" {
+			return config, errs.Arg(0, "Config admins can't be empty")
+		}
+	}
+	if config.LogLevel != "" {
+		level, err := logging.ParseLevel(config.LogLevel)
+		if err != nil {
+			return config, errs.Arg(0, err.Error())
+		}
+		config.LogLevel = level.String()
+	}
+	return config, nil
+}
+
+// ============================================================================================================================
+// Apply Config - store every section the config has, sections it leaves out keep their current value
+// ============================================================================================================================
+func applyConfig(stub shim.ChaincodeStubInterface, config Config) error {
+	if len(config.Admins) > 0 {
+		table, err := loadRoles(stub)
+		if err != nil {
+			return err
+		}
+		for _, admin := range config.Admins {
+			table.Set(admin, roles.Admin)
+		}
+		err = table.Save(stub)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Rules != nil {
+		err := putMarbleRules(stub, *config.Rules)
+		if err != nil {
+			return errs.WithArg(err, 0)
+		}
+	}
+	if config.LogLevel != "" {
+		err := stub.PutState(logging.LevelKey, []byte(config.LogLevel))
+		if err != nil {
+			return err
+		}
+	}
+	if config.Features != nil {
+		jsonAsBytes, _ := json.Marshal(config.Features)
+		err := stub.PutState(featuresStr, jsonAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get Features - the feature toggles in use, everything is on until a config switches something off
+// ============================================================================================================================
+func getFeatures(stub shim.ChaincodeStubInterface) (Features, error) {
+	featuresAsBytes, err := stub.GetState(featuresStr)
+	if err != nil {
+		return Features{}, errs.New(errs.Internal, "Failed to get features")
+	}
+	features := defaultFeatures
+	if len(featuresAsBytes) == 0 {
+		return features, nil
+	}
+	err = json.Unmarshal(featuresAsBytes, &features)
+	if err != nil {
+		return Features{}, errs.New(errs.Internal, "Corrupt features")
+	}
+	return features, nil
+}
+
+// requireFeature refuses functions whose feature is switched off
+func requireFeature(stub shim.ChaincodeStubInterface, function string) error {
+	feature, ok := featureOf[function]
+	if !ok {
+		return nil
+	}
+	features, err := getFeatures(stub)
+	if err != nil {
+		return err
+	}
+	if !features.enabled(feature) {
+		return errs.New(errs.Conflict, "The "+feature+" feature is switched off, "+function+" is not available")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get Config (query) - the configuration in use, every section filled in
+// ============================================================================================================================
+func (t *SimpleChaincode) get_config(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	table, err := loadRoles(stub)
+	if err != nil {
+		return nil, err
+	}
+	config := Config{Admins: []string{}}
+	for _, assignment := range table.Assignments() {
+		if assignment.Role == roles.Admin {
+			config.Admins = append(config.Admins, assignment.User)
+		}
+	}
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	config.Rules = &rules
+	level, err := logging.StoredLevel(stub, defaultLogLevel)
+	if err != nil {
+		return nil, err
+	}
+	config.LogLevel = level.String()
+	features, err := getFeatures(stub)
+	if err != nil {
+		return nil, err
+	}
+	config.Features = &features
+	return json.Marshal(config)
+}
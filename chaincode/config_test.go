@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+func getConfig(t *testing.T, stub *memStub, cc *SimpleChaincode) Config {
+	t.Helper()
+	res, err := stub.query(cc, "get_config")
+	if err != nil {
+		t.Fatalf("get_config failed: %s", err)
+	}
+	var config Config
+	if err := json.Unmarshal(res, &config); err != nil {
+		t.Fatalf("get_config returned %s: %s", res, err)
+	}
+	return config
+}
+
+func TestDeployWithConfig(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := newMemStub()
+	stub.begin()
+	_, err := cc.Init(stub, "init", []string{`{"admins":[" Dave "],"rules":{"colors":["Grey"],"min_size":1,"max_size":5,"max_name_length":8},"log_level":"WARNING","features":{"trades":true,"auctions":false}}`})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+
+	config := getConfig(t, stub, cc)
+	want := Config{
+		Admins:   []string{"dave"},
+		Rules:    &MarbleRules{Colors: []string{"grey"}, MinSize: 1, MaxSize: 5, MaxNameLength: 8},
+		LogLevel: "warning",
+		Features: &Features{Trades: true, Auctions: false, Coins: true},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+	if got := roleOf(t, stub, cc, "dave"); got != roles.Admin {
+		t.Errorf("dave is %s, want admin", got)
+	}
+}
+
+func TestInitKeepsConfig(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	config := getConfig(t, stub, cc)
+	if !reflect.DeepEqual(config.Admins, []string{testAdmin}) || !reflect.DeepEqual(*config.Rules, defaultMarbleRules) ||
+		config.LogLevel != "info" || *config.Features != defaultFeatures {
+		t.Errorf("default config = %+v", config)
+	}
+
+	//sections left out keep their values, admins only come from the deploy
+	stub.as(testAdmin)
+	mustInvoke(t, stub, cc, "init", `{"log_level":"debug"}`)
+	_, err := stub.invoke(cc, "init", `{"admins":["alice"]}`)
+	mustFailWith(t, err, errs.InvalidArgument, 0)
+	config = getConfig(t, stub, cc)
+	if config.LogLevel != "debug" || !reflect.DeepEqual(config.Admins, []string{testAdmin}) {
+		t.Errorf("config = %+v", config)
+	}
+
+	stub.as("bob")
+	mustBeUnauthorized(t, stub, cc, "init", `{"admins":["bob"]}`)
+}
+
+func TestFeatureToggles(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+
+	mustInvokeAs(t, stub, cc, testAdmin, "init", `{"features":{"trades":false,"auctions":true,"coins":false}}`)
+	for _, args := range [][]string{
+		{"open_trade", "bob", "green", "16", "red", "35"},
+		{"match_trades"},
+		{"transfer", "bob", "alice", "1"},
+		{"list_for_sale", "b1", "5"},
+	} {
+		_, err := stub.invoke(cc, args[0], args[1:]...)
+		mustFailWith(t, err, errs.Conflict, -1)
+	}
+
+	//what is already open can still be wound down
+	id := getOpenTrades(t, stub)[0].ID
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	mustInvoke(t, stub, cc, "start_auction", "b1", "1", strconv.FormatInt(stub.txTime.Add(time.Hour).Unix()*1000, 10)) //auctions stayed on
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+)
+
+// eventStub collects the events of one invocation, a transaction carries a single chaincode event so they go out together.
+// It also keeps the owners who gave up marbles on the way, their open trades are rechecked once the invocation worked.
+type eventStub struct {
+	shim.ChaincodeStubInterface
+	batch   events.Batch
+	touched map[string]bool
+}
+
+// emit queues an event for the running invocation, outside of an invocation there is nobody to tell and it is dropped
+func emit(stub shim.ChaincodeStubInterface, event events.Event) {
+	if es, ok := stub.(*eventStub); ok {
+		es.batch.Events = append(es.batch.Events, event)
+	}
+}
+
+// Unwrap lets logging find the logger of the invocation under the events
+func (es *eventStub) Unwrap() shim.ChaincodeStubInterface {
+	return es.ChaincodeStubInterface
+}
+
+// flush sends every queued event as one batch
+func (es *eventStub) flush() error {
+	if len(es.batch.Events) == 0 {
+		return nil
+	}
+	es.batch.TxID = es.GetTxID()
+	payload, _ := json.Marshal(es.batch)
+	return es.SetEvent(events.Name, payload)
+}
+
+func eventDescription(d Description) events.Description {
+	return events.Description{Color: d.Color, Size: d.Size, Quantity: d.Quantity}
+}
+
+func marbleCreated(m Marble) events.Event {
+	return events.Event{Type: events.MarbleCreated, MarbleCreated: &events.MarbleCreatedEvent{Name: m.Name, Color: m.Color, Size: m.Size, Owner: m.User}}
+}
+
+func marbleTransferred(name string, from string, to string, reason string, tradeID string) events.Event {
+	return events.Event{Type: events.MarbleTransferred, MarbleTransferred: &events.MarbleTransferredEvent{Name: name, From: from, To: to, Reason: reason, TradeID: tradeID}}
+}
+
+func marbleDeleted(m Marble) events.Event {
+	return events.Event{Type: events.MarbleDeleted, MarbleDeleted: &events.MarbleDeletedEvent{Name: m.Name, Owner: m.User}}
+}
+
+func tradeOpened(open AnOpenTrade) events.Event {
+	opened := &events.TradeOpenedEvent{ID: open.tradeID(), User: open.User, Want: eventDescription(open.Want), Willing: []events.Description{}, Escrow: open.Escrow, Expires: open.Expires}
+	for _, willing := range open.Willing {
+		opened.Willing = append(opened.Willing, eventDescription(willing))
+	}
+	return events.Event{Type: events.TradeOpened, TradeOpened: opened}
+}
+
+func tradePerformed(open AnOpenTrade, closer string, openerReceived []string, closerReceived []string) events.Event {
+	return events.Event{Type: events.TradePerformed, TradePerformed: &events.TradePerformedEvent{ID: open.tradeID(), Opener: open.User, Closer: closer, OpenerReceived: openerReceived, CloserReceived: closerReceived}}
+}
+
+func tradeRemoved(open AnOpenTrade, reason string) events.Event {
+	return events.Event{Type: events.TradeRemoved, TradeRemoved: &events.TradeRemovedEvent{ID: open.tradeID(), User: open.User, Reason: reason}}
+}
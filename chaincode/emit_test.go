@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+)
+
+// lastBatch decodes the event sent by the last committed transaction
+func lastBatch(t *testing.T, stub *memStub) events.Batch {
+	t.Helper()
+	if stub.lastEvent == nil {
+		t.Fatal("the last transaction sent no event")
+	}
+	if stub.lastEvent.name != events.Name {
+		t.Fatalf("event name = %q, want %q", stub.lastEvent.name, events.Name)
+	}
+	batch, err := events.Decode(stub.lastEvent.payload)
+	if err != nil {
+		t.Fatalf("event payload %s: %s", stub.lastEvent.payload, err)
+	}
+	return batch
+}
+
+func eventTypes(batch events.Batch) []string {
+	types := []string{}
+	for _, e := range batch.Events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestMarbleEvents(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustInvoke(t, stub, cc, "init_marble", "b1", "Blue", "16", "bob")
+	batch := lastBatch(t, stub)
+	if batch.TxID != stub.txID || len(batch.Events) != 1 {
+		t.Fatalf("batch = %+v", batch)
+	}
+	want := &events.MarbleCreatedEvent{Name: "b1", Color: "blue", Size: 16, Owner: "bob"}
+	if !reflect.DeepEqual(batch.Events[0].MarbleCreated, want) {
+		t.Errorf("created = %+v, want %+v", batch.Events[0].MarbleCreated, want)
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	batch = lastBatch(t, stub)
+	moved := &events.MarbleTransferredEvent{Name: "b1", From: "bob", To: "alice", Reason: reasonTransfer}
+	if len(batch.Events) != 1 || !reflect.DeepEqual(batch.Events[0].MarbleTransferred, moved) {
+		t.Errorf("transfer batch = %+v", batch)
+	}
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "delete", "b1")
+	batch = lastBatch(t, stub)
+	if !reflect.DeepEqual(eventTypes(batch), []string{events.MarbleDeleted}) || batch.Events[0].MarbleDeleted.Owner != "alice" {
+		t.Errorf("delete batch = %+v", batch)
+	}
+
+	//plain key/values are not marbles and make no noise
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "k", "v")
+	if stub.lastEvent != nil {
+		t.Errorf("write should send no event, got %s", stub.lastEvent.payload)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "delete", "k")
+	if stub.lastEvent != nil {
+		t.Errorf("deleting a plain key should send no event, got %s", stub.lastEvent.payload)
+	}
+}
+
+func TestTradeEvents(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "60")
+	id := tradeID(t, stub, 0)
+	opened := lastBatch(t, stub).Events[0].TradeOpened
+	want := &events.TradeOpenedEvent{ID: id, User: "bob", Want: events.Description{Color: "green", Size: 16}, Willing: []events.Description{{Color: "blue", Size: 16}}, Expires: getOpenTrades(t, stub)[0].Expires}
+	if !reflect.DeepEqual(opened, want) {
+		t.Errorf("opened = %+v, want %+v", opened, want)
+	}
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	batch := lastBatch(t, stub)
+	types := []string{events.MarbleTransferred, events.MarbleTransferred, events.TradePerformed}
+	if !reflect.DeepEqual(eventTypes(batch), types) {
+		t.Fatalf("perform batch types = %v, want %v", eventTypes(batch), types)
+	}
+	performed := &events.TradePerformedEvent{ID: id, Opener: "bob", Closer: "alice", OpenerReceived: []string{"a1"}, CloserReceived: []string{"b1"}}
+	if !reflect.DeepEqual(batch.Events[2].TradePerformed, performed) {
+		t.Errorf("performed = %+v, want %+v", batch.Events[2].TradePerformed, performed)
+	}
+	if batch.Events[0].MarbleTransferred.TradeID != id || batch.Events[0].MarbleTransferred.Reason != reasonTrade {
+		t.Errorf("trade transfer = %+v", batch.Events[0].MarbleTransferred)
+	}
+
+	mustInvoke(t, stub, cc, "open_trade", "alice", "red", "35", "blue", "16")
+	id = tradeID(t, stub, 0)
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	removed := lastBatch(t, stub).Events[0].TradeRemoved
+	if !reflect.DeepEqual(removed, &events.TradeRemovedEvent{ID: id, User: "alice", Reason: events.RemovedByUser}) {
+		t.Errorf("removed = %+v", removed)
+	}
+}
+
+func TestCleanTradesEvents(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	//giving b1 away leaves the trade with nothing to offer
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", "carol")
+	batch := lastBatch(t, stub)
+	if !reflect.DeepEqual(eventTypes(batch), []string{events.MarbleTransferred, events.TradeRemoved}) {
+		t.Fatalf("batch types = %v", eventTypes(batch))
+	}
+	if r := batch.Events[1].TradeRemoved; r.ID != id || r.Reason != events.RemovedStale {
+		t.Errorf("removed = %+v", r)
+	}
+}
+
+func TestFailedInvokeSendsNoEvent(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	before := stub.lastEvent
+
+	stub.failPut[marbleIndexStr] = true
+	stub.as("bob")
+	mustFail(t, stub, cc, "delete", "b1")
+	if stub.event != nil {
+		t.Errorf("a failed transaction should not send its events, got %s", stub.event.payload)
+	}
+	if stub.lastEvent != before {
+		t.Error("the last committed event should not change")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// mustFailWith checks err is a coded error, arg is the argument it should blame or -1 for none
+func mustFailWith(t *testing.T, err error, code errs.Code, arg int) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("want a %s error, got none", code)
+	}
+	e, ok := errs.Parse(err.Error())
+	if !ok {
+		t.Fatalf("error is not coded: %s", err)
+	}
+	if e.Code != code {
+		t.Errorf("code = %s, want %s (%s)", e.Code, code, e.Message)
+	}
+	if arg < 0 && e.Arg != nil {
+		t.Errorf("arg = %d, want none (%s)", *e.Arg, e.Message)
+	}
+	if arg >= 0 && (e.Arg == nil || *e.Arg != arg) {
+		t.Errorf("arg = %v, want %d (%s)", e.Arg, arg, e.Message)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "red", "16", "escrow", "b1")
+
+	cases := []struct {
+		name     string
+		function string
+		args     []string
+		code     errs.Code
+		arg      int
+	}{
+		{"unknown function", "fly", nil, errs.InvalidArgument, -1},
+		{"argument count", "init_marble", []string{"c1"}, errs.InvalidArgument, -1},
+		{"bad color", "init_marble", []string{"c1", "grey", "16", "bob"}, errs.InvalidArgument, 1},
+		{"bad size", "init_marble", []string{"c1", "blue", "big", "bob"}, errs.InvalidArgument, 2},
+		{"unknown owner", "init_marble", []string{"c1", "blue", "16", "eve"}, errs.NotFound, 3},
+		{"duplicate marble", "init_marble", []string{"a1", "blue", "16", "bob"}, errs.AlreadyExists, -1},
+		{"missing marble", "set_user", []string{"zz", "bob"}, errs.NotFound, -1},
+		{"someone else's marble", "set_user", []string{"a1", "bob"}, errs.Unauthorized, -1},
+		{"escrowed marble", "delete", []string{"b1"}, errs.Conflict, -1},
+		{"missing trade", "perform_trade", []string{"nope", "alice", "a1", "bob", "blue", "16"}, errs.NotFound, -1},
+		{"unknown closer", "perform_trade", []string{"nope", "eve", "a1", "bob", "blue", "16"}, errs.NotFound, 1},
+		{"bad trade size", "open_trade", []string{"bob", "red", "16", "blue", "x"}, errs.InvalidArgument, 4},
+		{"bad trade color", "open_trade", []string{"bob", "red", "16", "grey", "16"}, errs.InvalidArgument, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := stub.invoke(cc, c.function, c.args...)
+			mustFailWith(t, err, c.code, c.arg)
+		})
+	}
+
+	_, err := stub.query(cc, "get_marble", "zz")
+	mustFailWith(t, err, errs.NotFound, -1)
+	_, err = stub.query(cc, "list_marbles", "0")
+	mustFailWith(t, err, errs.InvalidArgument, 0)
+	_, err = stub.query(cc, "fly")
+	mustFailWith(t, err, errs.InvalidArgument, -1)
+
+	_, err = stub.query(cc, "list_marbles", "1", "bad\x00bookmark")
+	mustFailWith(t, err, errs.InvalidArgument, 1)
+
+	mustInvoke(t, stub, cc, "init_marble", "zz", "blue", "16", "bob")
+	stub.failGet["zz"] = true
+	_, err = stub.query(cc, "list_marbles")
+	mustFailWith(t, err, errs.Internal, -1)
+}
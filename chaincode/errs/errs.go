@@ -0,0 +1,109 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package errs is the error model of the marbles and scrutin chaincodes.
+//
+// Every error a chaincode returns is an *Error, and its text is the error as json, ie
+//
+//	{"code":"NOT_FOUND","arg":0,"message":"Marble does not exist: m1"}
+//
+// so clients branch on Code instead of matching messages. Go clients read it back with Parse,
+// other clients JSON.parse the error message. Arg is the index of the argument at fault and is
+// left out when the error is not about one argument.
+package errs
+
+import "encoding/json"
+
+// Code is the stable reason a request failed, messages can change but codes don't
+type Code string
+
+const (
+	NotFound        Code = "NOT_FOUND"        //the marble, trade, user... named in the request does not exist
+	AlreadyExists   Code = "ALREADY_EXISTS"   //something by that name already exists
+	InvalidArgument Code = "INVALID_ARGUMENT" //the request itself is wrong, retrying it won't help
+	Unauthorized    Code = "UNAUTHORIZED"     //the caller is not allowed to do this
+	Conflict        Code = "CONFLICT"         //the request is fine but the state doesn't allow it right now, ie a locked marble
+	Internal        Code = "INTERNAL"         //the ledger failed or holds something unreadable
+)
+
+type Error struct {
+	Code    Code   `json:"code"`
+	Arg     *int   `json:"arg,omitempty"` //index of the argument at fault, nil when no single argument is
+	Message string `json:"message"`       //for humans, don't branch on it
+}
+
+// Error is the json of the error, that is what reaches the client
+func (e *Error) Error() string {
+	jsonAsBytes, _ := json.Marshal(e)
+	return string(jsonAsBytes)
+}
+
+// New makes an error that is not about a single argument
+func New(code Code, message string) error {
+	return &Error{Code: code, Message: message}
+}
+
+// Arg makes an INVALID_ARGUMENT error about argument i
+func Arg(i int, message string) error {
+	return &Error{Code: InvalidArgument, Arg: &i, Message: message}
+}
+
+// From is err as an *Error, anything that isn't one already is INTERNAL
+func From(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: Internal, Message: err.Error()}
+}
+
+// Wrap makes sure a non nil err is an *Error, it is what the chaincode entry points return
+func Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return From(err)
+}
+
+// WithArg blames argument i for err, keeping its code
+func WithArg(err error, i int) error {
+	e := *From(err)
+	e.Arg = &i
+	return &e
+}
+
+// Prefix puts more context in front of err's message, keeping its code and argument
+func Prefix(prefix string, err error) error {
+	e := *From(err)
+	e.Message = prefix + e.Message
+	return &e
+}
+
+// CodeOf is the code of err, INTERNAL for errors that aren't an *Error
+func CodeOf(err error) Code {
+	return From(err).Code
+}
+
+// Parse reads an error message returned by the chaincode, ok is false when it isn't one of ours
+func Parse(message string) (e *Error, ok bool) {
+	e = &Error{}
+	if json.Unmarshal([]byte(message), e) != nil || e.Code == "" {
+		return nil, false
+	}
+	return e, true
+}
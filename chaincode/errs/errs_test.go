@@ -0,0 +1,51 @@
+package errs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorJSON(t *testing.T) {
+	err := Arg(0, `Marble "m1" is bad`)
+	want := `{"code":"INVALID_ARGUMENT","arg":0,"message":"Marble \"m1\" is bad"}`
+	if err.Error() != want {
+		t.Errorf("Error() = %s, want %s", err.Error(), want)
+	}
+	if got := New(NotFound, "gone").Error(); got != `{"code":"NOT_FOUND","message":"gone"}` {
+		t.Errorf("New().Error() = %s", got)
+	}
+
+	e, ok := Parse(err.Error())
+	if !ok || e.Code != InvalidArgument || e.Arg == nil || *e.Arg != 0 || e.Message != `Marble "m1" is bad` {
+		t.Errorf("Parse = %+v, %v", e, ok)
+	}
+	for _, message := range []string{"Failed to get thing", `{"Error":"Failed to get state"}`, ""} {
+		if e, ok := Parse(message); ok {
+			t.Errorf("Parse(%q) = %+v, want not ok", message, e)
+		}
+	}
+}
+
+func TestWrapping(t *testing.T) {
+	if Wrap(nil) != nil {
+		t.Error("Wrap(nil) should be nil")
+	}
+	plain := errors.New("disk on fire")
+	if CodeOf(plain) != Internal || CodeOf(Wrap(plain)) != Internal || From(plain).Message != "disk on fire" {
+		t.Errorf("plain errors should become INTERNAL, got %s", Wrap(plain))
+	}
+
+	original := New(Conflict, "locked")
+	blamed := From(WithArg(original, 3))
+	if blamed.Code != Conflict || blamed.Arg == nil || *blamed.Arg != 3 {
+		t.Errorf("WithArg = %+v", blamed)
+	}
+	if From(original).Arg != nil {
+		t.Error("WithArg changed the original error")
+	}
+
+	prefixed := From(Prefix("Cannot escrow m1: ", WithArg(original, 1)))
+	if prefixed.Code != Conflict || *prefixed.Arg != 1 || prefixed.Message != "Cannot escrow m1: locked" {
+		t.Errorf("Prefix = %+v", prefixed)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var escrowMarker = "escrow"     //open_trade argument that switches from descriptions to named marbles
+var escrowBundleSeparator = "+" //"m1+m2" escrows both marbles as one option, they must be alike
+
+// ============================================================================================================================
+// Escrow Marbles - lock the named marbles for a trade, the trade is willing to give exactly these marbles
+// ============================================================================================================================
+func (t *SimpleChaincode) escrowMarbles(stub shim.ChaincodeStubInterface, open *AnOpenTrade, options []string) error {
+	err := t.authorizeUser(stub, open.User, "escrow marbles for "+open.User) //only the owner can lock marbles up
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, option := range options {
+		bundle := Description{}
+		names := strings.Split(option, escrowBundleSeparator)
+		for _, name := range names {
+			if seen[name] {
+				return errs.New(errs.InvalidArgument, "Marble "+name+" is escrowed twice")
+			}
+			seen[name] = true
+
+			marble, err := getMarble(stub, name)
+			if err != nil {
+				return errs.Prefix("Cannot escrow "+name+": ", err)
+			}
+			if normalizeUserID(marble.User) != open.User {
+				return errs.New(errs.Conflict, "Marble "+name+" is not owned by "+open.User)
+			}
+			if marble.LockedBy != "" {
+				return errs.New(errs.Conflict, "Marble "+name+" is locked by "+marble.LockedBy)
+			}
+			if bundle.Color == "" {
+				bundle = Description{Color: marble.Color, Size: marble.Size}
+			} else if !strings.EqualFold(bundle.Color, marble.Color) || bundle.Size != marble.Size {
+				return errs.New(errs.InvalidArgument, "Escrowed bundle "+option+" mixes different marbles")
+			}
+
+			marble.LockedBy = open.ID
+			err = putMarble(stub, marble)
+			if err != nil {
+				return err
+			}
+			open.Escrow = append(open.Escrow, marble.Name)
+		}
+		if len(names) > 1 {
+			bundle.Quantity = len(names)
+		}
+		open.Willing = append(open.Willing, bundle)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Release Escrow - unlock every marble a trade still holds, marbles that moved on or got relocked are left alone
+// ============================================================================================================================
+func releaseEscrow(stub shim.ChaincodeStubInterface, open AnOpenTrade) error {
+	return unlockMarbles(stub, open.Escrow, open.ID)
+}
+
+// escrows tells if the trade holds the named marble in escrow
+func (open AnOpenTrade) escrows(name string) bool {
+	for _, escrowed := range open.Escrow {
+		if escrowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lockMarble locks a marble for a trade or auction
+func lockMarble(stub shim.ChaincodeStubInterface, marble Marble, lockID string) error {
+	if marble.LockedBy != "" {
+		return errs.New(errs.Conflict, "Marble "+marble.Name+" is locked by "+marble.LockedBy)
+	}
+	marble.LockedBy = lockID
+	return putMarble(stub, marble)
+}
+
+// unlockMarbles releases every named marble still held by lockID
+func unlockMarbles(stub shim.ChaincodeStubInterface, names []string, lockID string) error {
+	for _, name := range names {
+		marble, err := getMarble(stub, name)
+		if err != nil { //gone, nothing to unlock
+			continue
+		}
+		if marble.LockedBy != lockID {
+			continue
+		}
+		marble.LockedBy = ""
+		err = putMarble(stub, marble)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Openers Marbles 4 Trade - the opener's marbles that settle this option, escrowed trades only settle with their own marbles
+// ============================================================================================================================
+func openersMarbles4Trade(stub shim.ChaincodeStubInterface, open AnOpenTrade, color string, size int, count int) ([]Marble, error) {
+	if len(open.Escrow) == 0 {
+		return findMarbles4Trade(stub, open.User, color, size, count)
+	}
+
+	var found []Marble
+	for _, name := range open.Escrow {
+		marble, err := getMarble(stub, name)
+		if err != nil {
+			continue
+		}
+		if marble.LockedBy == open.ID && normalizeUserID(marble.User) == open.User &&
+			strings.ToLower(marble.Color) == strings.ToLower(color) && marble.Size == size {
+			found = append(found, marble)
+			if len(found) == count {
+				return found, nil
+			}
+		}
+	}
+	return nil, errs.New(errs.Conflict, "Did not find an escrowed marble of that color and size")
+}
+
+func putMarble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	marble.Schema = marbleSchema.Current()
+	jsonAsBytes, _ := json.Marshal(marble)
+	return stub.PutState(marble.Name, jsonAsBytes)
+}
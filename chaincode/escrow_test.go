@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustBeLocked(t *testing.T, stub *memStub, cc *SimpleChaincode, function string, args ...string) {
+	t.Helper()
+	err := mustFail(t, stub, cc, function, args...)
+	if !strings.Contains(err.Error(), "is locked by") {
+		t.Errorf("%s%v: want a lock error, got %s", function, args, err)
+	}
+}
+
+func TestOpenEscrowTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1", "b2")
+	id := tradeID(t, stub, 0)
+	trade := getOpenTrades(t, stub)[0]
+	if !reflect.DeepEqual(trade.Escrow, []string{"b1", "b2"}) {
+		t.Errorf("escrow = %v", trade.Escrow)
+	}
+	want := []Description{{Color: "blue", Size: 16}, {Color: "red", Size: 35}}
+	if !reflect.DeepEqual(trade.Willing, want) {
+		t.Errorf("willing = %+v, want %+v", trade.Willing, want)
+	}
+	for _, name := range []string{"b1", "b2"} {
+		if got := storedMarble(t, stub, name).LockedBy; got != id {
+			t.Errorf("%s locked by %q, want %q", name, got, id)
+		}
+	}
+
+	//locked marbles stay put
+	mustBeLocked(t, stub, cc, "set_user", "b1", "carol")
+	mustBeLocked(t, stub, cc, "delete", "b2")
+	mustBeLocked(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1")
+	if storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("b1 should still be bob's")
+	}
+
+	//and are not picked to settle description trades either
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", tradeID(t, stub, 1), "alice", "a1", "bob", "blue", "16")
+}
+
+func TestOpenEscrowTradeErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1")
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "a1")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "nope")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1", "b1")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1", "a1")
+
+	//a failed open leaves nothing locked
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("no trade should be open")
+	}
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("b1 should not be locked")
+	}
+}
+
+func TestPerformEscrowTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "b3", "blue", "16", "bob")
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b3", "b2")
+	id := tradeID(t, stub, 0)
+
+	//b1 is the same kind of marble but was not escrowed, b3 is the one that settles
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+
+	if m := storedMarble(t, stub, "b3"); m.User != "alice" || m.LockedBy != "" {
+		t.Errorf("b3 = %+v, want alice's and unlocked", m)
+	}
+	if m := storedMarble(t, stub, "b1"); m.User != "bob" {
+		t.Errorf("b1 = %+v, want bob's", m)
+	}
+	if m := storedMarble(t, stub, "b2"); m.User != "bob" || m.LockedBy != "" {
+		t.Errorf("b2 = %+v, want bob's and unlocked", m)
+	}
+	if storedMarble(t, stub, "a1").User != "bob" {
+		t.Error("a1 should be bob's")
+	}
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("trade should be closed")
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b2", "carol")
+}
+
+func TestPerformTradeWithLockedMarble(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "red", "35", "escrow", "a1")
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	bobs := tradeID(t, stub, 1)
+
+	//alice's green 16 is promised to her own trade and cannot close bob's
+	stub.as("alice")
+	mustBeLocked(t, stub, cc, "perform_trade", bobs, "alice", "a1", "bob", "blue", "16")
+}
+
+func TestRemoveEscrowTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1")
+	id := tradeID(t, stub, 0)
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "remove_trade", id)
+	if storedMarble(t, stub, "b1").LockedBy != id {
+		t.Error("b1 should still be locked")
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("removing the trade should unlock b1")
+	}
+	mustInvoke(t, stub, cc, "set_user", "b1", "carol")
+}
+
+func TestCleanTradesReleasesEscrow(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1")
+	id := tradeID(t, stub, 0)
+	//a raw write hands the still locked marble to carol, the trade can no longer settle
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "b1", `{"name":"b1","color":"blue","size":16,"user":"carol","locked_by":"`+id+`"}`)
+	mustInvoke(t, stub, cc, "set_user", "b2", "carol")
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Errorf("trade should be cleaned out, got %+v", getOpenTrades(t, stub))
+	}
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("cleaning the trade should unlock b1")
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package events holds the payloads the marbles chaincode sends as chaincode events.
+//
+// A transaction can only carry one chaincode event, so everything that happened in a
+// transaction is sent as one Batch under the event name Name. Consumers decode the
+// payload with Decode and switch on each Event's Type.
+package events
+
+import "encoding/json"
+
+// Name is the chaincode event name every batch is sent under
+const Name = "marbles"
+
+// Event types
+const (
+	MarbleCreated     = "marble_created"
+	MarbleTransferred = "marble_transferred"
+	MarbleDeleted     = "marble_deleted"
+	TradeOpened       = "trade_opened"
+	TradePerformed    = "trade_performed"
+	TradeRemoved      = "trade_removed"
+)
+
+// Reasons a trade is removed without being performed
+const (
+	RemovedByUser = "removed" //remove_trade
+	RemovedStale  = "stale"   //the opener can no longer give any of the marbles offered
+	RemovedExpiry = "expired" //the trade's time to live ran out
+	RemovedMatch  = "matched" //closed as part of a match_trades ring
+)
+
+type Description struct {
+	Color    string `json:"color"`
+	Size     int    `json:"size"`
+	Quantity int    `json:"quantity,omitempty"` //0 is the same as 1
+}
+
+type MarbleCreatedEvent struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Size  int    `json:"size"`
+	Owner string `json:"owner"`
+}
+
+type MarbleTransferredEvent struct {
+	Name    string `json:"name"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Reason  string `json:"reason"`             //transfer, trade, auction or sale
+	TradeID string `json:"trade_id,omitempty"` //trade, auction or listing that moved the marble
+}
+
+type MarbleDeletedEvent struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+type TradeOpenedEvent struct {
+	ID      string        `json:"id"`
+	User    string        `json:"user"`
+	Want    Description   `json:"want"`
+	Willing []Description `json:"willing"`
+	Escrow  []string      `json:"escrow,omitempty"`
+	Expires int64         `json:"expires,omitempty"`
+}
+
+type TradePerformedEvent struct {
+	ID             string   `json:"id"`
+	Opener         string   `json:"opener"`
+	Closer         string   `json:"closer"`
+	OpenerReceived []string `json:"opener_received"` //marbles the closer gave
+	CloserReceived []string `json:"closer_received"` //marbles the opener gave
+}
+
+type TradeRemovedEvent struct {
+	ID     string `json:"id"`
+	User   string `json:"user"`
+	Reason string `json:"reason"` //removed, stale, expired or matched
+}
+
+// Event is one thing that happened, the field named like Type is set
+type Event struct {
+	Type              string                  `json:"type"`
+	MarbleCreated     *MarbleCreatedEvent     `json:"marble_created,omitempty"`
+	MarbleTransferred *MarbleTransferredEvent `json:"marble_transferred,omitempty"`
+	MarbleDeleted     *MarbleDeletedEvent     `json:"marble_deleted,omitempty"`
+	TradeOpened       *TradeOpenedEvent       `json:"trade_opened,omitempty"`
+	TradePerformed    *TradePerformedEvent    `json:"trade_performed,omitempty"`
+	TradeRemoved      *TradeRemovedEvent      `json:"trade_removed,omitempty"`
+}
+
+// Batch is the payload of one chaincode event, the events of a transaction in the order they happened
+type Batch struct {
+	TxID   string  `json:"tx_id"`
+	Events []Event `json:"events"`
+}
+
+// Decode reads the payload of a chaincode event named Name
+func Decode(payload []byte) (Batch, error) {
+	var batch Batch
+	err := json.Unmarshal(payload, &batch)
+	return batch, err
+}
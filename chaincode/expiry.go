@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+)
+
+var ttlMarker = "ttl"                 //open_trade argument followed by the trade's time to live in seconds, never a marble name
+var maxTTL int64 = 366 * 24 * 60 * 60 //longest time to live, a year keeps the expiry in ms far from overflowing
+
+// parseTTL strips a trailing "ttl", "<seconds>" pair off open_trade's arguments, 0 means the trade never expires
+func parseTTL(args []string) (int64, []string, error) {
+	if len(args) < 2 || args[len(args)-2] != ttlMarker {
+		return 0, args, nil
+	}
+	ttl, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+	if err != nil || ttl <= 0 || ttl > maxTTL {
+		return 0, args, errs.New(errs.InvalidArgument, "ttl must be 1 to "+strconv.FormatInt(maxTTL, 10)+" seconds")
+	}
+	return ttl, args[:len(args)-2], nil
+}
+
+// ============================================================================================================================
+// Expire Trades - remove every open trade whose time to live ran out, returns the trades that were removed
+// ============================================================================================================================
+// Cleaning up after a transfer only rereads the trades of owners who gave up marbles, this is the one sweep over all of them.
+func (t *SimpleChaincode) expire_trades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	trades, err := getAllTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []AnOpenTrade{}
+	for _, open := range trades.OpenTrades {
+		if !open.isExpired(now) {
+			continue
+		}
+		err = releaseEscrow(stub, open) //escrowed marbles go back to the opener
+		if err != nil {
+			return nil, err
+		}
+		err = deleteTrade(stub, open)
+		if err != nil {
+			return nil, err
+		}
+		emit(stub, tradeRemoved(open, events.RemovedExpiry))
+		logFor(stub).Info("trade removed", "trade", open.tradeID(), "user", open.User, "reason", events.RemovedExpiry)
+		expired = append(expired, open)
+	}
+
+	return json.Marshal(expired)
+}
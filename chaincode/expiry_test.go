@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+func TestOpenTradeTTL(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "60")
+	trade := getOpenTrades(t, stub)[0]
+	if trade.Expires != trade.Timestamp+60000 {
+		t.Errorf("expires = %d, want %d", trade.Expires, trade.Timestamp+60000)
+	}
+	if len(trade.Willing) != 1 {
+		t.Errorf("ttl should not be read as a willing option, got %+v", trade.Willing)
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b2", "ttl", "60")
+	if trade := getOpenTrades(t, stub)[1]; trade.Expires == 0 || len(trade.Escrow) != 1 {
+		t.Errorf("escrow trade = %+v", trade)
+	}
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	if getOpenTrades(t, stub)[2].Expires != 0 {
+		t.Error("a trade without ttl should never expire")
+	}
+
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "0")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "soon")
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl")
+	err := mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "9223372036854775807")
+	mustFailWith(t, err, errs.InvalidArgument, -1)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", strconv.FormatInt(maxTTL, 10))
+	if trade := getOpenTrades(t, stub)[3]; trade.Expires != trade.Timestamp+maxTTL*1000 {
+		t.Errorf("the longest ttl should expire in a year, got %+v", trade)
+	}
+}
+
+func TestTTLIsNoMarbleName(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	err := mustFail(t, stub, cc, "init_marble", ttlMarker, "blue", "16", "bob")
+	mustFailWith(t, err, errs.InvalidArgument, 0)
+	mustInvoke(t, stub, cc, "init_marble", "TTL", "blue", "16", "bob")
+}
+
+func TestPerformExpiredTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "60")
+	id := tradeID(t, stub, 0)
+
+	stub.txTime = stub.txTime.Add(time.Minute)
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	if storedMarble(t, stub, "a1").User != "alice" {
+		t.Error("an expired trade should not move marbles")
+	}
+}
+
+func TestCleanTradesDropsExpired(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1", "ttl", "60")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35", "ttl", "3600")
+
+	mustInvoke(t, stub, cc, "init_marble", "b3", "blue", "16", "bob")
+
+	//cleaning only rereads the trades of whoever gave up marbles, bob's expired trade waits for him
+	stub.txTime = stub.txTime.Add(time.Minute)
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "set_user", "a1", "carol")
+	if trades := getOpenTrades(t, stub); len(trades) != 2 {
+		t.Errorf("alice's transfer should leave bob's trades alone, got %+v", trades)
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b3", "alice")
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 1 || trades[0].Willing[0].Color != "red" {
+		t.Errorf("only the hour long trade should survive, got %+v", trades)
+	}
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("the expired trade should release b1")
+	}
+}
+
+func TestExpireTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b1", "ttl", "60")
+	first := tradeID(t, stub, 0)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35", "ttl", "3600")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35")
+
+	//nothing is due yet
+	res := mustInvoke(t, stub, cc, "expire_trades")
+	if string(res) != "[]" || len(getOpenTrades(t, stub)) != 3 {
+		t.Errorf("expire_trades = %s", res)
+	}
+
+	stub.txTime = stub.txTime.Add(time.Minute)
+	res = mustInvoke(t, stub, cc, "expire_trades")
+	var removed []AnOpenTrade
+	if err := json.Unmarshal(res, &removed); err != nil || len(removed) != 1 || removed[0].ID != first {
+		t.Errorf("expire_trades = %s, want %s removed", res, first)
+	}
+	if len(getOpenTrades(t, stub)) != 2 {
+		t.Error("two trades should still be open")
+	}
+	if storedMarble(t, stub, "b1").LockedBy != "" {
+		t.Error("expiring the trade should release b1")
+	}
+
+	stub.txTime = stub.txTime.Add(time.Hour)
+	mustInvoke(t, stub, cc, "expire_trades")
+	if trades := getOpenTrades(t, stub); len(trades) != 1 || trades[0].Expires != 0 {
+		t.Errorf("only the trade without ttl should be left, got %+v", trades)
+	}
+
+	stub.failGet[tradeKeyOf(t, tradeID(t, stub, 0))] = true
+	mustFail(t, stub, cc, "expire_trades")
+}
+
+func TestMatchTradesSkipsExpired(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "ttl", "60")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+	if len(queryMatches(t, stub, cc)) != 1 {
+		t.Fatal("the trades should match before expiry")
+	}
+
+	stub.txTime = stub.txTime.Add(time.Minute)
+	if got := queryMatches(t, stub, cc); len(got) != 0 {
+		t.Errorf("preview = %+v, want none", got)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+	if storedMarble(t, stub, "a1").User != "alice" {
+		t.Error("an expired trade should not be matched")
+	}
+}
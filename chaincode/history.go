@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var historyStr = "history~name~tx~n"  //composite key type of one ownership change of a marble
+var legacyHistoryStr = "history~name" //composite key type of a whole ownership history, before each change got its own key
+
+var reasonCreate = "create"     //marble was made
+var reasonTransfer = "transfer" //set_user moved the marble
+var reasonTrade = "trade"       //marble changed hands in perform_trade
+var reasonAuction = "auction"   //marble was sold or paid in an auction
+var reasonSale = "sale"         //marble was bought with coins
+var reasonImport = "import"     //import_state created the marble or changed its owner
+
+type OwnershipRecord struct {
+	PrevOwner string `json:"prev_owner"`         //empty when the marble was created
+	NewOwner  string `json:"new_owner"`          //owner after this change
+	Reason    string `json:"reason"`             //create, transfer, trade, auction, sale or import
+	TradeID   string `json:"trade_id,omitempty"` //id of the open trade, auction or listing that moved the marble
+	TxID      string `json:"tx_id"`              //transaction that made the change
+	Timestamp int64  `json:"timestamp"`          //utc timestamp of the transaction in ms
+}
+
+// byChange orders ownership records by their transaction, records of one transaction keep the order they were made in
+type byChange []OwnershipRecord
+
+func (b byChange) Len() int           { return len(b) }
+func (b byChange) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byChange) Less(i, j int) bool { return b[i].Timestamp < b[j].Timestamp }
+
+// ============================================================================================================================
+// Get History - read the ownership records of a marble, oldest first
+// ============================================================================================================================
+func getHistory(stub shim.ChaincodeStubInterface, name string) ([]OwnershipRecord, error) {
+	history, err := getLegacyHistory(stub, name)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := getStateByPartialCompositeKey(stub, historyStr, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		_, recordAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get history for "+name)
+		}
+		var record OwnershipRecord
+		err = json.Unmarshal(recordAsBytes, &record)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt history for "+name)
+		}
+		history = append(history, record)
+	}
+	sort.Stable(byChange(history)) //keys are in tx id order, not in time order
+	return history, nil
+}
+
+// getLegacyHistory reads the single history record of a marble from before each change got its own key
+func getLegacyHistory(stub shim.ChaincodeStubInterface, name string) ([]OwnershipRecord, error) {
+	key, err := createCompositeKey(legacyHistoryStr, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	historyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get history for "+name)
+	}
+	history := []OwnershipRecord{}
+	if len(historyAsBytes) > 0 {
+		err = json.Unmarshal(historyAsBytes, &history)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt history for "+name)
+		}
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Record Ownership - store a provenance entry of a marble under its own key, a marble's history is never rewritten
+// ============================================================================================================================
+// n counts the records of the marble in this transaction so no record of it overwrites another
+func recordOwnership(stub shim.ChaincodeStubInterface, name string, prevOwner string, newOwner string, reason string, tradeID string) error {
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	txID := stub.GetTxID()
+	iter, err := getStateByPartialCompositeKey(stub, historyStr, []string{name, txID})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ; iter.HasNext(); n++ {
+		_, _, err = iter.Next()
+		if err != nil {
+			iter.Close()
+			return errs.New(errs.Internal, "Failed to get history for "+name)
+		}
+	}
+	iter.Close()
+
+	record := OwnershipRecord{
+		PrevOwner: prevOwner,
+		NewOwner:  newOwner,
+		Reason:    reason,
+		TradeID:   tradeID,
+		TxID:      txID,
+		Timestamp: timestamp,
+	}
+	key, err := createCompositeKey(historyStr, []string{name, txID, fmt.Sprintf("%04d", n)}) //padded to keep key order
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(record)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Marble History - return every ownership change of a marble, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) marble_history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "name"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting name of the marble")
+	}
+
+	history, err := getHistory(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 { //marbles made before provenance was tracked have no history yet
+		_, err = getMarble(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(history)
+}
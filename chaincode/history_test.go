@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func queryHistory(t *testing.T, stub *memStub, cc *SimpleChaincode, name string) []OwnershipRecord {
+	t.Helper()
+	res, err := stub.query(cc, "marble_history", name)
+	if err != nil {
+		t.Fatalf("marble_history %s failed: %s", name, err)
+	}
+	var history []OwnershipRecord
+	if err := json.Unmarshal(res, &history); err != nil {
+		t.Fatalf("marble_history %s returned %s: %s", name, res, err)
+	}
+	return history
+}
+
+func TestMarbleHistory(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	createdTx, createdAt := stub.txID, stub.txTime.Unix()*1000
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", "carol")
+	transferTx, transferAt := stub.txID, stub.txTime.Unix()*1000
+	mustInvoke(t, stub, cc, "open_trade", "carol", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "carol", "blue", "16")
+	tradeTx, tradeAt := stub.txID, stub.txTime.Unix()*1000
+
+	history := queryHistory(t, stub, cc, "b1")
+	if len(history) != 3 {
+		t.Fatalf("want 3 records, got %+v", history)
+	}
+	want := []OwnershipRecord{
+		{PrevOwner: "", NewOwner: "bob", Reason: "create", TxID: createdTx, Timestamp: createdAt},
+		{PrevOwner: "bob", NewOwner: "carol", Reason: "transfer", TxID: transferTx, Timestamp: transferAt},
+		{PrevOwner: "carol", NewOwner: "alice", Reason: "trade", TradeID: id, TxID: tradeTx, Timestamp: tradeAt},
+	}
+	for i := range want {
+		if history[i] != want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, history[i], want[i])
+		}
+	}
+
+	a1 := queryHistory(t, stub, cc, "a1")
+	if len(a1) != 2 || a1[1].PrevOwner != "alice" || a1[1].NewOwner != "carol" || a1[1].TradeID != id {
+		t.Errorf("a1 history = %+v", a1)
+	}
+
+	//history outlives the marble
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "delete", "b1")
+	if got := queryHistory(t, stub, cc, "b1"); len(got) != 3 {
+		t.Errorf("b1 history after delete = %+v", got)
+	}
+}
+
+func TestMarbleHistoryKeepsEveryChangeApart(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	legacyKey, _ := createCompositeKey(legacyHistoryStr, []string{"b1"})
+	stub.state[legacyKey] = []byte(`[{"prev_owner":"","new_owner":"bob","reason":"create","tx_id":"old","timestamp":1}]`)
+
+	stub.writes = map[string]int{}
+	for i := 0; i < 10; i++ { //tx10 sorts before tx2, the history still comes out in time order
+		from, to := "bob", "carol"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		mustInvokeAs(t, stub, cc, from, "set_user", "b1", to)
+	}
+	for key, n := range stub.writes {
+		if strings.HasPrefix(key, compositeKeyNamespace+historyStr) && n != 1 {
+			t.Errorf("history key %q was written %d times, every change should get its own", key, n)
+		}
+	}
+	history := queryHistory(t, stub, cc, "b1")
+	if len(history) != 12 || history[0].TxID != "old" || history[1].Reason != reasonCreate {
+		t.Fatalf("b1 history = %+v", history)
+	}
+	for i, record := range history[2:] {
+		if want := []string{"carol", "bob"}[i%2]; record.NewOwner != want {
+			t.Errorf("record %d = %+v, want a move to %s", i+2, record, want)
+		}
+	}
+}
+
+func TestMarbleHistoryErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	//marbles from before provenance tracking have an empty history
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "old", `{"name":"old","color":"red","size":5,"user":"bob"}`)
+	if got := queryHistory(t, stub, cc, "old"); len(got) != 0 {
+		t.Errorf("old history = %+v", got)
+	}
+
+	if _, err := stub.query(cc, "marble_history"); err == nil {
+		t.Error("marble_history without args should fail")
+	}
+	if _, err := stub.query(cc, "marble_history", "missing"); err == nil {
+		t.Error("marble_history of an unknown marble should fail")
+	}
+	if _, err := stub.query(cc, "marble_history", "bad\x00name"); err == nil {
+		t.Error("marble_history of an unindexable name should fail")
+	}
+}
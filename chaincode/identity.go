@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+// guard checks callers against the role table, the checks and role functions are shared with the scrutin chaincode.
+// Roles only go to registered users
+func (t *SimpleChaincode) guard() roles.Guard {
+	return roles.Guard{Identity: t.Identity, Load: loadRoles, Log: logFor, User: requireUser}
+}
+
+// ============================================================================================================================
+// Get Caller - the normalized name of the user calling the chaincode, it is an error if nobody can be resolved
+// ============================================================================================================================
+func (t *SimpleChaincode) getCaller(stub shim.ChaincodeStubInterface) (string, error) {
+	return t.guard().Caller(stub)
+}
+
+// ============================================================================================================================
+// Authorize User - make sure the caller is the given user
+// ============================================================================================================================
+func (t *SimpleChaincode) authorizeUser(stub shim.ChaincodeStubInterface, user string, action string) error {
+	return t.guard().AuthorizeUser(stub, user, action)
+}
+
+var adminStr = "_admin" //key of the admin before roles, moved into the role table by init
+
+// ============================================================================================================================
+// Record Admin - the identifiable caller deploying the chaincode becomes its admin
+// ============================================================================================================================
+func (t *SimpleChaincode) recordAdmin(stub shim.ChaincodeStubInterface) error {
+	err := t.guard().RecordAdmin(stub)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(adminStr) //the legacy admin, if any, is in the table from now on
+}
+
+// moveLegacyAdmin puts the admin of a ledger from before roles into the role table
+func moveLegacyAdmin(stub shim.ChaincodeStubInterface) error {
+	adminAsBytes, err := stub.GetState(adminStr)
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to get admin")
+	}
+	if len(adminAsBytes) == 0 {
+		return nil
+	}
+	table, err := loadRoles(stub)
+	if err != nil {
+		return err
+	}
+	err = table.Save(stub)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(adminStr)
+}
+
+// ============================================================================================================================
+// Load Roles - the role table, ledgers from before roles get their admin from the _admin key until the next init
+// ============================================================================================================================
+func loadRoles(stub shim.ChaincodeStubInterface) (roles.Table, error) {
+	table, err := roles.Load(stub)
+	if err != nil {
+		return nil, err
+	}
+	adminAsBytes, err := stub.GetState(adminStr)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get admin")
+	}
+	if len(adminAsBytes) > 0 && table.Count(roles.Admin) == 0 {
+		table.Set(string(adminAsBytes), roles.Admin)
+	}
+	return table, nil
+}
+
+// ============================================================================================================================
+// Authorize Role - make sure the caller has at least the given role, denials are logged for audit
+// ============================================================================================================================
+func (t *SimpleChaincode) authorizeRole(stub shim.ChaincodeStubInterface, need roles.Role, action string) error {
+	return t.guard().Authorize(stub, need, action)
+}
+
+// ============================================================================================================================
+// Authorize Admin - make sure the caller is an admin
+// ============================================================================================================================
+func (t *SimpleChaincode) authorizeAdmin(stub shim.ChaincodeStubInterface, action string) error {
+	return t.authorizeRole(stub, roles.Admin, action)
+}
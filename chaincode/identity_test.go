@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+// fixedIdentity is a resolver tests can point at any user
+type fixedIdentity struct {
+	user string
+	err  error
+}
+
+func (f *fixedIdentity) Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	return f.user, f.err
+}
+
+func mustBeUnauthorized(t *testing.T, stub *memStub, cc *SimpleChaincode, function string, args ...string) {
+	t.Helper()
+	err := mustFail(t, stub, cc, function, args...)
+	if !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("%s%v: want an authorization error, got %s", function, args, err)
+	}
+}
+
+func TestOnlyOwnersMoveMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "set_user", "b1", "alice")
+	mustBeUnauthorized(t, stub, cc, "delete", "b1")
+	if storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("b1 should still be bob's")
+	}
+
+	stub.as("")
+	mustFail(t, stub, cc, "set_user", "b1", "alice")
+	mustFail(t, stub, cc, "set_user", "nope", "alice")
+
+	stub.as(" BOB ")
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	mustBeUnauthorized(t, stub, cc, "delete", "b1")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "delete", "b1")
+}
+
+func TestOnlyCreatorsRemoveTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "remove_trade", id)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("bob should have removed his trade")
+	}
+}
+
+func TestOnlyHoldersCloseTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	//carol can't hand over alice's marble on alice's behalf
+	stub.as("carol")
+	mustBeUnauthorized(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+}
+
+func TestCallerComesFromTheCertificate(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("alice")
+	stub.metadata = "bob" //any client can claim to be bob
+	mustBeUnauthorized(t, stub, cc, "set_user", "b1", "alice")
+	stub.as("")
+	mustFail(t, stub, cc, "set_user", "b1", "alice")
+
+	cc.Identity = roles.CallerMetadata{} //a network that trusts its clients opts in
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	if storedMarble(t, stub, "b1").User != "alice" {
+		t.Error("b1 should be alice's")
+	}
+}
+
+func TestPluggableIdentity(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	identity := &fixedIdentity{user: "alice"}
+	cc.Identity = identity
+	stub.as("bob") //the certificate is ignored once a resolver is plugged in
+	mustBeUnauthorized(t, stub, cc, "set_user", "b1", "alice")
+
+	identity.user = "bob"
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+
+	identity.err = errors.New("no certificate")
+	mustFail(t, stub, cc, "set_user", "b2", "alice")
+
+	cc.Identity = roles.CertAttribute{Attribute: "login"}
+	mustFail(t, stub, cc, "set_user", "b2", "alice")
+	stub.attrs["login"] = []byte("bob")
+	mustInvoke(t, stub, cc, "set_user", "b2", "alice")
+	if storedMarble(t, stub, "b2").User != "alice" {
+		t.Error("b2 should be alice's")
+	}
+}
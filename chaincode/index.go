@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// composite keys start with U+0000 so they can never collide with marble names or the "_" keys,
+// U+0000 also separates the attributes and U+10FFFF is used as the upper bound of range queries
+const minUnicodeRuneValue rune = 0            //U+0000
+const maxUnicodeRuneValue rune = utf8.MaxRune //U+10FFFF - maximum (and unallocated) code point
+const compositeKeyNamespace = "\x00"
+
+var marbleNameIndexStr = "marble~name"    //index of marbles by name, pages of marbles range over it
+var ownerNameIndexStr = "owner~name"      //index of marbles by owner
+var colorSizeIndexStr = "color~size~name" //index of marbles by color and size
+var indexValue = []byte{0x00}             //index entries carry no value, the key is the data
+
+// ============================================================================================================================
+// Create Composite Key - build a range-queryable key out of an object type and its attributes
+// ============================================================================================================================
+func createCompositeKey(objectType string, attributes []string) (string, error) {
+	if err := validateCompositeKeyAttribute(objectType); err != nil {
+		return "", err
+	}
+	ck := compositeKeyNamespace + objectType + string(minUnicodeRuneValue)
+	for _, att := range attributes {
+		if err := validateCompositeKeyAttribute(att); err != nil {
+			return "", err
+		}
+		ck += att + string(minUnicodeRuneValue)
+	}
+	return ck, nil
+}
+
+// ============================================================================================================================
+// Split Composite Key - get the object type and attributes back out of a composite key
+// ============================================================================================================================
+func splitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) {
+		return "", nil, errs.New(errs.Internal, "Not a composite key: "+compositeKey)
+	}
+	components := strings.Split(compositeKey[len(compositeKeyNamespace):], string(minUnicodeRuneValue))
+	if len(components) < 2 {
+		return "", nil, errs.New(errs.Internal, "Not a composite key: "+compositeKey)
+	}
+	components = components[:len(components)-1] //every component is terminated, drop the empty tail
+	return components[0], components[1:], nil
+}
+
+func validateCompositeKeyAttribute(str string) error {
+	if !utf8.ValidString(str) {
+		return errs.New(errs.InvalidArgument, "Not a valid utf8 string: "+str)
+	}
+	for _, r := range str {
+		if r == minUnicodeRuneValue || r == maxUnicodeRuneValue {
+			return errs.New(errs.InvalidArgument, fmt.Sprintf("Input contains unicode %#U starting at position [%d]. %#U and %#U are not allowed in the input attribute of a composite key", r, strings.IndexRune(str, r), minUnicodeRuneValue, maxUnicodeRuneValue))
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get State By Partial Composite Key - range over every key that starts with the given attributes
+// ============================================================================================================================
+func getStateByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) (shim.StateRangeQueryIteratorInterface, error) {
+	startKey, err := createCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	endKey := startKey + string(maxUnicodeRuneValue)
+	return stub.RangeQueryState(startKey, endKey)
+}
+
+// ============================================================================================================================
+// Marble Index Keys - the composite keys a marble is indexed under
+// ============================================================================================================================
+func marbleIndexKeys(marble Marble) ([]string, error) {
+	nameKey, err := createCompositeKey(marbleNameIndexStr, []string{marble.Name})
+	if err != nil {
+		return nil, err
+	}
+	ownerKey, err := createCompositeKey(ownerNameIndexStr, []string{strings.ToLower(marble.User), marble.Name})
+	if err != nil {
+		return nil, err
+	}
+	colorKey, err := createCompositeKey(colorSizeIndexStr, []string{strings.ToLower(marble.Color), strconv.Itoa(marble.Size), marble.Name})
+	if err != nil {
+		return nil, err
+	}
+	return []string{nameKey, ownerKey, colorKey}, nil
+}
+
+// ============================================================================================================================
+// Index Marble - add a marble to the name, owner and color/size indexes
+// ============================================================================================================================
+func indexMarble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marbleIndexKeys(marble)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Unindex Marble - remove a marble from the name, owner and color/size indexes
+// ============================================================================================================================
+func unindexMarble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marbleIndexKeys(marble)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Marble Names By Owner - names of all marbles this user owns, read from the owner index
+// ============================================================================================================================
+func marbleNamesByOwner(stub shim.ChaincodeStubInterface, user string) ([]string, error) {
+	return indexedNames(stub, ownerNameIndexStr, []string{strings.ToLower(user)})
+}
+
+// ============================================================================================================================
+// Marble Names By Color Size - names of all marbles of this color and size, read from the color/size index
+// ============================================================================================================================
+func marbleNamesByColorSize(stub shim.ChaincodeStubInterface, color string, size int) ([]string, error) {
+	return indexedNames(stub, colorSizeIndexStr, []string{strings.ToLower(color), strconv.Itoa(size)})
+}
+
+// indexedNames returns the marble name (last attribute) of every index entry under the partial key
+func indexedNames(stub shim.ChaincodeStubInterface, objectType string, attributes []string) ([]string, error) {
+	iter, err := getStateByPartialCompositeKey(stub, objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var names []string
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := splitCompositeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, parts[len(parts)-1])
+	}
+	return names, nil
+}
+
+// ============================================================================================================================
+// IDs After - up to limit ids of an object type keyed by one id, in key order and starting after the given id
+// ============================================================================================================================
+func idsAfter(stub shim.ChaincodeStubInterface, objectType string, after string, limit int) ([]string, error) {
+	startKey, err := createCompositeKey(objectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	endKey := startKey + string(maxUnicodeRuneValue)
+	if after != "" {
+		startKey, err = createCompositeKey(objectType, []string{after})
+		if err != nil {
+			return nil, err
+		}
+	}
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to range over "+objectType)
+	}
+	defer iter.Close()
+
+	ids := []string{}
+	for iter.HasNext() && len(ids) < limit {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to range over "+objectType)
+		}
+		_, parts, err := splitCompositeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if parts[0] == after { //the range starts at the cursor itself
+			continue
+		}
+		ids = append(ids, parts[0])
+	}
+	return ids, nil
+}
+
+// ============================================================================================================================
+// Clear Indexes - remove every composite index entry, used by a reset
+// ============================================================================================================================
+func clearIndexes(stub shim.ChaincodeStubInterface) error {
+	return clearCompositeKeys(stub, marbleNameIndexStr, ownerNameIndexStr, colorSizeIndexStr)
+}
+
+// clearCompositeKeys deletes every composite key of the given object types
+func clearCompositeKeys(stub shim.ChaincodeStubInterface, objectTypes ...string) error {
+	for _, objectType := range objectTypes {
+		iter, err := getStateByPartialCompositeKey(stub, objectType, []string{})
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for iter.HasNext() {
+			key, _, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			keys = append(keys, key)
+		}
+		iter.Close()
+
+		for _, key := range keys {
+			err = stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
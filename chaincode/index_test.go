@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompositeKeyRoundTrip(t *testing.T) {
+	key, err := createCompositeKey("owner~name", []string{"bob", "m1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectType, attrs, err := splitCompositeKey(key)
+	if err != nil || objectType != "owner~name" || !reflect.DeepEqual(attrs, []string{"bob", "m1"}) {
+		t.Errorf("split = %q %v %v", objectType, attrs, err)
+	}
+
+	if _, err := createCompositeKey("owner~name", []string{"b\x00b"}); err == nil {
+		t.Error("U+0000 should not be allowed in an attribute")
+	}
+	if _, err := createCompositeKey("owner~name", []string{"b" + string(maxUnicodeRuneValue)}); err == nil {
+		t.Error("U+10FFFF should not be allowed in an attribute")
+	}
+	if _, _, err := splitCompositeKey("m1"); err == nil {
+		t.Error("plain keys are not composite keys")
+	}
+}
+
+// namesByOwner reads the owner index of the committed state
+func namesByOwner(t *testing.T, stub *memStub, user string) []string {
+	t.Helper()
+	stub.begin()
+	defer stub.end(nil)
+	names, err := marbleNamesByOwner(stub, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func namesByColorSize(t *testing.T, stub *memStub, color string, size int) []string {
+	t.Helper()
+	stub.begin()
+	defer stub.end(nil)
+	names, err := marbleNamesByColorSize(stub, color, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIndexesFollowMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvokeAs(t, stub, cc, testAdmin, "register_user", "bobby")
+	mustInvoke(t, stub, cc, "init_marble", "b3", "blue", "16", "bobby")
+
+	if got := namesByOwner(t, stub, "Bob"); !reflect.DeepEqual(got, []string{"b1", "b2"}) {
+		t.Errorf("bob owns %v, want [b1 b2]", got)
+	}
+	if got := namesByColorSize(t, stub, "BLUE", 16); !reflect.DeepEqual(got, []string{"b1", "b3"}) {
+		t.Errorf("blue 16s = %v, want [b1 b3]", got)
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	if got := namesByOwner(t, stub, "bob"); !reflect.DeepEqual(got, []string{"b2"}) {
+		t.Errorf("bob owns %v, want [b2]", got)
+	}
+	if got := namesByOwner(t, stub, "alice"); !reflect.DeepEqual(got, []string{"a1", "b1"}) {
+		t.Errorf("alice owns %v, want [a1 b1]", got)
+	}
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "delete", "b1")
+	if got := namesByOwner(t, stub, "alice"); !reflect.DeepEqual(got, []string{"a1"}) {
+		t.Errorf("alice owns %v, want [a1]", got)
+	}
+	if got := namesByColorSize(t, stub, "blue", 16); !reflect.DeepEqual(got, []string{"b3"}) {
+		t.Errorf("blue 16s = %v, want [b3]", got)
+	}
+
+	//marble names that can't be indexed are rejected
+	mustFail(t, stub, cc, "init_marble", "bad\x00name", "blue", "16", "bob")
+
+	mustInvokeAs(t, stub, cc, testAdmin, "reset")
+	if got := namesByOwner(t, stub, "bob"); len(got) != 0 {
+		t.Errorf("reset should clear the owner index, got %v", got)
+	}
+}
+
+func TestReindexMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	//simulate a ledger from before the indexes existed
+	stub.begin()
+	err := clearIndexes(stub)
+	stub.end(err)
+	if got := namesByOwner(t, stub, "bob"); len(got) != 0 {
+		t.Fatalf("indexes should be empty, got %v", got)
+	}
+
+	mustInvokeAs(t, stub, cc, testAdmin, "write", marbleIndexStr, `["b1","b2","a1","gone"]`)
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "carol", "operator")
+	stub.as("bob")
+	mustBeUnauthorized(t, stub, cc, "reindex_marbles")
+	stub.as("carol")
+	mustInvoke(t, stub, cc, "reindex_marbles")
+	if got := namesByOwner(t, stub, "bob"); !reflect.DeepEqual(got, []string{"b1", "b2"}) {
+		t.Errorf("bob owns %v, want [b1 b2]", got)
+	}
+	if got := namesByColorSize(t, stub, "green", 16); !reflect.DeepEqual(got, []string{"a1"}) {
+		t.Errorf("green 16s = %v, want [a1]", got)
+	}
+
+	stub.failGet[marbleIndexStr] = true
+	mustFail(t, stub, cc, "reindex_marbles")
+	delete(stub.failGet, marbleIndexStr)
+	stub.failGet["b2"] = true
+	mustFail(t, stub, cc, "reindex_marbles")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+)
+
+// captureLog sends every line the chaincode logs to a buffer for the rest of the test
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	saved := logger
+	logger = logging.New(&out, defaultLogLevel)
+	t.Cleanup(func() { logger = saved })
+	return &out
+}
+
+func TestLogging(t *testing.T) {
+	cc, stub := newCoinChaincode(t) //dave is the admin
+	out := captureLog(t)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	line := "level=info msg=\"marble created\" function=init_marble tx=" + stub.txID + " marble=b1 user=bob\n"
+	if out.String() != line {
+		t.Errorf("got %q, want %q", out.String(), line)
+	}
+
+	//debug lines only show up once an admin asks for them
+	out.Reset()
+	mustInvoke(t, stub, cc, "open_trade", "bob", "red", "16", "blue", "16")
+	if strings.Contains(out.String(), "level=debug") {
+		t.Errorf("debug lines at the default level: %s", out)
+	}
+	if _, err := stub.invoke(cc, "set_log_level", "debug"); err == nil {
+		t.Error("set_log_level by a non admin should fail")
+	}
+	if !strings.Contains(out.String(), `level=warning msg="invoke failed" function=set_log_level`) || !strings.Contains(out.String(), "code=UNAUTHORIZED") {
+		t.Errorf("failed invoke was not logged: %s", out)
+	}
+	stub.as("dave")
+	if _, err := stub.invoke(cc, "set_log_level", "loud"); err == nil {
+		t.Error("set_log_level with an unknown level should fail")
+	}
+	mustInvoke(t, stub, cc, "set_log_level", "DEBUG")
+	if res, err := stub.query(cc, "get_log_level"); err != nil || string(res) != "debug" {
+		t.Errorf("get_log_level = %s, %v", res, err)
+	}
+	out.Reset()
+	mustInvoke(t, stub, cc, "init_marble", "d1", "red", "16", "dave")
+	if !strings.Contains(out.String(), "level=debug msg=invoke function=init_marble tx="+stub.txID+" args=d1,red,16,dave") {
+		t.Errorf("no debug line: %s", out)
+	}
+
+	mustInvoke(t, stub, cc, "set_log_level", "error")
+	out.Reset()
+	mustInvoke(t, stub, cc, "init_marble", "d2", "red", "16", "dave")
+	if out.Len() != 0 {
+		t.Errorf("logged below error: %s", out)
+	}
+
+	//tracing stays out of the ledger
+	for _, key := range []string{"_debug1", "_debug2"} {
+		if _, ok := stub.state[key]; ok {
+			t.Errorf("%s was written", key)
+		}
+	}
+}
+
+func TestCorruptLogLevel(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	out := captureLog(t)
+	mustInvokeAs(t, stub, cc, testAdmin, "write", logging.LevelKey, "loud")
+	out.Reset()
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	if !strings.Contains(out.String(), `msg="using the default log level"`) || !strings.Contains(out.String(), `msg="marble created"`) {
+		t.Errorf("got %s", out)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package logging
+
+import (
+	"io/ioutil"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var silent = New(ioutil.Discard, Error) //logger outside of an invocation, there is nobody to tell
+
+// SetLevel is the set_log_level invoke, it changes how much every later invocation logs. authorize vets the caller
+// once the arguments are good
+func SetLevel(stub shim.ChaincodeStubInterface, args []string, authorize func() error) ([]byte, error) {
+	//   0
+	// "debug"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting debug, info, warning or error")
+	}
+	level, err := ParseLevel(args[0])
+	if err != nil {
+		return nil, errs.Arg(0, err.Error())
+	}
+	err = authorize()
+	if err != nil {
+		return nil, err
+	}
+	err = StoreLevel(stub, level)
+	if err != nil {
+		return nil, err
+	}
+	For(stub, silent).Info("log level changed", "level", level.String())
+	return nil, nil
+}
+
+// GetLevel is the get_log_level query, the level in use, def until one is set
+func GetLevel(stub shim.ChaincodeStubInterface, def Level) ([]byte, error) {
+	level, err := StoredLevel(stub, def)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(level.String()), nil
+}
@@ -0,0 +1,147 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package logging is the leveled logger of the marbles and scrutin chaincodes.
+//
+// Lines go to the chaincode's stdout, which the peer keeps in its logs, as key=value pairs
+//
+//	level=info msg="trade opened" function=open_trade tx=5c2d... user=bob
+//
+// Loggers are cheap to derive, With returns a copy that adds a field to every line it writes.
+// Begin derives the logger of one invocation at the level stored under LevelKey, For finds it again deeper down.
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads a level name, any case
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return Info, errors.New("Unknown log level " + strconv.Quote(name) + ", expecting one of " + strings.Join(levelNames, ", "))
+}
+
+type field struct {
+	key   string
+	value string
+}
+
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex //shared by every logger derived from the same New, lines don't interleave
+	level  Level
+	fields []field
+}
+
+// New makes a logger writing lines at level and above to out
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, mu: &sync.Mutex{}, level: level}
+}
+
+// With is a copy of the logger that adds key=value to every line
+func (l *Logger) With(key string, value string) *Logger {
+	child := *l
+	child.fields = append(append([]field{}, l.fields...), field{key, value})
+	return &child
+}
+
+// WithLevel is a copy of the logger that writes lines at level and above
+func (l *Logger) WithLevel(level Level) *Logger {
+	child := *l
+	child.level = level
+	return &child
+}
+
+func (l *Logger) Level() Level {
+	return l.level
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug, Info, Warning and Error write msg followed by the logger's fields and then the key, value pairs in kv
+func (l *Logger) Debug(msg string, kv ...string)   { l.log(Debug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...string)    { l.log(Info, msg, kv) }
+func (l *Logger) Warning(msg string, kv ...string) { l.log(Warning, msg, kv) }
+func (l *Logger) Error(msg string, kv ...string)   { l.log(Error, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []string) {
+	if !l.Enabled(level) {
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString("level=" + level.String() + " msg=" + quote(msg))
+	for _, f := range l.fields {
+		line.WriteString(" " + f.key + "=" + quote(f.value))
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		line.WriteString(" " + kv[i] + "=" + quote(kv[i+1]))
+	}
+	if len(kv)%2 == 1 { //a key without a value is a bug in the caller, still show it
+		line.WriteString(" " + kv[len(kv)-1] + "=")
+	}
+	line.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprint(l.out, line.String())
+}
+
+// quote leaves simple values bare and quotes anything with spaces, quotes or control characters
+func quote(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, c := range value {
+		if c <= ' ' || c == '"' || c == '=' || c == '\\' || c > '~' {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	log := New(&out, Info)
+	log.Debug("hidden")
+	log.Info("shown")
+	log.WithLevel(Debug).Debug("now shown")
+	log.Debug("still hidden") //WithLevel made a copy
+	want := "level=info msg=shown\nlevel=debug msg=\"now shown\"\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	for _, name := range []string{"debug", " INFO ", "Warning", "error"} {
+		if _, err := ParseLevel(name); err != nil {
+			t.Errorf("ParseLevel(%q) failed: %s", name, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) should fail")
+	}
+	if Warning.String() != "warning" || Level(9).String() != "level(9)" {
+		t.Errorf("String() = %s, %s", Warning, Level(9))
+	}
+}
+
+func TestFields(t *testing.T) {
+	var out bytes.Buffer
+	log := New(&out, Debug).With("function", "init_marble").With("tx", "tx1")
+	log.With("marble", `a "b"`).Warning("bad name", "user", "bob", "note", "", "dangling")
+	log.Error("no marble field")
+	want := `level=warning msg="bad name" function=init_marble tx=tx1 marble="a \"b\"" user=bob note="" dangling=` + "\n" +
+		`level=error msg="no marble field" function=init_marble tx=tx1` + "\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
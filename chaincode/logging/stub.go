@@ -0,0 +1,88 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package logging
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// LevelKey is the name for the key/value that stores the log level
+const LevelKey = "_loglevel"
+
+// Stub carries the logger of one invocation or query, its lines are tagged with the function and tx id
+type Stub struct {
+	shim.ChaincodeStubInterface
+	Log *Logger
+}
+
+// Wrapper is a stub that adds to the one it wraps, For looks through it for the logger of the invocation
+type Wrapper interface {
+	Unwrap() shim.ChaincodeStubInterface
+}
+
+// Begin starts the logger of an invocation or query from base, at the level stored in the ledger
+func Begin(stub shim.ChaincodeStubInterface, base *Logger, function string) *Stub {
+	level, err := StoredLevel(stub, base.Level())
+	log := base.WithLevel(level).With("function", function).With("tx", stub.GetTxID())
+	if err != nil {
+		log.Warning("using the default log level", "error", errs.From(err).Message)
+	}
+	return &Stub{ChaincodeStubInterface: stub, Log: log}
+}
+
+// For is the logger of the running invocation, fallback outside of one
+func For(stub shim.ChaincodeStubInterface, fallback *Logger) *Logger {
+	for {
+		switch s := stub.(type) {
+		case *Stub:
+			return s.Log
+		case Wrapper:
+			stub = s.Unwrap()
+		default:
+			return fallback
+		}
+	}
+}
+
+// StoredLevel is the level stored in the ledger, def until one is set
+func StoredLevel(stub shim.ChaincodeStubInterface, def Level) (Level, error) {
+	levelAsBytes, err := stub.GetState(LevelKey)
+	if err != nil {
+		return def, errs.New(errs.Internal, "Failed to get log level")
+	}
+	if len(levelAsBytes) == 0 {
+		return def, nil
+	}
+	level, err := ParseLevel(string(levelAsBytes))
+	if err != nil {
+		return def, errs.New(errs.Internal, "Corrupt log level")
+	}
+	return level, nil
+}
+
+// StoreLevel sets the level every later invocation logs at
+func StoreLevel(stub shim.ChaincodeStubInterface, level Level) error {
+	err := stub.PutState(LevelKey, []byte(level.String()))
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to store log level")
+	}
+	return nil
+}
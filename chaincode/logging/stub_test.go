@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// mapStub is the bit of a ledger the stub code reads and writes
+type mapStub struct {
+	shim.ChaincodeStubInterface
+	state   map[string][]byte
+	failGet bool
+}
+
+func (s *mapStub) GetTxID() string { return "tx1" }
+
+func (s *mapStub) GetState(key string) ([]byte, error) {
+	if s.failGet {
+		return nil, errors.New("ledger down")
+	}
+	return s.state[key], nil
+}
+
+func (s *mapStub) PutState(key string, value []byte) error {
+	s.state[key] = value
+	return nil
+}
+
+// wrapStub stands for a chaincode stub that adds to the invocation stub
+type wrapStub struct {
+	shim.ChaincodeStubInterface
+}
+
+func (w wrapStub) Unwrap() shim.ChaincodeStubInterface { return w.ChaincodeStubInterface }
+
+func TestStoredLevel(t *testing.T) {
+	stub := &mapStub{state: map[string][]byte{}}
+	if level, err := StoredLevel(stub, Warning); err != nil || level != Warning {
+		t.Errorf("unset level = %s, %v, want the default", level, err)
+	}
+	if err := StoreLevel(stub, Debug); err != nil {
+		t.Fatal(err)
+	}
+	if level, err := StoredLevel(stub, Warning); err != nil || level != Debug {
+		t.Errorf("stored level = %s, %v, want debug", level, err)
+	}
+	stub.state[LevelKey] = []byte("loud")
+	if level, err := StoredLevel(stub, Warning); err == nil || level != Warning {
+		t.Errorf("corrupt level = %s, %v, want the default and an error", level, err)
+	}
+}
+
+func TestBeginAndFor(t *testing.T) {
+	var out bytes.Buffer
+	base := New(&out, Info)
+	stub := &mapStub{state: map[string][]byte{LevelKey: []byte("debug")}}
+	ls := Begin(stub, base, "init_marble")
+	if For(stub, base) != base {
+		t.Error("outside of an invocation For should fall back")
+	}
+	For(wrapStub{ls}, base).Debug("found")
+	if want := "level=debug msg=found function=init_marble tx=tx1\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	stub.failGet = true
+	Begin(stub, base, "read").Log.Debug("hidden")
+	if !strings.Contains(out.String(), "using the default log level") || strings.Contains(out.String(), "hidden") {
+		t.Errorf("an unreadable level should warn and fall back to the base level, got %q", out.String())
+	}
+}
+
+func TestLevelFunctions(t *testing.T) {
+	stub := &mapStub{state: map[string][]byte{}}
+	denied := errors.New("denied")
+	if _, err := SetLevel(stub, []string{"debug"}, func() error { return denied }); err != denied {
+		t.Errorf("SetLevel without permission = %v", err)
+	}
+	for _, args := range [][]string{{}, {"loud"}, {"debug", "info"}} {
+		if _, err := SetLevel(stub, args, func() error { return nil }); err == nil {
+			t.Errorf("SetLevel%q should fail", args)
+		}
+	}
+	if res, err := GetLevel(stub, Info); err != nil || string(res) != "info" {
+		t.Errorf("GetLevel = %s, %v, want the default", res, err)
+	}
+	if _, err := SetLevel(stub, []string{" Warning "}, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := GetLevel(stub, Info); err != nil || string(res) != "warning" {
+		t.Errorf("GetLevel = %s, %v, want warning", res, err)
+	}
+}
@@ -21,41 +21,52 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
 )
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	Identity roles.Resolver //resolves who is calling, nil means the username attribute of the caller's certificate
 }
 
 var marbleIndexStr = "_marbleindex" //name for the key/value that will store a list of all known marbles
-var openTradesStr = "_opentrades"   //name for the key/value that will store all open trades
+var openTradesStr = "_opentrades"   //name for the key/value that stored all open trades before they got their own keys
 
 type Marble struct {
-	Name  string `json:"name"` //the fieldtags are needed to keep case from bouncing around
-	Color string `json:"color"`
-	Size  int    `json:"size"`
-	User  string `json:"user"`
+	Name     string `json:"name"` //the fieldtags are needed to keep case from bouncing around
+	Color    string `json:"color"`
+	Size     int    `json:"size"`
+	User     string `json:"user"`
+	LockedBy string `json:"locked_by,omitempty"` //id of the trade or auction holding this marble
+	Schema   int    `json:"schema"`              //schema version of the record, set when it is stored
 }
 
 type Description struct {
-	Color string `json:"color"`
-	Size  int    `json:"size"`
+	Color    string `json:"color"`
+	Size     int    `json:"size"`
+	Quantity int    `json:"quantity,omitempty"` //how many marbles like this, 0 is the same as 1
 }
 
 type AnOpenTrade struct {
-	User      string        `json:"user"`      //user who created the open trade order
-	Timestamp int64         `json:"timestamp"` //utc timestamp of creation
-	Want      Description   `json:"want"`      //description of desired marble
-	Willing   []Description `json:"willing"`   //array of marbles willing to trade away
+	ID        string        `json:"id"`                //id of the trade, the tx id of the open_trade that created it
+	User      string        `json:"user"`              //user who created the open trade order
+	Timestamp int64         `json:"timestamp"`         //utc timestamp of creation, the tx timestamp
+	Want      Description   `json:"want"`              //description of desired marble
+	Willing   []Description `json:"willing"`           //array of marbles willing to trade away
+	Escrow    []string      `json:"escrow,omitempty"`  //names of the marbles locked for this trade, empty if not in escrow
+	Expires   int64         `json:"expires,omitempty"` //utc timestamp in ms after which the trade is dead, 0 never expires
+	Schema    int           `json:"schema"`            //schema version of the record, set when it is stored
 }
 
+// AllTrades is the legacy _opentrades blob, and every open trade when read with getAllTrades
 type AllTrades struct {
 	OpenTrades []AnOpenTrade `json:"open_trades"`
 }
@@ -66,55 +77,87 @@ type AllTrades struct {
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		logger.Error("failed to start the marbles chaincode", "error", err.Error())
 	}
 }
 
 // ============================================================================================================================
-// Init - reset all the things
+// Init - set up the chaincode, safe to run again on a live ledger
 // ============================================================================================================================
+// Takes an optional json Config. Existing marbles, trades and indexes are kept, the index is only created when missing,
+// legacy open trades move to their own keys and config sections left out keep their current values. Wiping the ledger
+// is up to reset. Only the deploy runs Init, the deployer and the config's admins become the admins.
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var Aval int
-	var err error
+	config, err := parseConfig(args)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	err = prepareLedger(stub)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	err = t.recordAdmin(stub) //whoever deploys runs the admin functions
+	if err != nil {
+		return nil, errs.Wrap(err)
 	}
 
-	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
+	err = applyConfig(stub, config)
 	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
+		return nil, errs.Wrap(err)
 	}
+	return nil, nil
+}
 
-	// Write the state to the ledger
-	err = stub.PutState("abc", []byte(strconv.Itoa(Aval))) //making a test var "abc", I find it handy to read/write to it right away to test the network
+// ============================================================================================================================
+// Reinit - apply a config to the running chaincode, admin only. Admins only come from the deploy, grant_role adds more
+// ============================================================================================================================
+func (t *SimpleChaincode) reinit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := t.authorizeAdmin(stub, "apply a config")
 	if err != nil {
 		return nil, err
 	}
-
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to clear the index
-	err = stub.PutState(marbleIndexStr, jsonAsBytes)
+	config, err := parseConfig(args)
 	if err != nil {
 		return nil, err
 	}
-
-	var trades AllTrades
-	jsonAsBytes, _ = json.Marshal(trades) //clear the open trade struct
-	err = stub.PutState(openTradesStr, jsonAsBytes)
+	if len(config.Admins) > 0 {
+		return nil, errs.Arg(0, "Config admins are only taken at deploy, use grant_role")
+	}
+	err = prepareLedger(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = moveLegacyAdmin(stub)
 	if err != nil {
 		return nil, err
 	}
+	return nil, applyConfig(stub, config)
+}
 
-	return nil, nil
+// prepareLedger creates the marble index when it is missing and moves legacy open trades to their own keys
+func prepareLedger(stub shim.ChaincodeStubInterface) error {
+	indexAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to get marble index")
+	}
+	if indexAsBytes == nil {
+		var empty []string
+		jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to start the index
+		err = stub.PutState(marbleIndexStr, jsonAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = migrateTrades(stub) //ledgers from before per-trade keys
+	return err
 }
 
 // ============================================================================================================================
 // Run - Our entry point for Invocations - [LEGACY] obc-peer 4/25/2016
 // ============================================================================================================================
 func (t *SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
 	return t.Invoke(stub, function, args)
 }
 
@@ -122,68 +165,211 @@ func (t *SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string,
 // Invoke - Our entry point for Invocations
 // ============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
+	ls := logging.Begin(stub, logger, function)
+	ls.Log.Debug("invoke", "args", strings.Join(args, ","))
+
+	es := &eventStub{ChaincodeStubInterface: ls} //collect what happens and tell the world once it all worked
+	res, err := t.dispatch(es, function, args)
+	if err == nil {
+		err = es.flush()
+	}
+	if err != nil {
+		err = errs.Wrap(err) //clients always get a coded error
+		ls.Log.Warning("invoke failed", "code", string(errs.CodeOf(err)), "error", errs.From(err).Message)
+		return nil, err
+	}
+	return res, nil
+}
+
+// dispatch routes an invocation to its function
+func (t *SimpleChaincode) dispatch(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	err := requireFeature(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
-	if function == "init" { //initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "delete" { //deletes an entity from its state
+	if function == "init" { //apply a config, admin only
+		return t.reinit(stub, args)
+	} else if function == "reset" { //wipe the marbles and everything about them, admin only
+		return t.reset(stub, args)
+	} else if function == "delete" { //deletes an entity from its state, marbles by their owner and anything else by an admin
 		res, err := t.Delete(stub, args)
-		cleanTrades(stub) //lets make sure all open trades are still valid
-		return res, err
-	} else if function == "write" { //writes a value to the chaincode state
+		return cleanAfter(stub, res, err) //lets make sure the owner's open trades are still valid
+	} else if function == "write" { //writes a value to the chaincode state, admin only
 		return t.Write(stub, args)
 	} else if function == "init_marble" { //create a new marble
 		return t.init_marble(stub, args)
+	} else if function == "init_marbles" { //create a batch of marbles in one go
+		return t.init_marbles(stub, args)
 	} else if function == "set_user" { //change owner of a marble
 		res, err := t.set_user(stub, args)
-		cleanTrades(stub) //lets make sure all open trades are still valid
-		return res, err
+		return cleanAfter(stub, res, err) //lets make sure the owner's open trades are still valid
+	} else if function == "transfer_marbles" { //change owner of a batch of marbles
+		res, err := t.transfer_marbles(stub, args)
+		return cleanAfter(stub, res, err) //lets make sure the owner's open trades are still valid
 	} else if function == "open_trade" { //create a new trade order
 		return t.open_trade(stub, args)
 	} else if function == "perform_trade" { //forfill an open trade order
 		res, err := t.perform_trade(stub, args)
-		cleanTrades(stub) //lets clean just in case
-		return res, err
+		return cleanAfter(stub, res, err) //lets clean just in case
 	} else if function == "remove_trade" { //cancel an open trade order
 		return t.remove_trade(stub, args)
+	} else if function == "reindex_marbles" { //rebuild the owner and color/size indexes, operator only
+		return t.reindex_marbles(stub, args)
+	} else if function == "register_user" { //add a user to the registry
+		return t.register_user(stub, args)
+	} else if function == "update_user" { //change a user's display name
+		return t.update_user(stub, args)
+	} else if function == "expire_trades" { //remove open trades past their expiry
+		return t.expire_trades(stub, args)
+	} else if function == "start_auction" { //put a marble up for auction
+		return t.start_auction(stub, args)
+	} else if function == "place_bid" { //bid marbles on an auction
+		return t.place_bid(stub, args)
+	} else if function == "cancel_auction" { //take a marble out of auction before anyone bid
+		return t.cancel_auction(stub, args)
+	} else if function == "settle_auction" { //hand the marble to the winning bid
+		res, err := t.settle_auction(stub, args)
+		return cleanAfter(stub, res, err) //marbles changed hands, lets make sure the sellers' open trades are still valid
+	} else if function == "mint" { //create coins, admin only
+		return t.mint(stub, args)
+	} else if function == "transfer" { //send coins to another user
+		return t.transfer(stub, args)
+	} else if function == "list_for_sale" { //offer a marble for coins
+		return t.list_for_sale(stub, args)
+	} else if function == "unlist_marble" { //take a marble off sale
+		return t.unlist_marble(stub, args)
+	} else if function == "buy_marble" { //pay coins for a listed marble
+		res, err := t.buy_marble(stub, args)
+		return cleanAfter(stub, res, err) //marbles changed hands, lets make sure the sellers' open trades are still valid
+	} else if function == "set_log_level" { //change how much the chaincode logs, operator only
+		return logging.SetLevel(stub, args, func() error {
+			return t.authorizeRole(stub, roles.Operator, "set the log level")
+		})
+	} else if function == "set_marble_rules" { //change what marbles may look like, admin only
+		return t.set_marble_rules(stub, args)
+	} else if function == "grant_role" { //give a user the operator or admin role, admin only
+		return t.guard().GrantRole(stub, args)
+	} else if function == "revoke_role" { //make a user a plain user again, admin only
+		return t.guard().RevokeRole(stub, args)
+	} else if function == "migrate_trades" { //move trades of the legacy _opentrades key to their own keys, operator only
+		return t.migrate_trades(stub, args)
+	} else if function == "migrate_state" { //upgrade a batch of stored records to the current schema versions, admin only
+		return t.migrate_state(stub, args)
+	} else if function == "import_state" { //write records of export_state pages, admin only
+		return t.import_state(stub, args)
+	} else if function == "match_trades" { //close every ring of matching open trades
+		res, err := t.match_trades(stub, args)
+		return cleanAfter(stub, res, err) //lets clean just in case
 	}
-	fmt.Println("invoke did not find func: " + function) //error
+	return nil, errs.New(errs.InvalidArgument, "Received unknown function invocation")
+}
 
-	return nil, errors.New("Received unknown function invocation")
+// cleanAfter cleans up the open trades once a function that moves marbles worked, a failed one changed nothing
+func cleanAfter(stub shim.ChaincodeStubInterface, res []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	err = cleanTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 // ============================================================================================================================
 // Query - Our entry point for Queries
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	ls := logging.Begin(stub, logger, function)
+	ls.Log.Debug("query", "args", strings.Join(args, ","))
+
+	res, err := t.query(ls, function, args)
+	if err != nil {
+		err = errs.Wrap(err) //clients always get a coded error
+		ls.Log.Debug("query failed", "code", string(errs.CodeOf(err)), "error", errs.From(err).Message)
+		return nil, err
+	}
+	return res, nil
+}
+
+// query routes a query to its function
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
 	// Handle different functions
 	if function == "read" { //read a variable
 		return t.read(stub, args)
+	} else if function == "get_marble" { //read a single marble
+		return t.get_marble(stub, args)
+	} else if function == "list_marbles" { //page through all marbles
+		return t.list_marbles(stub, args)
+	} else if function == "marbles_by_owner" { //all marbles of a user
+		return t.marbles_by_owner(stub, args)
+	} else if function == "marbles_by_color_size" { //all marbles of a color and size
+		return t.marbles_by_color_size(stub, args)
+	} else if function == "marble_history" { //every owner a marble has had
+		return t.marble_history(stub, args)
+	} else if function == "get_user" { //read a registered user
+		return t.get_user(stub, args)
+	} else if function == "list_users" { //every registered user
+		return t.list_users(stub, args)
+	} else if function == "preview_matches" { //the rings match_trades would close
+		return t.preview_matches(stub, args)
+	} else if function == "get_auction" { //read a single auction
+		return t.get_auction(stub, args)
+	} else if function == "active_auctions" { //every auction still open
+		return t.active_auctions(stub, args)
+	} else if function == "auction_bids" { //bid history of an auction
+		return t.auction_bids(stub, args)
+	} else if function == "balance_of" { //coins a user holds
+		return t.balance_of(stub, args)
+	} else if function == "total_supply" { //coins minted so far
+		return t.total_supply(stub, args)
+	} else if function == "coin_history" { //changes to a user's coins
+		return t.coin_history(stub, args)
+	} else if function == "marbles_for_sale" { //every marble listed for coins
+		return t.marbles_for_sale(stub, args)
+	} else if function == "get_marble_rules" { //what marbles may look like
+		return t.get_marble_rules(stub, args)
+	} else if function == "get_role" { //the role of a user
+		return t.guard().GetRole(stub, args)
+	} else if function == "list_roles" { //every user with more than the user role
+		return t.guard().ListRoles(stub, args)
+	} else if function == "list_open_trades" { //page through all open trades
+		return t.list_open_trades(stub, args)
+	} else if function == "trades_by_opener" { //all open trades of a user
+		return t.trades_by_opener(stub, args)
+	} else if function == "trades_by_want" { //all open trades wanting a color and size
+		return t.trades_by_want(stub, args)
+	} else if function == "get_config" { //admins, rules, log level and features in use
+		return t.get_config(stub, args)
+	} else if function == "get_log_level" { //how much the chaincode logs
+		return logging.GetLevel(stub, defaultLogLevel)
+	} else if function == "export_state" { //page through a snapshot of every user, marble and open trade, admin only
+		return t.export_state(stub, args)
 	}
-	fmt.Println("query did not find func: " + function) //error
-
-	return nil, errors.New("Received unknown function query")
+	return nil, errs.New(errs.InvalidArgument, "Received unknown function query")
 }
 
 // ============================================================================================================================
 // Read - read a variable from chaincode state
 // ============================================================================================================================
 func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
+	var name string
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting name of the var to query")
 	}
 
 	name = args[0]
 	valAsbytes, err := stub.GetState(name) //get the var from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, errs.New(errs.Internal, "Failed to get state for "+name)
+	}
+	if marble, err := parseMarble(name, valAsbytes); err == nil { //marbles always come back at the current schema version
+		return json.Marshal(marble)
 	}
 
 	return valAsbytes, nil //send it onward
@@ -194,37 +380,64 @@ func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 // ============================================================================================================================
 func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 1")
 	}
 
 	name := args[0]
-	err := stub.DelState(name) //remove the key from chaincode state
+	valAsBytes, err := stub.GetState(name) //see if this key holds a marble before it goes away
 	if err != nil {
-		return nil, errors.New("Failed to delete state")
+		return nil, errs.New(errs.Internal, "Failed to get state")
+	}
+	res := Marble{}
+	isMarble := json.Unmarshal(valAsBytes, &res) == nil && res.Name == name //anything else is a plain key/value
+	if isMarble {
+		err = t.authorizeUser(stub, res.User, "delete marble "+name) //only the owner deletes a marble
+		if err != nil {
+			return nil, err
+		}
+		if res.LockedBy != "" {
+			return nil, errs.New(errs.Conflict, "Marble "+name+" is locked by "+res.LockedBy)
+		}
+	} else {
+		err = t.authorizeAdmin(stub, "delete "+name) //the chaincode's own keys are only for admins
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = stub.DelState(name) //remove the key from chaincode state
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to delete state")
+	}
+
+	if isMarble {
+		err = unindexMarble(stub, res) //remove marble from owner and color/size indexes
+		if err != nil {
+			return nil, err
+		}
+		touchOwner(stub, res.User) //the owner's open trades may have counted on it
+		emit(stub, marbleDeleted(res))
+		logFor(stub).Info("marble deleted", "marble", name, "user", res.User)
 	}
 
 	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	marbleIndex, err := getMarbleIndex(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get marble index")
+		return nil, err
 	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex) //un stringify it aka JSON.parse()
 
 	//remove marble from index
 	for i, val := range marbleIndex {
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + name)
 		if val == name { //find the correct marble
-			fmt.Println("found marble")
 			marbleIndex = append(marbleIndex[:i], marbleIndex[i+1:]...) //remove it
-			for x := range marbleIndex {                                //debug prints...
-				fmt.Println(string(x) + " - " + marbleIndex[x])
-			}
 			break
 		}
 	}
 	jsonAsBytes, _ := json.Marshal(marbleIndex) //save new index
 	err = stub.PutState(marbleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
@@ -234,14 +447,17 @@ func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string
 func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string // Entities
 	var err error
-	fmt.Println("running write()")
 
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 2. name of the variable and value to set")
 	}
 
 	name = args[0] //rename for funsies
 	value = args[1]
+	err = t.authorizeAdmin(stub, "write "+name) //raw writes can overwrite anything, including the roles
+	if err != nil {
+		return nil, err
+	}
 	err = stub.PutState(name, []byte(value)) //write the variable into the chaincode state
 	if err != nil {
 		return nil, err
@@ -258,67 +474,65 @@ func (t *SimpleChaincode) init_marble(stub shim.ChaincodeStubInterface, args []s
 	//   0       1       2     3
 	// "asdf", "blue", "35", "bob"
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 4")
 	}
 
 	//input sanitation
-	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+	marble, err := validateMarble(stub, args[0], args[1], args[2], args[3]) //owner has to be registered
+	if err != nil {
+		return nil, err
 	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	name := marble.Name
+
+	err = marbleNameFree(stub, name) //check if marble already exists
+	if err != nil {
+		return nil, err
 	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+
+	err = createMarble(stub, marble)
+	if err != nil {
+		return nil, err
 	}
-	name := args[0]
-	color := strings.ToLower(args[1])
-	user := strings.ToLower(args[3])
-	size, err := strconv.Atoi(args[2])
+
+	err = addToMarbleIndex(stub, name) //store name of marble
 	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+		return nil, err
 	}
 
-	//check if marble already exists
+	logFor(stub).Info("marble created", "marble", name, "user", marble.User)
+	return nil, nil
+}
+
+// marbleNameFree refuses a name that already holds a marble, or anything else
+func marbleNameFree(stub shim.ChaincodeStubInterface, name string) error {
 	marbleAsBytes, err := stub.GetState(name)
 	if err != nil {
-		return nil, errors.New("Failed to get marble name")
+		return errs.New(errs.Internal, "Failed to get marble name")
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res)
-	if res.Name == name {
-		fmt.Println("This marble arleady exists: " + name)
-		fmt.Println(res)
-		return nil, errors.New("This marble arleady exists") //all stop a marble by this name exists
+	if len(marbleAsBytes) > 0 {
+		res := Marble{}
+		if json.Unmarshal(marbleAsBytes, &res) == nil && res.Name == name {
+			return errs.New(errs.AlreadyExists, "This marble arleady exists") //all stop a marble by this name exists
+		}
+		return errs.New(errs.AlreadyExists, "Key "+name+" is already in use")
 	}
+	return nil
+}
 
-	//build the marble json string manually
-	str := `{"name": "` + name + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "user": "` + user + `"}`
-	err = stub.PutState(name, []byte(str)) //store marble with id as key
+// createMarble stores a new marble with its indexes and provenance, the caller adds it to the marble index
+func createMarble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	err := putMarble(stub, marble) //store marble with id as key
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	err = indexMarble(stub, marble) //add to owner and color/size indexes
 	if err != nil {
-		return nil, errors.New("Failed to get marble index")
+		return err
 	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex) //un stringify it aka JSON.parse()
-
-	//append
-	marbleIndex = append(marbleIndex, name) //add marble name to index list
-	fmt.Println("! marble index: ", marbleIndex)
-	jsonAsBytes, _ := json.Marshal(marbleIndex)
-	err = stub.PutState(marbleIndexStr, jsonAsBytes) //store name of marble
+	emit(stub, marbleCreated(marble))
 
-	fmt.Println("- end init marble")
-	return nil, nil
+	return recordOwnership(stub, marble.Name, "", marble.User, reasonCreate, "") //start the marble's provenance
 }
 
 // ============================================================================================================================
@@ -330,213 +544,407 @@ func (t *SimpleChaincode) set_user(stub shim.ChaincodeStubInterface, args []stri
 	//   0       1
 	// "name", "bob"
 	if len(args) < 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 2")
 	}
 
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	marbleAsBytes, err := stub.GetState(args[0])
+	marble, err := getMarble(stub, args[0])
 	if err != nil {
-		return nil, errors.New("Failed to get thing")
+		return nil, err
+	}
+	err = t.authorizeUser(stub, marble.User, "transfer marble "+marble.Name) //only the owner gives a marble away
+	if err != nil {
+		return nil, err
+	}
+	if marble.LockedBy != "" {
+		return nil, errs.New(errs.Conflict, "Marble "+marble.Name+" is locked by "+marble.LockedBy)
+	}
+	user, err := requireUser(stub, args[1]) //new owner has to be registered
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res) //un stringify it aka JSON.parse()
-	res.User = args[1]                  //change the user
 
-	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes) //rewrite the marble with id as key
+	err = transferMarble(stub, args[0], user, reasonTransfer, "")
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("- end set user")
 	return nil, nil
 }
 
+// ============================================================================================================================
+// Transfer Marble - change the owner of a marble, keep its indexes and provenance up to date
+// ============================================================================================================================
+func transferMarble(stub shim.ChaincodeStubInterface, name string, user string, reason string, tradeID string) error {
+	res, err := getMarble(stub, name)
+	if err != nil {
+		return err
+	}
+	previous := res.User
+	err = unindexMarble(stub, res) //drop the old owner from the index
+	if err != nil {
+		return err
+	}
+	res.User = user //change the user
+
+	err = putMarble(stub, res) //rewrite the marble with id as key
+	if err != nil {
+		return err
+	}
+
+	err = indexMarble(stub, res) //index under the new owner
+	if err != nil {
+		return err
+	}
+	err = recordOwnership(stub, name, previous, user, reason, tradeID)
+	if err != nil {
+		return err
+	}
+	touchOwner(stub, previous) //the previous owner's open trades may have counted on it
+	emit(stub, marbleTransferred(name, previous, user, reason, tradeID))
+	logFor(stub).Info("marble transferred", "marble", name, "user", user, "from", previous, "reason", reason)
+	return nil
+}
+
 // ============================================================================================================================
 // Open Trade - create an open trade for a marble you want with marbles you have
 // ============================================================================================================================
 func (t *SimpleChaincode) open_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	var will_size int
+	var will_size, will_qty int
 	var trade_away Description
 
 	//	0        1      2     3      4      5       6
 	//["bob", "blue", "16", "red", "16"] *"blue", "35*
+	//or in escrow, naming the marbles to lock
+	//["bob", "blue", "16", "escrow", "m1"] *"m2"*
+	//a size can carry a quantity for bundles, "16x2" is two 16s, escrowed bundles join names with "+"
+	//["bob", "red", "35", "blue", "16x2"] or ["bob", "red", "35", "escrow", "m1+m2"]
+	//either form can end with a time to live in seconds
+	//[... *"ttl", "3600"*]
+	ttl, args, err := parseTTL(args)
+	if err != nil {
+		return nil, err
+	}
+	isEscrow := len(args) > 3 && args[3] == escrowMarker
 	if len(args) < 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting like 5?")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user, wanted color and size, then colors and sizes or escrow and marble names to give")
+	}
+	if len(args)%2 == 0 && !isEscrow {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting an odd number")
+	}
+
+	size1, qty1, err := parseSizeQuantity(args[2])
+	if err != nil {
+		return nil, errs.Arg(2, "3rd argument must be a numeric string")
 	}
-	if len(args)%2 == 0 {
-		return nil, errors.New("Incorrect number of arguments. Expecting an odd number")
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
 	}
 
-	size1, err := strconv.Atoi(args[2])
+	user, err := requireUser(stub, args[0]) //opener has to be registered
 	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+		return nil, errs.WithArg(err, 0)
 	}
 
 	open := AnOpenTrade{}
-	open.User = args[0]
-	open.Timestamp = makeTimestamp() //use timestamp as an ID
+	open.ID = stub.GetTxID() //tx id is unique and the same on every peer
+	open.User = user
+	open.Timestamp = timestamp
 	open.Want.Color = args[1]
 	open.Want.Size = size1
-	fmt.Println("- start open trade")
-	jsonAsBytes, _ := json.Marshal(open)
-	err = stub.PutState("_debug1", jsonAsBytes)
+	open.Want.Quantity = qty1
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	open.Want, err = validateDescription(rules, open.Want, 1)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		open.Expires = timestamp + ttl*1000
+	}
+	if isEscrow { //lock the named marbles, they are what the opener is willing to give
+		err = t.escrowMarbles(stub, &open, args[4:])
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	for i := 3; i < len(args); i++ { //create and append each willing trade
-		will_size, err = strconv.Atoi(args[i+1])
+	for i := 3; i < len(args) && !isEscrow; i++ { //create and append each willing trade
+		will_size, will_qty, err = parseSizeQuantity(args[i+1])
 		if err != nil {
-			msg := "is not a numeric string " + args[i+1]
-			fmt.Println(msg)
-			return nil, errors.New(msg)
+			return nil, errs.Arg(i+1, "is not a numeric string "+args[i+1])
 		}
 
 		trade_away = Description{}
 		trade_away.Color = args[i]
 		trade_away.Size = will_size
-		fmt.Println("! created trade_away: " + args[i])
-		jsonAsBytes, _ = json.Marshal(trade_away)
-		err = stub.PutState("_debug2", jsonAsBytes)
-
+		trade_away.Quantity = will_qty
+		trade_away, err = validateDescription(rules, trade_away, i)
+		if err != nil {
+			return nil, err
+		}
 		open.Willing = append(open.Willing, trade_away)
-		fmt.Println("! appended willing to open")
 		i++
 	}
 
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
-	if err != nil {
-		return nil, errors.New("Failed to get opentrades")
-	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades) //un stringify it aka JSON.parse()
-
-	trades.OpenTrades = append(trades.OpenTrades, open) //append to open trades
-	fmt.Println("! appended open to trades")
-	jsonAsBytes, _ = json.Marshal(trades)
-	err = stub.PutState(openTradesStr, jsonAsBytes) //rewrite open orders
+	err = putTrade(stub, open) //store the trade under its own key
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("- end open trade")
+	emit(stub, tradeOpened(open))
+	logFor(stub).Info("trade opened", "trade", open.ID, "user", open.User, "escrow", strconv.FormatBool(isEscrow))
 	return nil, nil
 }
 
 // ============================================================================================================================
 // Perform Trade - close an open trade and move ownership
 // ============================================================================================================================
+// Every precondition is checked before anything is written. Any failure after that returns an error, and the peer then
+// discards all of this transaction's writes, so both transfers and the trade removal happen together or not at all.
 func (t *SimpleChaincode) perform_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
 	//	0		1					2					3				4					5
 	//[data.id, data.closer.user, data.closer.name, data.opener.user, data.opener.color, data.opener.size]
 	if len(args) < 6 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 6")
 	}
 
-	fmt.Println("- start close trade")
-	timestamp, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return nil, errors.New("1st argument must be a numeric string")
+	for i := 0; i < 5; i++ {
+		if len(args[i]) <= 0 {
+			return nil, errs.Arg(i, "Argument "+strconv.Itoa(i+1)+" must be a non-empty string")
+		}
 	}
-
 	size, err := strconv.Atoi(args[5])
 	if err != nil {
-		return nil, errors.New("6th argument must be a numeric string")
+		return nil, errs.Arg(5, "6th argument must be a numeric string")
 	}
-
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+	closer, err := requireUser(stub, args[1]) //both sides have to be registered
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	opener, err := requireUser(stub, args[3])
 	if err != nil {
-		return nil, errors.New("Failed to get opentrades")
+		return nil, errs.WithArg(err, 3)
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades) //un stringify it aka JSON.parse()
 
-	for i := range trades.OpenTrades { //look for the trade
-		fmt.Println("looking at " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10) + " for " + strconv.FormatInt(timestamp, 10))
-		if trades.OpenTrades[i].Timestamp == timestamp {
-			fmt.Println("found the trade")
+	//the trade has to exist
+	open, err := getTrade(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	if open.isExpired(now) {
+		return nil, errs.New(errs.Conflict, "Trade "+args[0]+" has expired")
+	}
+	if normalizeUserID(open.User) != opener {
+		return nil, errs.Arg(3, "Trade "+args[0]+" was opened by "+open.User+", not "+opener)
+	}
+	if opener == closer {
+		return nil, errs.New(errs.InvalidArgument, "Cannot close your own trade")
+	}
 
-			marbleAsBytes, err := stub.GetState(args[2])
-			if err != nil {
-				return nil, errors.New("Failed to get thing")
-			}
-			closersMarble := Marble{}
-			json.Unmarshal(marbleAsBytes, &closersMarble) //un stringify it aka JSON.parse()
-
-			//verify if marble meets trade requirements
-			if closersMarble.Color != trades.OpenTrades[i].Want.Color || closersMarble.Size != trades.OpenTrades[i].Want.Size {
-				msg := "marble in input does not meet trade requriements"
-				fmt.Println(msg)
-				return nil, errors.New(msg)
+	//the closer has to own as many marbles as the trade wants, each meeting the trade requirements
+	closerNames := append([]string{args[2]}, args[6:]...) //bundle trades name the extra marbles after the size
+	if len(closerNames) != open.Want.count() {
+		return nil, errs.New(errs.InvalidArgument, "Trade "+args[0]+" wants "+strconv.Itoa(open.Want.count())+" marbles, got "+strconv.Itoa(len(closerNames)))
+	}
+	closersMarbles := []Marble{}
+	for i, name := range closerNames {
+		for _, prev := range closerNames[:i] {
+			if prev == name {
+				return nil, errs.New(errs.InvalidArgument, "Marble "+name+" is offered twice")
 			}
+		}
+		closersMarble, err := getMarble(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		if normalizeUserID(closersMarble.User) != closer {
+			return nil, errs.New(errs.Conflict, "Marble "+closersMarble.Name+" is not owned by "+closer)
+		}
+		err = t.authorizeUser(stub, closersMarble.User, "close trade "+args[0]+" with marble "+closersMarble.Name) //only the holder of the offered marble
+		if err != nil {
+			return nil, err
+		}
+		if closersMarble.LockedBy != "" {
+			return nil, errs.New(errs.Conflict, "Marble "+closersMarble.Name+" is locked by "+closersMarble.LockedBy)
+		}
+		if !strings.EqualFold(closersMarble.Color, open.Want.Color) || closersMarble.Size != open.Want.Size {
+			return nil, errs.New(errs.Conflict, "marble in input does not meet trade requriements")
+		}
+		closersMarbles = append(closersMarbles, closersMarble)
+	}
 
-			marble, e := findMarble4Trade(stub, trades.OpenTrades[i].User, args[4], size) //find a marble that is suitable from opener
-			if e == nil {
-				fmt.Println("! no errors, proceeding")
+	//the opener has to be willing to give this kind of marble, and still own enough of them
+	option, ok := open.willingOption(args[4], size)
+	if !ok {
+		return nil, errs.Arg(4, "Trade "+args[0]+" does not offer a "+args[4]+" "+args[5])
+	}
+	openersMarbles, err := openersMarbles4Trade(stub, open, args[4], size, option.count()) //find suitable marbles from opener
+	if err != nil {
+		return nil, errs.Prefix("Opener no longer owns a "+args[4]+" "+args[5]+": ", err)
+	}
+	logFor(stub).Debug("trade checks passed", "trade", args[0], "user", closer)
 
-				t.set_user(stub, []string{args[2], trades.OpenTrades[i].User}) //change owner of selected marble, closer -> opener
-				t.set_user(stub, []string{marble.Name, args[1]})               //change owner of selected marble, opener -> closer
+	err = releaseEscrow(stub, open) //the trade is closing, nothing stays locked
+	if err != nil {
+		return nil, err
+	}
 
-				trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...) //remove trade
-				jsonAsBytes, _ := json.Marshal(trades)
-				err = stub.PutState(openTradesStr, jsonAsBytes) //rewrite open orders
-				if err != nil {
-					return nil, err
-				}
-			}
+	//settle, closer -> opener and opener -> closer, then close the trade
+	for _, marble := range closersMarbles {
+		err = transferMarble(stub, marble.Name, open.User, reasonTrade, args[0])
+		if err != nil {
+			return nil, err
 		}
 	}
-	fmt.Println("- end close trade")
+	for _, marble := range openersMarbles {
+		err = transferMarble(stub, marble.Name, closer, reasonTrade, args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = deleteTrade(stub, open) //close the trade
+	if err != nil {
+		return nil, err
+	}
+	emit(stub, tradePerformed(open, closer, marbleNames(closersMarbles), marbleNames(openersMarbles)))
+	logFor(stub).Info("trade performed", "trade", args[0], "user", closer, "opener", open.User)
 	return nil, nil
 }
 
 // ============================================================================================================================
-// findMarble4Trade - look for a matching marble that this user owns and return it
+// findMarbles4Trade - look for count matching marbles that this user owns and return them
 // ============================================================================================================================
-func findMarble4Trade(stub shim.ChaincodeStubInterface, user string, color string, size int) (m Marble, err error) {
-	var fail Marble
-	fmt.Println("- start find marble 4 trade")
-	fmt.Println("looking for " + user + ", " + color + ", " + strconv.Itoa(size))
+func findMarbles4Trade(stub shim.ChaincodeStubInterface, user string, color string, size int, count int) ([]Marble, error) {
+	var found []Marble
+	log := logFor(stub).With("user", user)
+	log.Debug("looking for marbles to trade", "count", strconv.Itoa(count), "color", color, "size", strconv.Itoa(size))
 
-	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	//get the names of this user's marbles from the owner index
+	names, err := marbleNamesByOwner(stub, user)
 	if err != nil {
-		return fail, errors.New("Failed to get marble index")
+		return nil, errs.New(errs.Internal, "Failed to get owner index")
 	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex) //un stringify it aka JSON.parse()
 
-	for i := range marbleIndex { //iter through all the marbles
-		//fmt.Println("looking @ marble name: " + marbleIndex[i]);
-
-		marbleAsBytes, err := stub.GetState(marbleIndex[i]) //grab this marble
+	for i := range names { //iter through the user's marbles only
+		marbleAsBytes, err := stub.GetState(names[i]) //grab this marble
 		if err != nil {
-			return fail, errors.New("Failed to get marble")
+			return nil, errs.New(errs.Internal, "Failed to get marble")
+		}
+		if marbleAsBytes == nil { //stale index entry
+			continue
+		}
+		res, err := parseMarble(names[i], marbleAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		if res.LockedBy != "" { //held in escrow for another trade
+			continue
 		}
-		res := Marble{}
-		json.Unmarshal(marbleAsBytes, &res) //un stringify it aka JSON.parse()
-		//fmt.Println("looking @ " + res.User + ", " + res.Color + ", " + strconv.Itoa(res.Size));
 
 		//check for user && color && size
 		if strings.ToLower(res.User) == strings.ToLower(user) && strings.ToLower(res.Color) == strings.ToLower(color) && res.Size == size {
-			fmt.Println("found a marble: " + res.Name)
-			fmt.Println("! end find marble 4 trade")
-			return res, nil
+			log.Debug("found a marble to trade", "marble", res.Name)
+			found = append(found, res)
+			if len(found) == count {
+				return found, nil
+			}
+		}
+	}
+
+	return nil, errs.New(errs.Conflict, "Did not find marble to use in this trade")
+}
+
+// ============================================================================================================================
+// Trade ID - the id clients use for a trade, trades opened before ids existed are known by their timestamp
+// ============================================================================================================================
+func (open AnOpenTrade) tradeID() string {
+	if open.ID == "" {
+		return strconv.FormatInt(open.Timestamp, 10)
+	}
+	return open.ID
+}
+
+// hasID tells if the client supplied id names this trade
+func (open AnOpenTrade) hasID(id string) bool {
+	return open.tradeID() == id
+}
+
+// isExpired tells if the trade's time to live ran out by the given timestamp
+func (open AnOpenTrade) isExpired(now int64) bool {
+	return open.Expires > 0 && now >= open.Expires
+}
+
+// willingOption is the first option offering marbles of this color and size
+func (open AnOpenTrade) willingOption(color string, size int) (Description, bool) {
+	for _, willing := range open.Willing {
+		if strings.EqualFold(willing.Color, color) && willing.Size == size {
+			return willing, true
 		}
 	}
+	return Description{}, false
+}
 
-	fmt.Println("- end find marble 4 trade - error")
-	return fail, errors.New("Did not find marble to use in this trade")
+// count is how many marbles the description stands for, descriptions from before bundles are a single marble
+func (d Description) count() int {
+	if d.Quantity < 1 {
+		return 1
+	}
+	return d.Quantity
 }
 
 // ============================================================================================================================
-// Make Timestamp - create a timestamp in ms
+// Get Marble Index - the names of every marble, an unset index is empty
 // ============================================================================================================================
-func makeTimestamp() int64 {
-	return time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
+func getMarbleIndex(stub shim.ChaincodeStubInterface) ([]string, error) {
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get marble index")
+	}
+	var marbleIndex []string
+	if len(marblesAsBytes) == 0 {
+		return marbleIndex, nil
+	}
+	err = json.Unmarshal(marblesAsBytes, &marbleIndex) //un stringify it aka JSON.parse()
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Corrupt marble index")
+	}
+	return marbleIndex, nil
+}
+
+// addToMarbleIndex appends names to the list of all marbles, one write however many names
+func addToMarbleIndex(stub shim.ChaincodeStubInterface, names ...string) error {
+	marbleIndex, err := getMarbleIndex(stub)
+	if err != nil {
+		return err
+	}
+	marbleIndex = append(marbleIndex, names...) //add marble names to index list
+	jsonAsBytes, _ := json.Marshal(marbleIndex)
+	return stub.PutState(marbleIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Tx Timestamp - the timestamp of the running transaction in ms, the same on every peer
+// ============================================================================================================================
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	if ts == nil {
+		return 0, errs.New(errs.Internal, "Transaction has no timestamp")
+	}
+	return ts.Seconds*1000 + int64(ts.Nanos)/int64(time.Millisecond), nil
 }
 
 // ============================================================================================================================
@@ -548,105 +956,72 @@ func (t *SimpleChaincode) remove_trade(stub shim.ChaincodeStubInterface, args []
 	//	0
 	//[data.id]
 	if len(args) < 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 1")
 	}
 
-	fmt.Println("- start remove trade")
-	timestamp, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return nil, errors.New("1st argument must be a numeric string")
+	if len(args[0]) <= 0 {
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
 	}
 
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+	open, err := getTrade(stub, args[0])
 	if err != nil {
-		return nil, errors.New("Failed to get opentrades")
+		return nil, err
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades) //un stringify it aka JSON.parse()
-
-	for i := range trades.OpenTrades { //look for the trade
-		//fmt.Println("looking at " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10) + " for " + strconv.FormatInt(timestamp, 10))
-		if trades.OpenTrades[i].Timestamp == timestamp {
-			fmt.Println("found the trade")
-			trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...) //remove this trade
-			jsonAsBytes, _ := json.Marshal(trades)
-			err = stub.PutState(openTradesStr, jsonAsBytes) //rewrite open orders
-			if err != nil {
-				return nil, err
-			}
-			break
-		}
+	err = t.authorizeUser(stub, open.User, "remove trade "+args[0]) //only the trade's creator
+	if err != nil {
+		return nil, err
 	}
-
-	fmt.Println("- end remove trade")
+	err = releaseEscrow(stub, open)
+	if err != nil {
+		return nil, err
+	}
+	err = deleteTrade(stub, open)
+	if err != nil {
+		return nil, err
+	}
+	emit(stub, tradeRemoved(open, events.RemovedByUser))
+	logFor(stub).Info("trade removed", "trade", args[0], "user", open.User)
 	return nil, nil
 }
 
 // ============================================================================================================================
-// Clean Up Open Trades - make sure open trades are still possible, remove choices that are no longer possible, remove trades that have no valid choices
+// Reindex Marbles - rebuild the name, owner and color/size indexes from the marble index, for ledgers created before them
 // ============================================================================================================================
-func cleanTrades(stub shim.ChaincodeStubInterface) (err error) {
-	var didWork = false
-	fmt.Println("- start clean trades")
-
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+func (t *SimpleChaincode) reindex_marbles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := t.authorizeRole(stub, roles.Operator, "reindex marbles")
 	if err != nil {
-		return errors.New("Failed to get opentrades")
+		return nil, err
+	}
+	err = clearIndexes(stub)
+	if err != nil {
+		return nil, err
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades) //un stringify it aka JSON.parse()
-
-	fmt.Println("# trades " + strconv.Itoa(len(trades.OpenTrades)))
-	for i := 0; i < len(trades.OpenTrades); { //iter over all the known open trades
-		fmt.Println(strconv.Itoa(i) + ": looking at trade " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10))
 
-		fmt.Println("# options " + strconv.Itoa(len(trades.OpenTrades[i].Willing)))
-		for x := 0; x < len(trades.OpenTrades[i].Willing); { //find a marble that is suitable
-			fmt.Println("! on next option " + strconv.Itoa(i) + ":" + strconv.Itoa(x))
-			_, e := findMarble4Trade(stub, trades.OpenTrades[i].User, trades.OpenTrades[i].Willing[x].Color, trades.OpenTrades[i].Willing[x].Size)
-			if e != nil {
-				fmt.Println("! errors with this option, removing option")
-				didWork = true
-				trades.OpenTrades[i].Willing = append(trades.OpenTrades[i].Willing[:x], trades.OpenTrades[i].Willing[x+1:]...) //remove this option
-				x--
-			} else {
-				fmt.Println("! this option is fine")
-			}
+	//get the marble index
+	marbleIndex, err := getMarbleIndex(stub)
+	if err != nil {
+		return nil, err
+	}
 
-			x++
-			fmt.Println("! x:" + strconv.Itoa(x))
-			if x >= len(trades.OpenTrades[i].Willing) { //things might have shifted, recalcuate
-				break
-			}
+	for i := range marbleIndex {
+		marbleAsBytes, err := stub.GetState(marbleIndex[i])
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get marble "+marbleIndex[i])
 		}
-
-		if len(trades.OpenTrades[i].Willing) == 0 {
-			fmt.Println("! no more options for this trade, removing trade")
-			didWork = true
-			trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...) //remove this trade
-			i--
+		if marbleAsBytes == nil {
+			logFor(stub).Warning("skipping missing marble", "marble", marbleIndex[i])
+			continue
 		}
-
-		i++
-		fmt.Println("! i:" + strconv.Itoa(i))
-		if i >= len(trades.OpenTrades) { //things might have shifted, recalcuate
-			break
+		res, err := parseMarble(marbleIndex[i], marbleAsBytes)
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	if didWork {
-		fmt.Println("! saving open trade changes")
-		jsonAsBytes, _ := json.Marshal(trades)
-		err = stub.PutState(openTradesStr, jsonAsBytes) //rewrite open orders
+		err = indexMarble(stub, res)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
-		fmt.Println("! all open trades are fine")
 	}
 
-	fmt.Println("- end clean trades")
-	return nil
+	logFor(stub).Info("marbles reindexed", "marbles", strconv.Itoa(len(marbleIndex)))
+	return nil, nil
 }
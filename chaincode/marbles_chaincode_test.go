@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// newTestChaincode deploys the chaincode on a fresh in-memory stub, testAdmin deploys it and so is its admin
+func newTestChaincode(t *testing.T) (*SimpleChaincode, *memStub) {
+	t.Helper()
+	cc := new(SimpleChaincode)
+	stub := newMemStub()
+	stub.as(testAdmin)
+	stub.begin()
+	_, err := cc.Init(stub, "init", []string{"99"})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	for _, user := range testUsers {
+		mustInvoke(t, stub, cc, "register_user", user)
+	}
+	stub.as("")
+	return cc, stub
+}
+
+var testUsers = []string{"alice", "bob", "carol", "dave"} //registered by newTestChaincode
+var testAdmin = "root"                                    //deploys the chaincode in newTestChaincode
+
+func storedMarble(t *testing.T, stub *memStub, name string) Marble {
+	t.Helper()
+	var m Marble
+	if err := json.Unmarshal(stub.state[name], &m); err != nil {
+		t.Fatalf("marble %s is not valid json: %s", name, err)
+	}
+	return m
+}
+
+func storedMarbleIndex(t *testing.T, stub *memStub) []string {
+	t.Helper()
+	var index []string
+	if err := json.Unmarshal(stub.state[marbleIndexStr], &index); err != nil {
+		t.Fatalf("marble index is not valid json: %s", err)
+	}
+	return index
+}
+
+// getOpenTrades reads the committed open trades in the order they were opened
+func getOpenTrades(t *testing.T, stub *memStub) []AnOpenTrade {
+	t.Helper()
+	prefix, _ := createCompositeKey(tradeStr, []string{})
+	trades := []AnOpenTrade{}
+	for key, value := range stub.state {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		var open AnOpenTrade
+		if err := json.Unmarshal(value, &open); err != nil {
+			t.Fatalf("open trade %q is not valid json: %s", key, err)
+		}
+		trades = append(trades, open)
+	}
+	sort.Stable(byOpening(trades))
+	return trades
+}
+
+// tradeKeyOf is the state key of an open trade
+func tradeKeyOf(t *testing.T, id string) string {
+	t.Helper()
+	key, err := tradeKey(id)
+	if err != nil {
+		t.Fatalf("no trade key for %q: %s", id, err)
+	}
+	return key
+}
+
+// tradeID returns the id a client would pass to perform_trade/remove_trade for the i-th open trade
+func tradeID(t *testing.T, stub *memStub, i int) string {
+	t.Helper()
+	trades := getOpenTrades(t, stub)
+	if i >= len(trades) {
+		t.Fatalf("only %d open trades, wanted #%d", len(trades), i)
+	}
+	return trades[i].tradeID()
+}
+
+// seedMarbles creates bob's blue 16 "b1" and red 35 "b2", and alice's green 16 "a1"
+func seedMarbles(t *testing.T, cc *SimpleChaincode, stub *memStub) {
+	t.Helper()
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b2", "red", "35", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+}
+
+func TestInit(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	if _, ok := stub.state["abc"]; ok {
+		t.Error("init should not write the abc test key")
+	}
+	if len(storedMarbleIndex(t, stub)) != 0 {
+		t.Error("marble index should be empty after init")
+	}
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("open trades should be empty after init")
+	}
+
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "init", "1", "2")
+	mustFail(t, stub, cc, "init", "abc")
+	mustFail(t, stub, cc, "init", `{"admins":[" "]}`)
+	mustFail(t, stub, cc, "init", `{"log_level":"loud"}`)
+	mustFail(t, stub, cc, "init", `{"rules":{"colors":[],"min_size":1,"max_size":5,"max_name_length":8}}`)
+
+	//running init again, with the number older deploy scripts send or with nothing, keeps the ledger
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvokeAs(t, stub, cc, testAdmin, "init", "7")
+	mustInvokeAs(t, stub, cc, testAdmin, "init")
+	if len(storedMarbleIndex(t, stub)) != 3 || len(getOpenTrades(t, stub)) != 1 {
+		t.Error("init should keep the marble index and open trades")
+	}
+	if got := namesByOwner(t, stub, "bob"); len(got) != 2 {
+		t.Errorf("init should keep the owner index, got %v", got)
+	}
+
+	stub.as(testAdmin)
+	stub.failGet[marbleIndexStr] = true
+	mustFail(t, stub, cc, "init")
+	delete(stub.failGet, marbleIndexStr)
+	stub.failGet[openTradesStr] = true
+	mustFail(t, stub, cc, "init")
+	delete(stub.failGet, openTradesStr)
+}
+
+func TestRunAndUnknownFunctions(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as(testAdmin)
+	stub.begin()
+	_, err := cc.Run(stub, "write", []string{"k", "v"})
+	stub.end(err)
+	if err != nil || string(stub.state["k"]) != "v" {
+		t.Errorf("Run should dispatch to Invoke, err=%v k=%q", err, stub.state["k"])
+	}
+
+	mustFail(t, stub, cc, "no_such_function")
+	if _, err := stub.query(cc, "no_such_function"); err == nil {
+		t.Error("unknown query should fail")
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustFail(t, stub, cc, "write", "k")
+	mustFail(t, stub, cc, "write", "k", "v", "x")
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "k", "v")
+
+	res, err := stub.query(cc, "read", "k")
+	if err != nil || string(res) != "v" {
+		t.Errorf("read k = %q, %v", res, err)
+	}
+	res, err = stub.query(cc, "read", "missing")
+	if err != nil || res != nil {
+		t.Errorf("read of a missing key = %q, %v, want nil, nil", res, err)
+	}
+	if _, err := stub.query(cc, "read"); err == nil {
+		t.Error("read without args should fail")
+	}
+	stub.failGet["k"] = true
+	if _, err := stub.query(cc, "read", "k"); err == nil {
+		t.Error("read should surface GetState failures")
+	}
+
+	stub.failPut["k"] = true
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "write", "k", "w")
+}
+
+func TestInitMarble(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustInvoke(t, stub, cc, "init_marble", "m1", "BLUE", "16", "Bob")
+	want := Marble{Name: "m1", Color: "blue", Size: 16, User: "bob", Schema: marbleSchema.Current()}
+	if got := storedMarble(t, stub, "m1"); got != want {
+		t.Errorf("marble = %+v, want %+v", got, want)
+	}
+	if index := storedMarbleIndex(t, stub); !reflect.DeepEqual(index, []string{"m1"}) {
+		t.Errorf("index = %v, want [m1]", index)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"too few args", []string{"m2", "blue", "16"}},
+		{"too many args", []string{"m2", "blue", "16", "bob", "x"}},
+		{"empty name", []string{"", "blue", "16", "bob"}},
+		{"empty color", []string{"m2", "", "16", "bob"}},
+		{"empty size", []string{"m2", "blue", "", "bob"}},
+		{"empty user", []string{"m2", "blue", "16", ""}},
+		{"size not a number", []string{"m2", "blue", "big", "bob"}},
+		{"duplicate", []string{"m1", "red", "35", "alice"}},
+	}
+	for _, c := range cases {
+		if _, err := stub.invoke(cc, "init_marble", c.args...); err == nil {
+			t.Errorf("%s: init_marble%v should fail", c.name, c.args)
+		}
+	}
+	if index := storedMarbleIndex(t, stub); len(index) != 1 {
+		t.Errorf("failed creates should not touch the index, got %v", index)
+	}
+
+	stub.failGet["m2"] = true
+	mustFail(t, stub, cc, "init_marble", "m2", "blue", "16", "bob")
+	stub.failPut["m3"] = true
+	mustFail(t, stub, cc, "init_marble", "m3", "blue", "16", "bob")
+	stub.failGet[marbleIndexStr] = true
+	mustFail(t, stub, cc, "init_marble", "m4", "blue", "16", "bob")
+}
+
+func TestSetUser(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "set_user", "b1")
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	if got := storedMarble(t, stub, "b1").User; got != "alice" {
+		t.Errorf("b1 owner = %s, want alice", got)
+	}
+
+	stub.failGet["b2"] = true
+	mustFail(t, stub, cc, "set_user", "b2", "alice")
+	delete(stub.failGet, "b2")
+	stub.failPut["b2"] = true
+	mustFail(t, stub, cc, "set_user", "b2", "alice")
+}
+
+func TestSetUserCleansTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	//bob offers his blue 16 or red 35 for a green 16
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "red", "35")
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", "alice")
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 1 || !reflect.DeepEqual(trades[0].Willing, []Description{{Color: "red", Size: 35}}) {
+		t.Fatalf("blue 16 option should be gone, trades = %+v", trades)
+	}
+
+	mustInvoke(t, stub, cc, "set_user", "b2", "alice")
+	if trades := getOpenTrades(t, stub); len(trades) != 0 {
+		t.Errorf("trade without options should be removed, trades = %+v", trades)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35")
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "delete")
+	mustInvoke(t, stub, cc, "delete", "b2")
+	if _, ok := stub.state["b2"]; ok {
+		t.Error("b2 should be deleted")
+	}
+	if index := storedMarbleIndex(t, stub); !reflect.DeepEqual(index, []string{"b1", "a1"}) {
+		t.Errorf("index = %v, want [b1 a1]", index)
+	}
+	if trades := getOpenTrades(t, stub); len(trades) != 0 {
+		t.Errorf("trade offering the deleted marble should be removed, trades = %+v", trades)
+	}
+
+	//deleting a key that is not a marble leaves the index alone
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "k", "v")
+	mustInvokeAs(t, stub, cc, testAdmin, "delete", "k")
+	if index := storedMarbleIndex(t, stub); len(index) != 2 {
+		t.Errorf("index = %v, want 2 marbles", index)
+	}
+
+	stub.failPut["b1"] = true
+	mustFail(t, stub, cc, "delete", "b1")
+	delete(stub.failPut, "b1")
+	stub.failGet[marbleIndexStr] = true
+	mustFail(t, stub, cc, "delete", "b1")
+}
+
+func TestOpenTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "red", "35")
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 1 {
+		t.Fatalf("want 1 open trade, got %d", len(trades))
+	}
+	open := trades[0]
+	if open.User != "bob" || open.Want != (Description{Color: "green", Size: 16}) {
+		t.Errorf("unexpected trade %+v", open)
+	}
+	if open.ID != stub.txID || open.Timestamp != stub.txTime.Unix()*1000 {
+		t.Errorf("trade id and timestamp should come from the transaction, got %+v", open)
+	}
+	if !reflect.DeepEqual(open.Willing, []Description{{Color: "blue", Size: 16}, {Color: "red", Size: 35}}) {
+		t.Errorf("willing = %+v", open.Willing)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"too few args", []string{"bob", "green", "16", "blue"}},
+		{"even number of args", []string{"bob", "green", "16", "blue", "16", "red"}},
+		{"want size not a number", []string{"bob", "green", "x", "blue", "16"}},
+		{"willing size not a number", []string{"bob", "green", "16", "blue", "x"}},
+	}
+	for _, c := range cases {
+		if _, err := stub.invoke(cc, "open_trade", c.args...); err == nil {
+			t.Errorf("%s: open_trade%v should fail", c.name, c.args)
+		}
+	}
+	if trades := getOpenTrades(t, stub); len(trades) != 1 {
+		t.Errorf("failed open_trade calls should not add trades, got %d", len(trades))
+	}
+
+	next := "tx" + strconv.Itoa(stub.txNum+1) //the trade id open_trade is about to use
+	stub.failPut[tradeKeyOf(t, next)] = true
+	mustFail(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+}
+
+func TestPerformTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	//alice gives a1 (green 16) and gets one of bob's blue 16s
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	if got := storedMarble(t, stub, "a1").User; got != "bob" {
+		t.Errorf("a1 owner = %s, want bob", got)
+	}
+	if got := storedMarble(t, stub, "b1").User; got != "alice" {
+		t.Errorf("b1 owner = %s, want alice", got)
+	}
+	if trades := getOpenTrades(t, stub); len(trades) != 0 {
+		t.Errorf("trade should be closed, trades = %+v", trades)
+	}
+}
+
+func TestPerformTradeErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue")
+	mustFail(t, stub, cc, "perform_trade", "", "alice", "a1", "bob", "blue", "16")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "x")
+
+	//a2 is a red 35, bob wants a green 16
+	mustInvoke(t, stub, cc, "init_marble", "a2", "red", "35", "alice")
+	err := mustFail(t, stub, cc, "perform_trade", id, "alice", "a2", "bob", "blue", "16")
+	if !strings.Contains(err.Error(), "requriements") {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	stub.failGet["a1"] = true
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	delete(stub.failGet, "a1")
+	stub.failGet[tradeKeyOf(t, id)] = true
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	delete(stub.failGet, tradeKeyOf(t, id))
+
+	//every failed precondition is reported
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown trade", []string{"12345", "alice", "a1", "bob", "blue", "16"}, "not found"},
+		{"wrong opener", []string{id, "alice", "a1", "carol", "blue", "16"}, "was opened by"},
+		{"own trade", []string{id, "bob", "a1", "bob", "blue", "16"}, "your own"},
+		{"missing closer marble", []string{id, "alice", "nope", "bob", "blue", "16"}, "does not exist"},
+		{"closer does not own the marble", []string{id, "carol", "a1", "bob", "blue", "16"}, "not owned by"},
+		{"option not offered", []string{id, "alice", "a1", "bob", "red", "35"}, "does not offer"},
+		{"empty closer", []string{id, "", "a1", "bob", "blue", "16"}, "non-empty"},
+	}
+	for _, c := range cases {
+		_, err := stub.invoke(cc, "perform_trade", c.args...)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: perform_trade%v = %v, want error containing %q", c.name, c.args, err, c.want)
+		}
+	}
+
+	//the opener gave away the marble they offered
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "b1", `{"name":"b1","color":"blue","size":16,"user":"dave"}`)
+	err = mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	if !strings.Contains(err.Error(), "no longer owns") {
+		t.Errorf("unexpected error %s", err)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "b1", `{"name":"b1","color":"blue","size":16,"user":"bob"}`)
+
+	if storedMarble(t, stub, "a1").User != "alice" || storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("no marble should have moved")
+	}
+	if trades := getOpenTrades(t, stub); len(trades) != 1 {
+		t.Errorf("trade should still be open, trades = %+v", trades)
+	}
+}
+
+func TestRemoveTrade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	stub.as("bob")
+	mustFail(t, stub, cc, "remove_trade")
+	mustFail(t, stub, cc, "remove_trade", "")
+	err := mustFail(t, stub, cc, "remove_trade", "12345")
+	mustFailWith(t, err, errs.NotFound, -1)
+	if trades := getOpenTrades(t, stub); len(trades) != 1 {
+		t.Errorf("unknown id should not remove anything, trades = %+v", trades)
+	}
+
+	stub.failGet[tradeKeyOf(t, id)] = true
+	mustFail(t, stub, cc, "remove_trade", id)
+	delete(stub.failGet, tradeKeyOf(t, id))
+	stub.failPut[tradeKeyOf(t, id)] = true
+	mustFail(t, stub, cc, "remove_trade", id)
+	delete(stub.failPut, tradeKeyOf(t, id))
+
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	if trades := getOpenTrades(t, stub); len(trades) != 0 {
+		t.Errorf("trade should be removed, trades = %+v", trades)
+	}
+}
+
+func TestFindMarbles4Trade(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "b3", "red", "35", "bob")
+
+	stub.begin()
+	defer stub.end(nil)
+	found, err := findMarbles4Trade(stub, "BOB", "Red", 35, 2)
+	if err != nil || len(found) != 2 || found[0].Name != "b2" || found[1].Name != "b3" {
+		t.Errorf("findMarbles4Trade = %+v, %v, want b2 and b3", found, err)
+	}
+	if _, err := findMarbles4Trade(stub, "bob", "red", 35, 3); err == nil {
+		t.Error("bob has only two red 35s")
+	}
+	if _, err := findMarbles4Trade(stub, "alice", "red", 35, 1); err == nil {
+		t.Error("alice has no red 35")
+	}
+	stub.failGet["b1"] = true
+	if _, err := findMarbles4Trade(stub, "bob", "red", 35, 1); err == nil {
+		t.Error("findMarbles4Trade should surface GetState failures")
+	}
+	delete(stub.failGet, "b1")
+
+	//lookups go through the owner index, never the full marble list
+	stub.failGet[marbleIndexStr] = true
+	if found, err := findMarbles4Trade(stub, "bob", "blue", 16, 1); err != nil || found[0].Name != "b1" {
+		t.Errorf("findMarbles4Trade = %+v, %v, want b1", found, err)
+	}
+}
+
+func TestCleanTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16", "purple", "1", "red", "35")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "red", "35", "white", "2")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+
+	stub.begin()
+	err := cleanTradesOf(stub, []string{"alice", "bob"})
+	stub.end(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 2 {
+		t.Fatalf("alice's white 2 trade should be removed, trades = %+v", trades)
+	}
+	if !reflect.DeepEqual(trades[0].Willing, []Description{{Color: "blue", Size: 16}, {Color: "red", Size: 35}}) {
+		t.Errorf("purple option should be removed, willing = %+v", trades[0].Willing)
+	}
+	if trades[1].User != "alice" || trades[1].Want != (Description{Color: "blue", Size: 16}) {
+		t.Errorf("alice's green 16 trade should be kept, got %+v", trades[1])
+	}
+
+	stub.begin()
+	stub.failGet[tradeKeyOf(t, trades[0].ID)] = true
+	if err := cleanTradesOf(stub, []string{"bob"}); err == nil {
+		t.Error("cleanTradesOf should surface GetState failures")
+	}
+	stub.end(nil)
+}
+
+func TestLegacyTradeIDs(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	//trades opened before ids existed are only known by their timestamp
+	legacy := `{"open_trades":[` +
+		`{"user":"bob","timestamp":1475000000000,"want":{"color":"green","size":16},"willing":[{"color":"blue","size":16}]},` +
+		`{"user":"bob","timestamp":1475000000001,"want":{"color":"green","size":16},"willing":[{"color":"red","size":35}]}]}`
+	mustInvokeAs(t, stub, cc, testAdmin, "write", openTradesStr, legacy)
+	mustInvokeAs(t, stub, cc, testAdmin, "migrate_trades")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35")
+	id := tradeID(t, stub, 2)
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		t.Errorf("new trades should not use a numeric id, got %s", id)
+	}
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "remove_trade", "1475000000001")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", "1475000000000", "alice", "a1", "bob", "blue", "16")
+	if storedMarble(t, stub, "a1").User != "bob" {
+		t.Error("legacy trade should have been performed")
+	}
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 1 || trades[0].ID != id {
+		t.Fatalf("only the new trade should be left, trades = %+v", trades)
+	}
+
+	//a new trade is not found by its timestamp
+	stub.as("bob")
+	err := mustFail(t, stub, cc, "remove_trade", strconv.FormatInt(trades[0].Timestamp, 10))
+	mustFailWith(t, err, errs.NotFound, -1)
+	if len(getOpenTrades(t, stub)) != 1 {
+		t.Error("new trades should only be removed by id")
+	}
+	mustInvoke(t, stub, cc, "remove_trade", id)
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("trade should be removed by id")
+	}
+}
+
+func TestPerformTradeIsAtomic(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	//the second transfer fails after the first one was written
+	stub.failPut["b1"] = true
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	if storedMarble(t, stub, "a1").User != "alice" || storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("a failed trade should not move any marble")
+	}
+	if len(getOpenTrades(t, stub)) != 1 {
+		t.Error("a failed trade should stay open")
+	}
+	delete(stub.failPut, "b1")
+
+	//closing the trade fails after both transfers were written
+	stub.failPut[tradeKeyOf(t, id)] = true
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "blue", "16")
+	if storedMarble(t, stub, "a1").User != "alice" || storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("a failed trade should not move any marble")
+	}
+	delete(stub.failPut, tradeKeyOf(t, id))
+
+	mustInvoke(t, stub, cc, "perform_trade", id, "alice", "a1", "bob", "BLUE", "16")
+	if storedMarble(t, stub, "a1").User != "bob" || storedMarble(t, stub, "b1").User != "alice" {
+		t.Error("trade should have gone through")
+	}
+}
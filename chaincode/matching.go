@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+var maxRingSize = 6      //longest chain of trades match_trades will look for
+var maxMatchTrades = 100 //most open trades one match_trades or preview_matches looks at, the oldest ones
+var maxRingSteps = 10000 //most partial rings one call tries before it settles for the rings found so far
+
+type RingLeg struct {
+	TradeID string `json:"trade_id"` //trade whose want this leg fills
+	Marble  string `json:"marble"`   //marble that moves
+	From    string `json:"from"`     //opener of the trade that gives the marble up
+	To      string `json:"to"`       //opener of the trade that wanted it
+}
+
+type TradeRing struct {
+	Trades []string  `json:"trades"` //ids of the trades closed by this ring
+	Legs   []RingLeg `json:"legs"`
+}
+
+// ============================================================================================================================
+// Match Trades - close every ring of open trades where each opener gets their want from the next one, operator only
+// ============================================================================================================================
+func (t *SimpleChaincode) match_trades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := t.authorizeRole(stub, roles.Operator, "match trades")
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+	trades, err := getAllTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+	rings, err := findTradeRings(stub, trades, now)
+	if err != nil {
+		return nil, err
+	}
+
+	closed := 0
+	for _, ring := range rings { //every opener already agreed to these swaps when they opened their trade
+		for _, id := range ring.Trades {
+			closed++
+			for i := range trades.OpenTrades {
+				if trades.OpenTrades[i].hasID(id) {
+					err = releaseEscrow(stub, trades.OpenTrades[i])
+					if err != nil {
+						return nil, err
+					}
+					err = deleteTrade(stub, trades.OpenTrades[i])
+					if err != nil {
+						return nil, err
+					}
+					emit(stub, tradeRemoved(trades.OpenTrades[i], events.RemovedMatch))
+				}
+			}
+		}
+		for _, leg := range ring.Legs {
+			err = transferMarble(stub, leg.Marble, leg.To, reasonTrade, leg.TradeID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	logFor(stub).Info("trades matched", "rings", strconv.Itoa(len(rings)), "trades", strconv.Itoa(closed))
+	return json.Marshal(rings)
+}
+
+// ============================================================================================================================
+// Preview Matches (query) - the rings match_trades would close right now, nothing is changed, operator only
+// ============================================================================================================================
+func (t *SimpleChaincode) preview_matches(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := t.authorizeRole(stub, roles.Operator, "preview matches")
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTimestamp(stub)
+	if err != nil { //without a timestamp we can't tell what expired, assume nothing did
+		now = 0
+	}
+	trades, err := getAllTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+	rings, err := findTradeRings(stub, trades, now)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rings)
+}
+
+// ============================================================================================================================
+// Find Trade Rings - greedily pick rings of trades in the order they were opened
+//
+// Trade i can be filled by trade j when j's opener offers i's want and still has such a marble.
+// A ring is a cycle of these, every opener in it is a different user and gives exactly one marble.
+// Once a trade or marble is used by a ring it is not considered again, expired trades are never considered.
+// Only the oldest maxMatchTrades trades are looked at and the search gives up after maxRingSteps partial rings,
+// whatever is left over is matched by a later call.
+// ============================================================================================================================
+func findTradeRings(stub shim.ChaincodeStubInterface, trades AllTrades, now int64) ([]TradeRing, error) {
+	open := []AnOpenTrade{}
+	for _, trade := range trades.OpenTrades {
+		if len(open) == maxMatchTrades {
+			break
+		}
+		if !trade.isExpired(now) {
+			open = append(open, trade)
+		}
+	}
+	graph, err := ringGraph(stub, open)
+	if err != nil {
+		return nil, err
+	}
+
+	search := ringSearch{open: open, graph: graph, used: make([]bool, len(open)), reserved: map[string]bool{}, steps: maxRingSteps}
+	rings := []TradeRing{}
+	for start := range open {
+		if search.steps <= 0 {
+			break
+		}
+		if search.used[start] {
+			continue
+		}
+		path, marbles := search.extend(start, []int{start}, []string{})
+		if path == nil {
+			continue
+		}
+
+		ring := TradeRing{}
+		for k, i := range path {
+			giver := path[(k+1)%len(path)]
+			search.used[i] = true
+			search.reserved[marbles[k]] = true
+			ring.Trades = append(ring.Trades, open[i].tradeID())
+			ring.Legs = append(ring.Legs, RingLeg{TradeID: open[i].tradeID(), Marble: marbles[k], From: open[giver].User, To: open[i].User})
+		}
+		rings = append(rings, ring)
+	}
+	return rings, nil
+}
+
+// ringEdge says trade to can fill a trade's want with one of these marbles of its opener
+type ringEdge struct {
+	to      int
+	marbles []string
+}
+
+// ============================================================================================================================
+// Ring Graph - for every trade, the trades that could fill its want, the only state reads of the ring search
+//
+// The marbles of each opener are read once. Bundles only settle pairwise through perform_trade, rings move one
+// marble per leg, so trades wanting or offering more than one marble have no edges.
+// ============================================================================================================================
+func ringGraph(stub shim.ChaincodeStubInterface, open []AnOpenTrade) ([][]ringEdge, error) {
+	owned := map[string][]Marble{} //unlocked marbles of each opener
+	offers := make([][]Marble, len(open))
+	for j, trade := range open {
+		if len(trade.Escrow) > 0 { //an escrow trade gives only what it locked
+			offers[j] = giveableMarbles(stub, trade.User, trade.Escrow, trade.ID)
+			continue
+		}
+		user := normalizeUserID(trade.User)
+		if _, ok := owned[user]; !ok {
+			names, err := marbleNamesByOwner(stub, user)
+			if err != nil {
+				return nil, errs.New(errs.Internal, "Failed to get owner index")
+			}
+			owned[user] = giveableMarbles(stub, user, names, "")
+		}
+		offers[j] = owned[user]
+	}
+
+	graph := make([][]ringEdge, len(open))
+	for i := range open {
+		want := open[i].Want
+		if want.count() != 1 {
+			continue
+		}
+		for j := range open {
+			if normalizeUserID(open[i].User) == normalizeUserID(open[j].User) {
+				continue
+			}
+			option, ok := open[j].willingOption(want.Color, want.Size)
+			if !ok || option.count() != 1 {
+				continue
+			}
+			edge := ringEdge{to: j}
+			for _, marble := range offers[j] {
+				if strings.EqualFold(marble.Color, want.Color) && marble.Size == want.Size {
+					edge.marbles = append(edge.marbles, marble.Name)
+				}
+			}
+			if len(edge.marbles) > 0 {
+				graph[i] = append(graph[i], edge)
+			}
+		}
+	}
+	return graph, nil
+}
+
+// giveableMarbles reads the named marbles the user still owns and that are locked by lockedBy, "" for unlocked ones
+func giveableMarbles(stub shim.ChaincodeStubInterface, user string, names []string, lockedBy string) []Marble {
+	marbles := []Marble{}
+	for _, name := range names {
+		marble, err := getMarble(stub, name)
+		if err != nil { //gone or stale, can't be traded
+			continue
+		}
+		if marble.LockedBy == lockedBy && normalizeUserID(marble.User) == normalizeUserID(user) {
+			marbles = append(marbles, marble)
+		}
+	}
+	return marbles
+}
+
+// ringSearch is the state of one findTradeRings, trades and marbles taken by a ring so far and the steps left
+type ringSearch struct {
+	open     []AnOpenTrade
+	graph    [][]ringEdge
+	used     []bool
+	reserved map[string]bool
+	steps    int
+}
+
+// supplier is the marble the edge's trade would hand over, "" if the trade or all its fitting marbles are taken
+func (s *ringSearch) supplier(edge ringEdge) string {
+	if s.used[edge.to] {
+		return ""
+	}
+	for _, name := range edge.marbles {
+		if !s.reserved[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// extend grows path depth first until the last trade can be filled by the first one.
+// marbles[k] is the marble that fills path[k], it comes from path[k+1].
+func (s *ringSearch) extend(start int, path []int, marbles []string) ([]int, []string) {
+	if s.steps <= 0 {
+		return nil, nil
+	}
+	s.steps--
+	last := path[len(path)-1]
+	if len(path) > 1 { //try to close the ring first, shorter rings are preferred
+		for _, edge := range s.graph[last] {
+			if edge.to != start {
+				continue
+			}
+			if marble := s.supplier(edge); marble != "" {
+				return path, append(marbles, marble)
+			}
+		}
+	}
+	if len(path) >= maxRingSize {
+		return nil, nil
+	}
+
+	for _, edge := range s.graph[last] {
+		if edge.to == start || inRing(s.open, path, s.open[edge.to].User) {
+			continue
+		}
+		marble := s.supplier(edge)
+		if marble == "" {
+			continue
+		}
+		found, foundMarbles := s.extend(start, append(path[:len(path):len(path)], edge.to), append(marbles[:len(marbles):len(marbles)], marble))
+		if found != nil {
+			return found, foundMarbles
+		}
+	}
+	return nil, nil
+}
+
+// inRing tells if a user already opened one of the trades on the path
+func inRing(open []AnOpenTrade, path []int, user string) bool {
+	for _, i := range path {
+		if normalizeUserID(open[i].User) == normalizeUserID(user) {
+			return true
+		}
+	}
+	return false
+}
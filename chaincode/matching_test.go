@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// queryMatches runs preview_matches as the admin, the stub's caller is back to the previous one afterwards
+func queryMatches(t *testing.T, stub *memStub, cc *SimpleChaincode) []TradeRing {
+	t.Helper()
+	caller := stub.caller
+	defer stub.as(caller)
+	stub.as(testAdmin)
+	res, err := stub.query(cc, "preview_matches")
+	if err != nil {
+		t.Fatalf("preview_matches failed: %s", err)
+	}
+	var rings []TradeRing
+	if err := json.Unmarshal(res, &rings); err != nil {
+		t.Fatalf("preview_matches returned %s: %s", res, err)
+	}
+	return rings
+}
+
+// seedRing gives alice, bob and carol one marble each and has each of them want the next one's marble
+func seedRing(t *testing.T, cc *SimpleChaincode, stub *memStub) []string {
+	t.Helper()
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "c1", "red", "35", "carol")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "red", "35", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "carol", "green", "16", "red", "35")
+	return []string{tradeID(t, stub, 0), tradeID(t, stub, 1), tradeID(t, stub, 2)}
+}
+
+func TestMatchTradesRing(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	ids := seedRing(t, cc, stub)
+
+	want := []TradeRing{{
+		Trades: ids,
+		Legs: []RingLeg{
+			{TradeID: ids[0], Marble: "b1", From: "bob", To: "alice"},
+			{TradeID: ids[1], Marble: "c1", From: "carol", To: "bob"},
+			{TradeID: ids[2], Marble: "a1", From: "alice", To: "carol"},
+		},
+	}}
+	if got := queryMatches(t, stub, cc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("preview = %+v, want %+v", got, want)
+	}
+	if len(getOpenTrades(t, stub)) != 3 || storedMarble(t, stub, "b1").User != "bob" {
+		t.Fatal("preview should not change anything")
+	}
+
+	res := mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+	var settled []TradeRing
+	if err := json.Unmarshal(res, &settled); err != nil || !reflect.DeepEqual(settled, want) {
+		t.Errorf("match_trades returned %s, want %+v", res, want)
+	}
+	for name, owner := range map[string]string{"a1": "carol", "b1": "alice", "c1": "bob"} {
+		if got := storedMarble(t, stub, name).User; got != owner {
+			t.Errorf("%s owned by %s, want %s", name, got, owner)
+		}
+	}
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Errorf("all trades should be closed, got %+v", getOpenTrades(t, stub))
+	}
+	if h := queryHistory(t, stub, cc, "b1"); h[len(h)-1].TradeID != ids[0] || h[len(h)-1].Reason != reasonTrade {
+		t.Errorf("b1 history = %+v", h)
+	}
+
+	//nothing left to match
+	if got := queryMatches(t, stub, cc); len(got) != 0 {
+		t.Errorf("preview = %+v, want none", got)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+}
+
+func TestMatchTradesNoRing(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+
+	//bob wants alice's green but alice only wants her own kind of marble
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "red", "35", "green", "16")
+	//alice wants a blue but only offers a blue back, which bob doesn't want
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "blue", "16")
+
+	if got := queryMatches(t, stub, cc); len(got) != 0 {
+		t.Errorf("preview = %+v, want none", got)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+	if len(getOpenTrades(t, stub)) != 3 {
+		t.Error("no trade should be closed")
+	}
+}
+
+func TestMatchTradesPairAndReservations(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+
+	//two trades from bob both want alice's only green, it can only go once
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+	ids := []string{tradeID(t, stub, 0), tradeID(t, stub, 1), tradeID(t, stub, 2)}
+
+	rings := queryMatches(t, stub, cc)
+	if len(rings) != 1 || !reflect.DeepEqual(rings[0].Trades, []string{ids[0], ids[2]}) {
+		t.Fatalf("preview = %+v", rings)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+	if storedMarble(t, stub, "a1").User != "bob" || storedMarble(t, stub, "b1").User != "alice" {
+		t.Error("a1 and b1 should have swapped")
+	}
+	//bob's second trade now has nothing to give and is cleaned out
+	if got := getOpenTrades(t, stub); len(got) != 0 {
+		t.Errorf("open trades = %+v", got)
+	}
+}
+
+func TestMatchTradesEscrow(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "b2", "blue", "16", "bob")
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "escrow", "b2")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+
+	rings := queryMatches(t, stub, cc)
+	if len(rings) != 1 || rings[0].Legs[1].Marble != "b2" {
+		t.Fatalf("escrowed b2 should settle the ring, got %+v", rings)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "match_trades")
+	if m := storedMarble(t, stub, "b2"); m.User != "alice" || m.LockedBy != "" {
+		t.Errorf("b2 = %+v", m)
+	}
+	if storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("b1 was not escrowed and should stay with bob")
+	}
+}
+
+func TestMatchTradesFailsAtomically(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedRing(t, cc, stub)
+	stub.as(testAdmin)
+
+	stub.failPut["c1"] = true
+	mustFail(t, stub, cc, "match_trades")
+	delete(stub.failPut, "c1")
+	if storedMarble(t, stub, "b1").User != "bob" || len(getOpenTrades(t, stub)) != 3 {
+		t.Error("a failed match should leave marbles and trades untouched")
+	}
+
+	stub.failGet[tradeKeyOf(t, tradeID(t, stub, 0))] = true
+	mustFail(t, stub, cc, "match_trades")
+	if _, err := stub.query(cc, "preview_matches"); err == nil {
+		t.Error("preview_matches should surface GetState failures")
+	}
+}
+
+func TestMatchTradesTakesAnOperator(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedRing(t, cc, stub)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "match_trades")
+	if _, err := stub.query(cc, "preview_matches"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("preview_matches by alice = %v", err)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "alice", "operator")
+	mustInvoke(t, stub, cc, "match_trades")
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("an operator should be able to match trades")
+	}
+}
+
+func TestMatchTradesIsBounded(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedRing(t, cc, stub)
+	seedRing2 := func() { //a second ring between the same users, opened after the first
+		mustInvoke(t, stub, cc, "init_marble", "a2", "green", "16", "alice")
+		mustInvoke(t, stub, cc, "init_marble", "b2", "blue", "16", "bob")
+		mustInvoke(t, stub, cc, "init_marble", "c2", "red", "35", "carol")
+		mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+		mustInvoke(t, stub, cc, "open_trade", "bob", "red", "35", "blue", "16")
+		mustInvoke(t, stub, cc, "open_trade", "carol", "green", "16", "red", "35")
+	}
+	seedRing2()
+
+	defer func(trades, steps int) { maxMatchTrades, maxRingSteps = trades, steps }(maxMatchTrades, maxRingSteps)
+	maxMatchTrades = 3 //only the first ring is looked at
+	if rings := queryMatches(t, stub, cc); len(rings) != 1 {
+		t.Errorf("with 3 trades looked at, preview = %+v", rings)
+	}
+	maxMatchTrades = 100
+	maxRingSteps = 3 //enough for the first ring only
+	if rings := queryMatches(t, stub, cc); len(rings) != 1 {
+		t.Errorf("with 3 steps, preview = %+v", rings)
+	}
+	maxRingSteps = 10000
+	if rings := queryMatches(t, stub, cc); len(rings) != 2 {
+		t.Errorf("preview = %+v, want both rings", rings)
+	}
+
+}
+
+// chainReads opens copies copies of a chain of trades that never closes into a ring and counts the state reads
+// of a preview_matches, alice wants bob's blue, bob carol's red, carol dave's yellow and dave a purple nobody has
+func chainReads(t *testing.T, copies int) int {
+	t.Helper()
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "a1", "green", "16", "alice")
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+	mustInvoke(t, stub, cc, "init_marble", "c1", "red", "16", "carol")
+	mustInvoke(t, stub, cc, "init_marble", "d1", "yellow", "16", "dave")
+	for i := 0; i < copies; i++ {
+		mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+		mustInvoke(t, stub, cc, "open_trade", "bob", "red", "16", "blue", "16")
+		mustInvoke(t, stub, cc, "open_trade", "carol", "yellow", "16", "red", "16")
+		mustInvoke(t, stub, cc, "open_trade", "dave", "purple", "16", "yellow", "16")
+	}
+	before := stub.reads
+	if rings := queryMatches(t, stub, cc); len(rings) != 0 {
+		t.Fatalf("preview = %+v, want none", rings)
+	}
+	return stub.reads - before
+}
+
+func TestMatchTradesReadsEachOpenerOnce(t *testing.T) {
+	//copies^3 paths lead nowhere, the reads should only grow with the trades themselves
+	one, five := chainReads(t, 1), chainReads(t, 5)
+	if perTrade := (five - one) / 16; perTrade > 2 {
+		t.Errorf("preview_matches read the state %d times for 4 trades and %d for 20", one, five)
+	}
+}
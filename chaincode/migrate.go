@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+)
+
+var migrationStr = "_migration" //name for the key/value that stores how far migrate_state got
+
+// schema versions of the stored records, a struct that changes shape gets a migration registered here
+var marbleSchema = schema.NewRegistry("marble").
+	Register(0, schema.Initial)
+var tradeSchema = schema.NewRegistry("trade").
+	Register(0, tradeIDFromTimestamp)
+
+// tradeIDFromTimestamp gives trades from before ids the id clients know them by, their timestamp
+func tradeIDFromTimestamp(r schema.Record) error {
+	var id string
+	var timestamp int64
+	err := r.Get("id", &id)
+	if err != nil || id != "" {
+		return err
+	}
+	err = r.Get("timestamp", &timestamp)
+	if err != nil {
+		return err
+	}
+	return r.Set("id", strconv.FormatInt(timestamp, 10))
+}
+
+// migrationStages upgrades the marbles in name order, then the open trades in id order
+var migrationStages = []schema.Stage{
+	{Kind: "marble", Keys: marblesAfter, Upgrade: upgradeMarble},
+	{Kind: "trade", Keys: tradesAfter, Upgrade: upgradeTrade},
+}
+
+func marblesAfter(stub shim.ChaincodeStubInterface, after string, limit int) ([]string, error) {
+	return idsAfter(stub, marbleNameIndexStr, after, limit)
+}
+
+func tradesAfter(stub shim.ChaincodeStubInterface, after string, limit int) ([]string, error) {
+	return idsAfter(stub, tradeStr, after, limit)
+}
+
+// upgradeRecord rewrites the record under key at the current version of its registry, records that can't be
+// upgraded are logged and left alone so one bad record doesn't hold up the rest
+func upgradeRecord(stub shim.ChaincodeStubInterface, registry *schema.Registry, key string, label string) (bool, error) {
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errs.New(errs.Internal, "Failed to get "+registry.Kind()+" "+label)
+	}
+	if recordAsBytes == nil { //stale index entry
+		return false, nil
+	}
+	upgraded, changed, err := registry.Upgrade(recordAsBytes)
+	if err != nil {
+		logFor(stub).Warning("skipping a record that can't be upgraded", registry.Kind(), label, "error", errs.From(err).Message)
+		return false, nil
+	}
+	if !changed {
+		return false, nil
+	}
+	err = stub.PutState(key, upgraded)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func upgradeMarble(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	return upgradeRecord(stub, marbleSchema, name, name)
+}
+
+func upgradeTrade(stub shim.ChaincodeStubInterface, id string) (bool, error) {
+	key, err := tradeKey(id)
+	if err != nil {
+		return false, err
+	}
+	return upgradeRecord(stub, tradeSchema, key, id)
+}
+
+// ============================================================================================================================
+// Migrate State - upgrade the next batch of stored records to the current schema versions, admin only
+// call it until the progress it returns is done, reads upgrade whatever it hasn't gotten to yet on the fly
+// marbles are found through the name index, ledgers from before it run reindex_marbles first
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	batch := defaultPageSize
+
+	//   0*
+	// "50"
+	if len(args) > 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting batch size")
+	}
+	if len(args) > 0 && args[0] != "" {
+		batch, err = strconv.Atoi(args[0])
+		if err != nil || batch <= 0 || batch > maxPageSize {
+			return nil, errs.Arg(0, "1st argument must be a batch size between 1 and "+strconv.Itoa(maxPageSize))
+		}
+	}
+	err = t.authorizeAdmin(stub, "migrate state")
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := schema.Run(stub, migrationStr, []*schema.Registry{marbleSchema, tradeSchema}, migrationStages, batch)
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("state migrated", "batch", strconv.Itoa(progress.Batch), "scanned", strconv.Itoa(progress.Scanned),
+		"upgraded", strconv.Itoa(progress.Upgraded), "done", strconv.FormatBool(progress.Done))
+	return json.Marshal(progress)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+)
+
+// seedLegacyState stores records the way chaincode versions before schema versions did
+func seedLegacyState(t *testing.T, stub *memStub) {
+	t.Helper()
+	names := []string{}
+	for _, m := range []Marble{
+		{Name: "l1", Color: "blue", Size: 16, User: "bob"},
+		{Name: "l2", Color: "red", Size: 35, User: "bob"},
+		{Name: "l3", Color: "green", Size: 16, User: "alice"},
+	} {
+		stub.state[m.Name] = []byte(`{"name":"` + m.Name + `","color":"` + m.Color + `","size":` + strconv.Itoa(m.Size) + `,"user":"` + m.User + `"}`)
+		names = append(names, m.Name)
+	}
+	index, _ := json.Marshal(names)
+	stub.state[marbleIndexStr] = index
+	stub.state[tradeKeyOf(t, "1475000000000")] = []byte(`{"user":"bob","timestamp":1475000000000,"want":{"color":"green","size":16},"willing":[{"color":"blue","size":16}]}`)
+}
+
+func storedVersion(t *testing.T, stub *memStub, key string) int {
+	t.Helper()
+	version, err := schema.VersionOf(stub.state[key])
+	if err != nil {
+		t.Fatalf("%q holds %s: %s", key, stub.state[key], err)
+	}
+	return version
+}
+
+func TestLegacyRecordsAreReadUpgraded(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedLegacyState(t, stub)
+
+	for _, function := range []string{"get_marble", "read"} {
+		res, err := stub.query(cc, function, "l1")
+		if err != nil {
+			t.Fatalf("%s failed: %s", function, err)
+		}
+		var m Marble
+		json.Unmarshal(res, &m)
+		if m.Name != "l1" || m.Schema != marbleSchema.Current() {
+			t.Errorf("%s of a legacy marble = %s", function, res)
+		}
+	}
+	if storedVersion(t, stub, "l1") != 0 {
+		t.Error("queries should not rewrite records")
+	}
+
+	//the legacy trade is known by its timestamp
+	res, err := stub.query(cc, "list_open_trades")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page TradePage
+	json.Unmarshal(res, &page)
+	if len(page.Trades) != 1 || page.Trades[0].ID != "1475000000000" || page.Trades[0].Schema != tradeSchema.Current() {
+		t.Fatalf("list_open_trades = %s", res)
+	}
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "remove_trade", "1475000000000")
+	if len(getOpenTrades(t, stub)) != 0 {
+		t.Error("the legacy trade should be removable by its timestamp")
+	}
+
+	//records written by a chaincode newer than this one are refused
+	stub.state["l2"] = []byte(`{"name":"l2","color":"red","size":35,"user":"bob","schema":99}`)
+	if _, err := stub.query(cc, "get_marble", "l2"); err == nil || !strings.Contains(err.Error(), "unknown schema version") {
+		t.Errorf("get_marble of a newer record should fail, got %v", err)
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedLegacyState(t, stub)
+	mustInvokeAs(t, stub, cc, testAdmin, "reindex_marbles") //the ledger predates the name index
+	stub.failGet[marbleIndexStr] = true                     //batches page over the name index, never the list of all marbles
+	stub.as("bob")
+	mustBeUnauthorized(t, stub, cc, "migrate_state")
+	stub.as(testAdmin)
+	for _, args := range [][]string{{"0"}, {"x"}, {"201"}, {"1", "2"}} {
+		mustFail(t, stub, cc, "migrate_state", args...)
+	}
+
+	var progress schema.Progress
+	for i := 0; i < 10 && !progress.Done; i++ {
+		res := mustInvoke(t, stub, cc, "migrate_state", "2")
+		if err := json.Unmarshal(res, &progress); err != nil {
+			t.Fatalf("migrate_state returned %s: %s", res, err)
+		}
+		if progress.Batch > 2 {
+			t.Fatalf("batch of %d records, asked for 2", progress.Batch)
+		}
+	}
+	if !progress.Done || progress.Scanned != 4 || progress.Upgraded != 4 {
+		t.Fatalf("progress = %+v", progress)
+	}
+	if progress.Versions["marble"] != marbleSchema.Current() || progress.Versions["trade"] != tradeSchema.Current() {
+		t.Errorf("progress versions = %v", progress.Versions)
+	}
+	for _, name := range []string{"l1", "l2", "l3"} {
+		if storedVersion(t, stub, name) != marbleSchema.Current() {
+			t.Errorf("marble %s was not upgraded: %s", name, stub.state[name])
+		}
+	}
+	key := tradeKeyOf(t, "1475000000000")
+	if storedVersion(t, stub, key) != tradeSchema.Current() || !strings.Contains(string(stub.state[key]), `"id":"1475000000000"`) {
+		t.Errorf("trade was not upgraded: %s", stub.state[key])
+	}
+
+	//once done there is nothing more to do
+	res := mustInvoke(t, stub, cc, "migrate_state")
+	json.Unmarshal(res, &progress)
+	if !progress.Done || progress.Batch != 0 {
+		t.Errorf("progress after the migration = %+v", progress)
+	}
+}
+
+func TestMigrateStateSkipsBadRecords(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedLegacyState(t, stub)
+	stub.as(testAdmin)
+	mustInvoke(t, stub, cc, "reindex_marbles")
+	stub.state["l2"] = []byte(`{"name":"l2","schema":99}`)
+
+	logs := captureLog(t)
+	res := mustInvoke(t, stub, cc, "migrate_state")
+	var progress schema.Progress
+	json.Unmarshal(res, &progress)
+	if !progress.Done || progress.Upgraded != 3 {
+		t.Errorf("progress = %+v", progress)
+	}
+	if !strings.Contains(logs.String(), "skipping a record that can't be upgraded") || !strings.Contains(logs.String(), "marble=l2") {
+		t.Errorf("the bad record should be logged, got %s", logs)
+	}
+
+	stub.failGet["l3"] = true
+	delete(stub.state, migrationStr) //start over
+	mustFail(t, stub, cc, "migrate_state")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+)
+
+var defaultPageSize = 20 //page size of list_marbles when none is given
+var maxPageSize = 200    //largest page list_marbles will return
+
+type MarblePage struct {
+	Marbles  []Marble `json:"marbles"`  //marbles in this page, ordered by name
+	Bookmark string   `json:"bookmark"` //pass back to get the next page, empty when there are no more
+}
+
+// ============================================================================================================================
+// Get Marble - read a marble from chaincode state and make sure it is one
+// ============================================================================================================================
+func getMarble(stub shim.ChaincodeStubInterface, name string) (Marble, error) {
+	marbleAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return Marble{}, errs.New(errs.Internal, "Failed to get marble "+name)
+	}
+	return parseMarble(name, marbleAsBytes)
+}
+
+// parseMarble un stringifies the value stored under name and checks it is a complete marble
+func parseMarble(name string, marbleAsBytes []byte) (Marble, error) {
+	var res Marble
+	if marbleAsBytes == nil {
+		return res, errs.New(errs.NotFound, "Marble does not exist: "+name)
+	}
+	if _, err := schema.VersionOf(marbleAsBytes); err != nil { //not even a json object
+		return res, errs.New(errs.NotFound, "Not a marble: "+name)
+	}
+	marbleAsBytes, _, err := marbleSchema.Upgrade(marbleAsBytes) //records of older versions are read as the current one
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(marbleAsBytes, &res)
+	if err != nil {
+		return res, errs.New(errs.NotFound, "Not a marble: "+name)
+	}
+	if res.Name != name || res.Color == "" || res.User == "" || res.Size <= 0 {
+		return res, errs.New(errs.NotFound, "Not a valid marble: "+name)
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// Get Marbles - read a list of marbles, skipping names that are no longer marbles
+// ============================================================================================================================
+func getMarbles(stub shim.ChaincodeStubInterface, names []string) ([]Marble, error) {
+	marbles := []Marble{}
+	for _, name := range names {
+		marbleAsBytes, err := stub.GetState(name)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get marble "+name)
+		}
+		marble, err := parseMarble(name, marbleAsBytes)
+		if err != nil { //stale index entry, leave it out
+			logFor(stub).Warning("skipping stale index entry", "marble", name, "error", errs.From(err).Message)
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+	return marbles, nil
+}
+
+// filterMarbles keeps the marbles that match the optional color ("" for any) and size (0 for any)
+func filterMarbles(marbles []Marble, color string, size int) []Marble {
+	filtered := []Marble{}
+	for _, m := range marbles {
+		if color != "" && strings.ToLower(m.Color) != strings.ToLower(color) {
+			continue
+		}
+		if size != 0 && m.Size != size {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// ============================================================================================================================
+// Get Marble (query) - return a single validated marble
+// ============================================================================================================================
+func (t *SimpleChaincode) get_marble(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "name"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting name of the marble")
+	}
+
+	marble, err := getMarble(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(marble)
+}
+
+// ============================================================================================================================
+// List Marbles - return a page of marbles ordered by name, starting after the bookmark
+// ============================================================================================================================
+func (t *SimpleChaincode) list_marbles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	pageSize := defaultPageSize
+	bookmark := ""
+
+	//   0*      1*
+	// "20", "bookmark"
+	if len(args) > 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting page size and bookmark")
+	}
+	if len(args) > 0 && args[0] != "" {
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			return nil, errs.Arg(0, "1st argument must be a page size between 1 and "+strconv.Itoa(maxPageSize))
+		}
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	//read the name index from the bookmark on, a page never loads more names than it shows
+	page := MarblePage{Marbles: []Marble{}}
+	after := bookmark
+	for len(page.Marbles) < pageSize {
+		room := pageSize - len(page.Marbles)
+		names, err := marblesAfter(stub, after, room)
+		if err != nil && errs.CodeOf(err) == errs.InvalidArgument { //a bookmark no marble can have
+			return nil, errs.WithArg(err, 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			after = name
+			marbleAsBytes, err := stub.GetState(name)
+			if err != nil {
+				return nil, errs.New(errs.Internal, "Failed to get marble "+name)
+			}
+			marble, err := parseMarble(name, marbleAsBytes)
+			if err != nil {
+				logFor(stub).Warning("skipping stale index entry", "marble", name, "error", errs.From(err).Message)
+				continue
+			}
+			page.Marbles = append(page.Marbles, marble)
+		}
+		if len(names) < room { //no more marbles
+			break
+		}
+	}
+	if len(page.Marbles) == pageSize {
+		more, err := marblesAfter(stub, after, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(more) > 0 {
+			page.Bookmark = after //more to come
+		}
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// Marbles By Owner - return every marble a user owns, optionally only of a color and/or size
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_owner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	color := ""
+	size := 0
+
+	//   0       1*      2*
+	// "bob", "blue", "16"
+	if len(args) < 1 || len(args) > 3 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user and optional color and size")
+	}
+	if len(args[0]) <= 0 {
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
+	}
+	if len(args) > 1 {
+		color = args[1]
+	}
+	if len(args) > 2 && args[2] != "" {
+		size, err = strconv.Atoi(args[2])
+		if err != nil {
+			return nil, errs.Arg(2, "3rd argument must be a numeric string")
+		}
+	}
+
+	names, err := marbleNamesByOwner(stub, args[0])
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get owner index")
+	}
+	marbles, err := getMarbles(stub, names)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(filterMarbles(marbles, color, size))
+}
+
+// ============================================================================================================================
+// Marbles By Color Size - return every marble of a color and size, optionally only those of one owner
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_color_size(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1      2*
+	// "blue", "16", "bob"
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting color, size and optional user")
+	}
+	if len(args[0]) <= 0 {
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errs.Arg(1, "2nd argument must be a numeric string")
+	}
+
+	names, err := marbleNamesByColorSize(stub, args[0], size)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get color/size index")
+	}
+	marbles, err := getMarbles(stub, names)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) > 2 && args[2] != "" { //only this owner's
+		owned := []Marble{}
+		for _, m := range marbles {
+			if strings.ToLower(m.User) == strings.ToLower(args[2]) {
+				owned = append(owned, m)
+			}
+		}
+		marbles = owned
+	}
+	return json.Marshal(marbles)
+}
+
+// marbleNames lists the names of the marbles in order
+func marbleNames(marbles []Marble) []string {
+	names := []string{}
+	for _, m := range marbles {
+		names = append(names, m.Name)
+	}
+	return names
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func queryMarbles(t *testing.T, stub *memStub, cc *SimpleChaincode, function string, args ...string) []string {
+	t.Helper()
+	res, err := stub.query(cc, function, args...)
+	if err != nil {
+		t.Fatalf("%s%v failed: %s", function, args, err)
+	}
+	var marbles []Marble
+	if err := json.Unmarshal(res, &marbles); err != nil {
+		t.Fatalf("%s%v returned %s: %s", function, args, res, err)
+	}
+	return marbleNames(marbles)
+}
+
+func TestGetMarble(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	res, err := stub.query(cc, "get_marble", "b2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Marble
+	json.Unmarshal(res, &m)
+	if m != (Marble{Name: "b2", Color: "red", Size: 35, User: "bob", Schema: marbleSchema.Current()}) {
+		t.Errorf("get_marble b2 = %s", res)
+	}
+
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "junk", `{"name":"junk"}`)
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "text", `hello`)
+	for _, args := range [][]string{{}, {"b1", "b2"}, {"missing"}, {"junk"}, {"text"}} {
+		if _, err := stub.query(cc, "get_marble", args...); err == nil {
+			t.Errorf("get_marble%v should fail", args)
+		}
+	}
+	stub.failGet["b1"] = true
+	if _, err := stub.query(cc, "get_marble", "b1"); err == nil {
+		t.Error("get_marble should surface GetState failures")
+	}
+}
+
+func TestListMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	for _, name := range []string{"e", "c", "a", "d", "b"} {
+		mustInvoke(t, stub, cc, "init_marble", name, "blue", "16", "bob")
+	}
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "delete", "d")
+
+	var seen []string
+	bookmark := ""
+	for pages := 0; pages < 10; pages++ {
+		res, err := stub.query(cc, "list_marbles", "2", bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page MarblePage
+		if err := json.Unmarshal(res, &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Marbles) > 2 {
+			t.Fatalf("page is too big: %s", res)
+		}
+		seen = append(seen, marbleNames(page.Marbles)...)
+		bookmark = page.Bookmark
+		if bookmark == "" {
+			break
+		}
+	}
+	if len(seen) != 4 || seen[0] != "a" || seen[1] != "b" || seen[2] != "c" || seen[3] != "e" {
+		t.Errorf("pages returned %v, want [a b c e]", seen)
+	}
+
+	res, err := stub.query(cc, "list_marbles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page MarblePage
+	json.Unmarshal(res, &page)
+	if len(page.Marbles) != 4 || page.Bookmark != "" {
+		t.Errorf("default page = %s", res)
+	}
+
+	for _, args := range [][]string{{"0"}, {"x"}, {"100000"}, {"1", "a", "b"}} {
+		if _, err := stub.query(cc, "list_marbles", args...); err == nil {
+			t.Errorf("list_marbles%v should fail", args)
+		}
+	}
+	stub.failGet[marbleIndexStr] = true //pages range over the name index, the list of all marbles is never loaded
+	if _, err := stub.query(cc, "list_marbles", "2", "b"); err != nil {
+		t.Errorf("list_marbles should not read the marble index: %v", err)
+	}
+	nameKey, _ := createCompositeKey(marbleNameIndexStr, []string{"c"})
+	stub.failGet[nameKey] = true
+	if _, err := stub.query(cc, "list_marbles"); err == nil {
+		t.Error("list_marbles should surface index failures")
+	}
+}
+
+func TestMarblesByOwner(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "b3", "blue", "35", "bob")
+
+	if got := queryMarbles(t, stub, cc, "marbles_by_owner", "BOB"); len(got) != 3 {
+		t.Errorf("bob owns %v", got)
+	}
+	if got := queryMarbles(t, stub, cc, "marbles_by_owner", "bob", "blue"); len(got) != 2 || got[0] != "b1" || got[1] != "b3" {
+		t.Errorf("bob's blues = %v", got)
+	}
+	if got := queryMarbles(t, stub, cc, "marbles_by_owner", "bob", "", "35"); len(got) != 2 || got[0] != "b2" || got[1] != "b3" {
+		t.Errorf("bob's 35s = %v", got)
+	}
+	if got := queryMarbles(t, stub, cc, "marbles_by_owner", "nobody"); len(got) != 0 {
+		t.Errorf("nobody owns %v", got)
+	}
+
+	for _, args := range [][]string{{}, {""}, {"bob", "blue", "x"}, {"bob", "blue", "16", "x"}} {
+		if _, err := stub.query(cc, "marbles_by_owner", args...); err == nil {
+			t.Errorf("marbles_by_owner%v should fail", args)
+		}
+	}
+	stub.failGet["b1"] = true
+	if _, err := stub.query(cc, "marbles_by_owner", "bob"); err == nil {
+		t.Error("marbles_by_owner should surface GetState failures")
+	}
+}
+
+func TestMarblesByColorSize(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "init_marble", "a2", "blue", "16", "alice")
+
+	if got := queryMarbles(t, stub, cc, "marbles_by_color_size", "Blue", "16"); len(got) != 2 || got[0] != "a2" || got[1] != "b1" {
+		t.Errorf("blue 16s = %v", got)
+	}
+	if got := queryMarbles(t, stub, cc, "marbles_by_color_size", "blue", "16", "alice"); len(got) != 1 || got[0] != "a2" {
+		t.Errorf("alice's blue 16s = %v", got)
+	}
+	if got := queryMarbles(t, stub, cc, "marbles_by_color_size", "blue", "35"); len(got) != 0 {
+		t.Errorf("blue 35s = %v", got)
+	}
+
+	for _, args := range [][]string{{"blue"}, {"", "16"}, {"blue", "x"}, {"blue", "16", "bob", "x"}} {
+		if _, err := stub.query(cc, "marbles_by_color_size", args...); err == nil {
+			t.Errorf("marbles_by_color_size%v should fail", args)
+		}
+	}
+}
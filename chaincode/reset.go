@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// ============================================================================================================================
+// Reset - wipe the marbles, their trades, auctions and listings, admin only, coins held by open bids go back to the bidders
+// users, coins, roles, config and marble histories stay
+// ============================================================================================================================
+func (t *SimpleChaincode) reset(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting none")
+	}
+	err := t.authorizeAdmin(stub, "reset the ledger")
+	if err != nil {
+		return nil, err
+	}
+
+	marbleIndex, err := getMarbleIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range marbleIndex {
+		err = stub.DelState(name)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to delete marble "+name)
+		}
+	}
+
+	var empty []string
+	jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to clear the index
+	err = stub.PutState(marbleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.DelState(openTradesStr) //trades of a ledger that was never migrated
+	if err != nil {
+		return nil, err
+	}
+
+	err = refundOpenAuctions(stub) //the coins are not marbles, bidders get them back before the auctions go
+	if err != nil {
+		return nil, err
+	}
+	err = clearCompositeKeys(stub, marbleNameIndexStr, ownerNameIndexStr, colorSizeIndexStr, tradeStr, tradeOpenerIndexStr, tradeWantIndexStr, auctionStr, listingStr)
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("ledger reset", "marbles", strconv.Itoa(len(marbleIndex)))
+	return nil, nil
+}
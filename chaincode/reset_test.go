@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+func TestReset(t *testing.T) {
+	cc, stub := newCoinChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvoke(t, stub, cc, "list_for_sale", "b2", "5")
+	mustInvoke(t, stub, cc, "start_auction", "b1", "10", strconv.FormatInt(stub.txTime.Add(time.Hour).Unix()*1000, 10), "coin")
+	auction := stub.txID
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "place_bid", auction, "alice", "30")
+
+	mustBeUnauthorized(t, stub, cc, "reset")
+	mustInvokeAs(t, stub, cc, testAdmin, "reset")
+
+	for _, name := range []string{"b1", "b2", "a1"} {
+		if _, ok := stub.state[name]; ok {
+			t.Errorf("%s should be gone", name)
+		}
+	}
+	if len(storedMarbleIndex(t, stub)) != 0 || len(getOpenTrades(t, stub)) != 0 {
+		t.Error("reset should clear the marble index and open trades")
+	}
+	if got := namesByOwner(t, stub, "bob"); len(got) != 0 {
+		t.Errorf("reset should clear the owner index, got %v", got)
+	}
+	res, err := stub.query(cc, "marbles_for_sale")
+	if err != nil || string(res) != "[]" {
+		t.Errorf("marbles_for_sale after reset = %s, %v", res, err)
+	}
+
+	//what isn't about marbles stays
+	if got := balanceOf(t, stub, cc, "bob"); got != 100 {
+		t.Errorf("bob has %d coins, want 100", got)
+	}
+	if got := balanceOf(t, stub, cc, "alice"); got != 100 {
+		t.Errorf("alice has %d coins, want the bid of 30 back", got)
+	}
+	if got := roleOf(t, stub, cc, "dave"); got != roles.Admin {
+		t.Errorf("dave is %s, want admin", got)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package roles
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+)
+
+// Resolver works out which user is calling the chaincode
+type Resolver interface {
+	Caller(stub shim.ChaincodeStubInterface) (string, error)
+}
+
+// CallerMetadata takes the user name the client attached as caller metadata to the transaction. Nothing vouches for
+// the metadata, a client can send any name it likes, so it is only for tests and networks that trust every client
+// and opt into it
+type CallerMetadata struct{}
+
+func (CallerMetadata) Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil {
+		return "", errs.New(errs.Internal, "Failed to get caller metadata")
+	}
+	return string(metadata), nil
+}
+
+// CertAttribute takes the user name from an attribute of the caller's transaction certificate, the membership
+// service signed it so the caller can't make it up
+type CertAttribute struct {
+	Attribute string //name of the attribute, ie "username"
+}
+
+func (c CertAttribute) Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	value, err := stub.ReadCertAttribute(c.Attribute)
+	if err != nil { //no certificate, or one without the attribute
+		return "", errs.New(errs.Unauthorized, "Caller's certificate has no "+c.Attribute+" attribute")
+	}
+	return string(value), nil
+}
+
+// DefaultResolver is the resolver of a Guard that plugs in none
+var DefaultResolver Resolver = CertAttribute{Attribute: "username"}
+
+// NormalizeID is the canonical form of a user id, "  Bob " and "bob" are the same user
+func NormalizeID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+var silent = logging.New(ioutil.Discard, logging.Error)
+
+// Guard checks callers against the role table and leaves an audit trail of what it refuses
+type Guard struct {
+	Identity Resolver                                                  //resolves who is calling, nil is DefaultResolver
+	Load     func(shim.ChaincodeStubInterface) (Table, error)          //reads the role table, nil is Load
+	Log      func(shim.ChaincodeStubInterface) *logging.Logger         //logger of the running invocation, nil logs nothing
+	User     func(shim.ChaincodeStubInterface, string) (string, error) //vets the user grant_role is for, nil takes any id
+}
+
+func (g Guard) table(stub shim.ChaincodeStubInterface) (Table, error) {
+	if g.Load != nil {
+		return g.Load(stub)
+	}
+	return Load(stub)
+}
+
+func (g Guard) log(stub shim.ChaincodeStubInterface) *logging.Logger {
+	if g.Log != nil {
+		return g.Log(stub)
+	}
+	return silent
+}
+
+// Caller is the normalized name of the user calling the chaincode, it is an error if nobody can be resolved
+func (g Guard) Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	identity := DefaultResolver
+	if g.Identity != nil {
+		identity = g.Identity
+	}
+	caller, err := identity.Caller(stub)
+	if err != nil {
+		return "", err
+	}
+	caller = NormalizeID(caller)
+	if caller == "" {
+		return "", errs.New(errs.Unauthorized, "Unable to identify the caller of this transaction")
+	}
+	return caller, nil
+}
+
+// AuthorizeUser makes sure the caller is the given user
+func (g Guard) AuthorizeUser(stub shim.ChaincodeStubInterface, user string, action string) error {
+	caller, err := g.Caller(stub)
+	if err != nil {
+		return err
+	}
+	if caller != NormalizeID(user) {
+		g.Audit(stub, caller, action, "only "+NormalizeID(user)+" can")
+		return errs.New(errs.Unauthorized, "Unauthorized: "+caller+" cannot "+action+", only "+user+" can")
+	}
+	return nil
+}
+
+// AuthorizeUserOrRole makes sure the caller is the given user or has at least the given role
+func (g Guard) AuthorizeUserOrRole(stub shim.ChaincodeStubInterface, user string, need Role, action string) error {
+	table, err := g.table(stub)
+	if err != nil {
+		return err
+	}
+	caller, err := g.Caller(stub)
+	if err != nil {
+		g.Audit(stub, "", action, "only "+NormalizeID(user)+" or role "+string(need)+" can")
+		return errs.New(errs.Unauthorized, "Unauthorized: an anonymous caller cannot "+action)
+	}
+	if caller == NormalizeID(user) || table.Of(caller).Includes(need) {
+		return nil
+	}
+	g.Audit(stub, caller, action, "only "+NormalizeID(user)+" or role "+string(need)+" can")
+	return errs.New(errs.Unauthorized, "Unauthorized: "+caller+" cannot "+action+", only "+user+" or the "+string(need)+" role can")
+}
+
+// Authorize makes sure the caller has at least the given role, denials are logged for audit
+func (g Guard) Authorize(stub shim.ChaincodeStubInterface, need Role, action string) error {
+	table, err := g.table(stub)
+	if err != nil {
+		return err
+	}
+	caller, err := g.Caller(stub)
+	if err != nil {
+		g.Audit(stub, "", action, "need role "+string(need))
+		return errs.New(errs.Unauthorized, "Unauthorized: an anonymous caller cannot "+action)
+	}
+	have := table.Of(caller)
+	if !have.Includes(need) {
+		g.Audit(stub, caller, action, "need role "+string(need)+", has "+string(have))
+		return errs.New(errs.Unauthorized, "Unauthorized: "+caller+" cannot "+action+", it takes the "+string(need)+" role")
+	}
+	return nil
+}
+
+// RecordAdmin makes the identifiable caller deploying the chaincode its admin when there is none yet. Only the
+// deploy may call it, an invocation would let anybody claim a chaincode without admins. The table is saved either
+// way, so admins Load found outside of it land in it
+func (g Guard) RecordAdmin(stub shim.ChaincodeStubInterface) error {
+	table, err := g.table(stub)
+	if err != nil {
+		return err
+	}
+	if table.Count(Admin) == 0 {
+		caller, err := g.Caller(stub)
+		if err != nil { //deployed anonymously, the admin is whoever inits next
+			return nil
+		}
+		table.Set(caller, Admin)
+		g.log(stub).Info("admin recorded", "user", caller)
+	}
+	return table.Save(stub)
+}
+
+// SetRole changes the role of a user, the last admin can't be demoted or nobody could grant roles again
+func (g Guard) SetRole(stub shim.ChaincodeStubInterface, user string, role Role) error {
+	table, err := g.table(stub)
+	if err != nil {
+		return err
+	}
+	old := table.Of(user)
+	if old == Admin && role != Admin && table.Count(Admin) == 1 {
+		return errs.New(errs.Conflict, user+" is the last admin, grant another admin first")
+	}
+	table.Set(user, role)
+	err = table.Save(stub)
+	if err != nil {
+		return err
+	}
+	g.log(stub).Info("role changed", "user", user, "from", string(old), "to", string(role))
+	return nil
+}
+
+// Audit leaves a trace of a refused call in the peer log, the transaction itself is rolled back
+func (g Guard) Audit(stub shim.ChaincodeStubInterface, caller string, action string, reason string) {
+	g.log(stub).Warning("access denied", "audit", "denied", "user", caller, "action", action, "reason", reason)
+}
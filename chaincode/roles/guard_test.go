@@ -0,0 +1,132 @@
+package roles
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+)
+
+// certStub is a ledger with a caller, the caller is the username attribute of its certificate
+type certStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	caller string
+}
+
+func (s *certStub) GetState(key string) ([]byte, error) { return s.state[key], nil }
+
+func (s *certStub) PutState(key string, value []byte) error {
+	s.state[key] = value
+	return nil
+}
+
+func (s *certStub) ReadCertAttribute(name string) ([]byte, error) {
+	if name != "username" || s.caller == "" {
+		return nil, errors.New("no such attribute")
+	}
+	return []byte(s.caller), nil
+}
+
+func (s *certStub) GetCallerMetadata() ([]byte, error) { return []byte("root"), nil }
+
+// testGuard logs into out
+func testGuard(out *bytes.Buffer) Guard {
+	log := logging.New(out, logging.Info)
+	return Guard{Log: func(shim.ChaincodeStubInterface) *logging.Logger { return log }}
+}
+
+func TestGuardRecordsTheFirstAdmin(t *testing.T) {
+	var out bytes.Buffer
+	g := testGuard(&out)
+	stub := &certStub{state: map[string][]byte{}}
+	if err := g.RecordAdmin(stub); err != nil { //anonymous deploy
+		t.Fatal(err)
+	}
+	stub.caller = "bob"
+	if err := g.Authorize(stub, Admin, "reset"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("without an admin nobody does admin work, got %v", err)
+	}
+
+	stub.caller = " Root "
+	if err := g.RecordAdmin(stub); err != nil {
+		t.Fatal(err)
+	}
+	stub.caller = "bob"
+	if err := g.RecordAdmin(stub); err != nil {
+		t.Fatal(err)
+	}
+	table, _ := Load(stub)
+	if table.Of("root") != Admin || table.Of("bob") != User {
+		t.Errorf("table = %v, want root as the only admin", table)
+	}
+	if err := g.Authorize(stub, Admin, "reset"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("bob does admin work, got %v", err)
+	}
+}
+
+func TestGuardAuthorize(t *testing.T) {
+	var out bytes.Buffer
+	g := testGuard(&out)
+	stub := &certStub{state: map[string][]byte{}, caller: "root"}
+	if err := g.RecordAdmin(stub); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetRole(stub, "alice", Operator); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetRole(stub, "root", User); errs.CodeOf(err) != errs.Conflict {
+		t.Errorf("demoting the last admin = %v, want a conflict", err)
+	}
+
+	stub.caller = "alice"
+	if err := g.Authorize(stub, Operator, "match trades"); err != nil {
+		t.Errorf("an operator was refused: %v", err)
+	}
+	out.Reset()
+	if err := g.Authorize(stub, Admin, "grant roles"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("an operator did admin work, got %v", err)
+	}
+	if !strings.Contains(out.String(), "audit=denied user=alice action=\"grant roles\"") {
+		t.Errorf("the denial was not audited, log %q", out.String())
+	}
+	if err := g.AuthorizeUser(stub, " ALICE", "trade"); err != nil {
+		t.Errorf("alice acting as herself was refused: %v", err)
+	}
+	if err := g.AuthorizeUser(stub, "bob", "trade"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("alice acting as bob, got %v", err)
+	}
+
+	if err := g.AuthorizeUserOrRole(stub, "Alice", Admin, "register alice"); err != nil {
+		t.Errorf("alice registering herself was refused: %v", err)
+	}
+	if err := g.AuthorizeUserOrRole(stub, "bob", Admin, "register bob"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("alice registering bob, got %v", err)
+	}
+	stub.caller = "root"
+	if err := g.AuthorizeUserOrRole(stub, "bob", Admin, "register bob"); err != nil {
+		t.Errorf("an admin registering bob was refused: %v", err)
+	}
+
+	stub.caller = ""
+	if err := g.Authorize(stub, User, "read"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("an anonymous caller got through, %v", err)
+	}
+}
+
+func TestGuardIdentity(t *testing.T) {
+	stub := &certStub{state: map[string][]byte{}, caller: "bob"}
+	if caller, err := (Guard{}).Caller(stub); err != nil || caller != "bob" {
+		t.Errorf("default caller = %q, %v, want the certificate's bob", caller, err)
+	}
+	if caller, err := (Guard{Identity: CallerMetadata{}}).Caller(stub); err != nil || caller != "root" {
+		t.Errorf("opted in caller = %q, %v, want the metadata's root", caller, err)
+	}
+	if _, err := (Guard{Identity: CertAttribute{Attribute: "login"}}).Caller(stub); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("a missing attribute should be unauthorized, got %v", err)
+	}
+}
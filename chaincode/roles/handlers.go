@@ -0,0 +1,97 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package roles
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// GrantRole is the grant_role invoke, it gives a user a role, admin only
+func (g Guard) GrantRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0        1
+	// "bob", "operator"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id and role")
+	}
+	user := NormalizeID(args[0])
+	if user == "" {
+		return nil, errs.Arg(0, "1st argument must be a non-empty user id")
+	}
+	if g.User != nil {
+		var err error
+		user, err = g.User(stub, args[0])
+		if err != nil {
+			return nil, errs.WithArg(err, 0)
+		}
+	}
+	role, err := Parse(args[1])
+	if err != nil {
+		return nil, errs.WithArg(err, 1)
+	}
+	err = g.Authorize(stub, Admin, "grant roles")
+	if err != nil {
+		return nil, err
+	}
+	return nil, g.SetRole(stub, user, role)
+}
+
+// RevokeRole is the revoke_role invoke, it makes a user a plain user again, admin only. The user isn't vetted,
+// roles of users that are gone can still be revoked
+func (g Guard) RevokeRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id")
+	}
+	err := g.Authorize(stub, Admin, "revoke roles")
+	if err != nil {
+		return nil, err
+	}
+	return nil, g.SetRole(stub, NormalizeID(args[0]), User)
+}
+
+// GetRole is the get_role query, users nobody granted anything are plain users
+func (g Guard) GetRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id")
+	}
+	table, err := g.table(stub)
+	if err != nil {
+		return nil, err
+	}
+	user := NormalizeID(args[0])
+	jsonAsBytes, _ := json.Marshal(Assignment{User: user, Role: table.Of(user)})
+	return jsonAsBytes, nil
+}
+
+// ListRoles is the list_roles query, every user with more than the user role
+func (g Guard) ListRoles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	table, err := g.table(stub)
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(table.Assignments())
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,60 @@
+package roles
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+func TestRoleFunctions(t *testing.T) {
+	var out bytes.Buffer
+	g := testGuard(&out)
+	g.User = func(stub shim.ChaincodeStubInterface, id string) (string, error) {
+		if NormalizeID(id) == "nobody" {
+			return "", errs.New(errs.NotFound, "User not found: nobody")
+		}
+		return NormalizeID(id), nil
+	}
+	stub := &certStub{state: map[string][]byte{}, caller: "root"}
+	if err := g.RecordAdmin(stub); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		code errs.Code
+	}{
+		{[]string{"bob"}, errs.InvalidArgument},
+		{[]string{" ", "admin"}, errs.InvalidArgument},
+		{[]string{"bob", "boss"}, errs.InvalidArgument},
+		{[]string{"nobody", "admin"}, errs.NotFound},
+	} {
+		if _, err := g.GrantRole(stub, c.args); errs.CodeOf(err) != c.code {
+			t.Errorf("GrantRole%q = %v, want %s", c.args, err, c.code)
+		}
+	}
+	if _, err := g.GrantRole(stub, []string{" Bob ", "operator"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := g.GetRole(stub, []string{"BOB"})
+	if err != nil || string(res) != `{"user":"bob","role":"operator"}` {
+		t.Errorf("GetRole = %s, %v", res, err)
+	}
+
+	stub.caller = "bob"
+	if _, err := g.RevokeRole(stub, []string{"bob"}); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("an operator revoked a role, got %v", err)
+	}
+	stub.caller = "root"
+	if _, err := g.RevokeRole(stub, []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = g.ListRoles(stub, nil)
+	var list []Assignment
+	if json.Unmarshal(res, &list) != nil || len(list) != 1 || list[0] != (Assignment{User: "root", Role: Admin}) {
+		t.Errorf("ListRoles = %s", res)
+	}
+}
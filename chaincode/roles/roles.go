@@ -0,0 +1,135 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package roles is the role model of the marbles and scrutin chaincodes.
+//
+// Every caller is a User. The role table, stored under Key, lists the callers that are more than that.
+// Roles are ordered, an Admin can do everything an Operator can and an Operator everything a User can.
+// A Guard resolves the caller, checks it against the table and audits what it refuses.
+package roles
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// Key is the name for the key/value that stores the role table
+const Key = "_roles"
+
+type Role string
+
+const (
+	User     Role = "user"     //anybody, the role of everyone not in the table
+	Operator Role = "operator" //runs maintenance like reindexing and the log level
+	Admin    Role = "admin"    //grants roles and runs the functions that can overwrite or wipe the ledger
+)
+
+var rank = map[Role]int{User: 0, Operator: 1, Admin: 2}
+
+// Parse reads a role name, any case
+func Parse(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := rank[role]; !ok {
+		return User, errs.New(errs.InvalidArgument, "Unknown role "+name+", expecting user, operator or admin")
+	}
+	return role, nil
+}
+
+// Includes is true when r can do whatever other can
+func (r Role) Includes(other Role) bool {
+	return rank[r] >= rank[other]
+}
+
+// Table maps user ids to their role, plain users are left out
+type Table map[string]Role
+
+// Assignment is one row of the table, for listing
+type Assignment struct {
+	User string `json:"user"`
+	Role Role   `json:"role"`
+}
+
+// Load reads the role table, an unset table is empty
+func Load(stub shim.ChaincodeStubInterface) (Table, error) {
+	table := Table{}
+	tableAsBytes, err := stub.GetState(Key)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get roles")
+	}
+	if len(tableAsBytes) == 0 {
+		return table, nil
+	}
+	err = json.Unmarshal(tableAsBytes, &table)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Corrupt roles")
+	}
+	return table, nil
+}
+
+// Save writes the role table
+func (t Table) Save(stub shim.ChaincodeStubInterface) error {
+	tableAsBytes, _ := json.Marshal(t)
+	return stub.PutState(Key, tableAsBytes)
+}
+
+// Of is the role of a user id
+func (t Table) Of(id string) Role {
+	if role, ok := t[id]; ok {
+		return role
+	}
+	return User
+}
+
+// Set gives a user id a role, setting User takes the id out of the table
+func (t Table) Set(id string, role Role) {
+	if role == User {
+		delete(t, id)
+		return
+	}
+	t[id] = role
+}
+
+// Count is how many user ids have exactly this role
+func (t Table) Count(role Role) int {
+	n := 0
+	for _, r := range t {
+		if r == role {
+			n++
+		}
+	}
+	return n
+}
+
+// Assignments lists the table ordered by user id
+func (t Table) Assignments() []Assignment {
+	ids := []string{}
+	for id := range t {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := []Assignment{}
+	for _, id := range ids {
+		list = append(list, Assignment{User: id, Role: t[id]})
+	}
+	return list
+}
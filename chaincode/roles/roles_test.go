@@ -0,0 +1,44 @@
+package roles
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]Role{"admin": Admin, " Operator ": Operator, "USER": User} {
+		if got, err := Parse(name); err != nil || got != want {
+			t.Errorf("Parse(%q) = %s, %v, want %s", name, got, err, want)
+		}
+	}
+	if _, err := Parse("boss"); err == nil {
+		t.Error("Parse of an unknown role should fail")
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	if !Admin.Includes(Operator) || !Operator.Includes(User) || !User.Includes(User) {
+		t.Error("higher roles should include lower ones")
+	}
+	if User.Includes(Operator) || Operator.Includes(Admin) {
+		t.Error("lower roles should not include higher ones")
+	}
+}
+
+func TestTable(t *testing.T) {
+	table := Table{}
+	table.Set("bob", Admin)
+	table.Set("alice", Operator)
+	table.Set("carol", Admin)
+	table.Set("carol", User)
+	if table.Of("carol") != User || table.Of("nobody") != User {
+		t.Error("users without a role are plain users")
+	}
+	if table.Count(Admin) != 1 || table.Count(Operator) != 1 {
+		t.Errorf("counts = %d admins, %d operators", table.Count(Admin), table.Count(Operator))
+	}
+	want := []Assignment{{User: "alice", Role: Operator}, {User: "bob", Role: Admin}}
+	if got := table.Assignments(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Assignments() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+func roleOf(t *testing.T, stub *memStub, cc *SimpleChaincode, user string) roles.Role {
+	t.Helper()
+	res, err := stub.query(cc, "get_role", user)
+	if err != nil {
+		t.Fatalf("get_role %s failed: %s", user, err)
+	}
+	var assignment roles.Assignment
+	if err := json.Unmarshal(res, &assignment); err != nil {
+		t.Fatalf("get_role %s returned %s: %s", user, res, err)
+	}
+	return assignment.Role
+}
+
+func TestFirstAdmin(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := newMemStub()
+
+	//deployed anonymously there is no admin, and nobody can make themselves one
+	stub.begin()
+	_, err := cc.Init(stub, "init", []string{"99"})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	stub.as("dave")
+	_, err = stub.invoke(cc, "init", `{"admins":["dave"]}`)
+	mustFailWith(t, err, errs.Unauthorized, -1)
+	mustBeUnauthorized(t, stub, cc, "init", "99")
+	if got := roleOf(t, stub, cc, "dave"); got != roles.User {
+		t.Errorf("dave is %s, want user", got)
+	}
+
+	//the deployer is the admin, only admins run init and it keeps the roles
+	cc, stub = new(SimpleChaincode), newMemStub()
+	stub.as("dave")
+	stub.begin()
+	_, err = cc.Init(stub, "init", []string{"99"})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "init", "99")
+	stub.as("dave")
+	mustInvoke(t, stub, cc, "init", "99")
+	if got := roleOf(t, stub, cc, "dave"); got != roles.Admin {
+		t.Errorf("dave is %s after a reset, want admin", got)
+	}
+}
+
+func TestLegacyAdmin(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	//a ledger from before roles only knows its admin by the _admin key
+	delete(stub.state, roles.Key)
+	stub.state[adminStr] = []byte("dave")
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "init", "99")
+	stub.as("dave")
+	mustInvoke(t, stub, cc, "init", "99")
+	if _, ok := stub.state[adminStr]; ok {
+		t.Error("init should move the legacy admin into the role table")
+	}
+	if got := roleOf(t, stub, cc, "dave"); got != roles.Admin {
+		t.Errorf("dave is %s, want admin", got)
+	}
+	if got := roleOf(t, stub, cc, testAdmin); got != roles.User {
+		t.Errorf("%s is %s, want user", testAdmin, got)
+	}
+}
+
+func TestGrantAndRevokeRoles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as("alice")
+	mustBeUnauthorized(t, stub, cc, "grant_role", "alice", "admin")
+
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "grant_role", "alice")
+	_, err := stub.invoke(cc, "grant_role", "nobody", "operator")
+	mustFailWith(t, err, errs.NotFound, 0)
+	_, err = stub.invoke(cc, "grant_role", "alice", "boss")
+	mustFailWith(t, err, errs.InvalidArgument, 1)
+
+	mustInvoke(t, stub, cc, "grant_role", " Alice ", "Operator")
+	mustInvoke(t, stub, cc, "grant_role", "bob", "admin")
+	if got := roleOf(t, stub, cc, "alice"); got != roles.Operator {
+		t.Errorf("alice is %s, want operator", got)
+	}
+	if got := roleOf(t, stub, cc, "carol"); got != roles.User {
+		t.Errorf("carol is %s, want user", got)
+	}
+	res, err := stub.query(cc, "list_roles")
+	if err != nil {
+		t.Fatalf("list_roles failed: %s", err)
+	}
+	var list []roles.Assignment
+	want := []roles.Assignment{{User: "alice", Role: roles.Operator}, {User: "bob", Role: roles.Admin}, {User: testAdmin, Role: roles.Admin}}
+	if err := json.Unmarshal(res, &list); err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("list_roles = %s, %v", res, err)
+	}
+
+	//operators run maintenance but can't hand out roles
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "set_log_level", "debug")
+	mustBeUnauthorized(t, stub, cc, "grant_role", "carol", "operator")
+	mustBeUnauthorized(t, stub, cc, "write", "k", "v")
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "revoke_role", "alice")
+	mustInvoke(t, stub, cc, "revoke_role", testAdmin)
+	if got := roleOf(t, stub, cc, "alice"); got != roles.User {
+		t.Errorf("alice is %s after revoke, want user", got)
+	}
+
+	//the last admin stays
+	_, err = stub.invoke(cc, "revoke_role", "bob")
+	mustFailWith(t, err, errs.Conflict, -1)
+	_, err = stub.invoke(cc, "grant_role", "bob", "operator")
+	mustFailWith(t, err, errs.Conflict, -1)
+}
+
+func TestGenericFunctionsNeedAdmin(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "k", "v")
+
+	for _, user := range []string{"", "bob"} {
+		stub.as(user)
+		mustBeUnauthorized(t, stub, cc, "write", "k", "w")
+		mustBeUnauthorized(t, stub, cc, "write", roles.Key, `{"bob":"admin"}`)
+		mustBeUnauthorized(t, stub, cc, "delete", "k")
+		mustBeUnauthorized(t, stub, cc, "init", "1")
+	}
+	if string(stub.state["k"]) != "v" {
+		t.Errorf("k = %q, want v", stub.state["k"])
+	}
+
+	//owners still delete their own marbles
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "delete", "b1")
+}
+
+func TestDenialsAreAudited(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	out := captureLog(t)
+
+	stub.as("bob")
+	mustBeUnauthorized(t, stub, cc, "write", "k", "v")
+	line := "level=warning msg=\"access denied\" function=write tx=" + stub.txID + " audit=denied user=bob action=\"write k\" reason=\"need role admin, has user\"\n"
+	if !strings.HasPrefix(out.String(), line) {
+		t.Errorf("got %q, want it to start with %q", out.String(), line)
+	}
+}
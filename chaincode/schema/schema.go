@@ -0,0 +1,254 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package schema versions the records the marbles and scrutin chaincodes keep in the ledger.
+//
+// Every stored record carries its version in the Field json field, records written before versioning have none and
+// are version 0. Each kind of record has a Registry of migrations, migration n upgrades a record from version n to
+// n+1, so the current version of a kind is the number of its migrations. Reads run Upgrade on whatever they find,
+// and Run upgrades the stored records themselves a batch at a time.
+package schema
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// Field is the json field holding the version of a record
+const Field = "schema"
+
+// Record is a stored record as raw json fields, what migrations work on
+type Record map[string]json.RawMessage
+
+// Get un stringifies a field into v, a missing field leaves v as it is
+func (r Record) Get(field string, v interface{}) error {
+	raw, ok := r[field]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Set stores v as a field
+func (r Record) Set(field string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r[field] = raw
+	return nil
+}
+
+// Migration upgrades a record by one version
+type Migration func(Record) error
+
+// Initial is the first migration of kinds that didn't change when versions were introduced, it only gets them stamped
+func Initial(Record) error { return nil }
+
+// Registry holds the migrations of one kind of record
+type Registry struct {
+	kind       string
+	migrations []Migration
+}
+
+// NewRegistry starts the registry of a kind of record, at version 0 until migrations are registered
+func NewRegistry(kind string) *Registry {
+	return &Registry{kind: kind}
+}
+
+// Register adds the migration from version from to from+1, migrations have to be registered in order
+func (r *Registry) Register(from int, m Migration) *Registry {
+	if from != len(r.migrations) {
+		panic("schema: " + r.kind + " migration from version " + strconv.Itoa(from) + " registered out of order")
+	}
+	r.migrations = append(r.migrations, m)
+	return r
+}
+
+// Kind is the name of the kind of record
+func (r *Registry) Kind() string { return r.kind }
+
+// Current is the version records of this kind are written with
+func (r *Registry) Current() int { return len(r.migrations) }
+
+// VersionOf reads the version of a stored record, records without one are version 0
+func VersionOf(data []byte) (int, error) {
+	var stamp struct {
+		Version int `json:"schema"`
+	}
+	err := json.Unmarshal(data, &stamp)
+	if err != nil {
+		return 0, err
+	}
+	return stamp.Version, nil
+}
+
+// Upgrade brings a stored record up to the current version, the record comes back as it is when it already is.
+// Records from a newer version than this chaincode knows are refused rather than read wrong.
+func (r *Registry) Upgrade(data []byte) ([]byte, bool, error) {
+	version, err := VersionOf(data)
+	if err != nil {
+		return nil, false, errs.New(errs.Internal, "Corrupt "+r.kind+" record")
+	}
+	if version == r.Current() {
+		return data, false, nil
+	}
+	if version < 0 || version > r.Current() {
+		return nil, false, errs.New(errs.Internal, r.kind+" record has unknown schema version "+strconv.Itoa(version))
+	}
+
+	record := Record{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, false, errs.New(errs.Internal, "Corrupt "+r.kind+" record")
+	}
+	for ; version < r.Current(); version++ {
+		err = r.migrations[version](record)
+		if err != nil {
+			return nil, false, errs.New(errs.Internal, "Failed to upgrade "+r.kind+" record from version "+strconv.Itoa(version)+": "+err.Error())
+		}
+	}
+	record.Set(Field, version)
+	upgraded, _ := json.Marshal(record)
+	return upgraded, true, nil
+}
+
+// ============================================================================================================================
+// Stored migrations - upgrading every stored record, a batch per transaction
+// ============================================================================================================================
+
+// Stage is the part of a migration that upgrades one kind of record, its records are visited in key order
+type Stage struct {
+	Kind    string
+	Keys    func(stub shim.ChaincodeStubInterface, after string, limit int) ([]string, error) //up to limit keys after the cursor, in order
+	Upgrade func(stub shim.ChaincodeStubInterface, key string) (bool, error)                  //upgrade one stored record, true if it was rewritten
+}
+
+// Progress is how far a migration got, it is stored between batches
+type Progress struct {
+	Versions map[string]int `json:"versions"` //the version of each kind this migration upgrades to
+	Stage    string         `json:"stage"`    //kind of record the next batch works on, empty once done
+	Cursor   string         `json:"cursor"`   //key of the last record looked at in the stage
+	Scanned  int            `json:"scanned"`  //records looked at so far
+	Upgraded int            `json:"upgraded"` //records rewritten so far
+	Batch    int            `json:"batch"`    //records looked at by the last batch
+	Done     bool           `json:"done"`
+}
+
+// Run upgrades the next batch of at most limit records and stores the progress under key.
+// A migration that finished stays finished until a registry gets a new version, then it starts over.
+func Run(stub shim.ChaincodeStubInterface, key string, registries []*Registry, stages []Stage, limit int) (Progress, error) {
+	versions := map[string]int{}
+	for _, r := range registries {
+		versions[r.Kind()] = r.Current()
+	}
+	progress, err := load(stub, key)
+	if err != nil {
+		return progress, err
+	}
+	if !sameVersions(progress.Versions, versions) { //nothing stored, or a new version shipped
+		progress = Progress{Versions: versions}
+		if len(stages) > 0 {
+			progress.Stage = stages[0].Kind
+		}
+	}
+
+	progress.Batch = 0
+	for progress.Stage != "" && progress.Batch < limit {
+		i := stageIndex(stages, progress.Stage)
+		if i < 0 { //a stage this chaincode no longer has
+			progress.Stage = ""
+			break
+		}
+		room := limit - progress.Batch
+		keys, err := stages[i].Keys(stub, progress.Cursor, room)
+		if err != nil {
+			return progress, err
+		}
+		for _, k := range keys {
+			upgraded, err := stages[i].Upgrade(stub, k)
+			if err != nil {
+				return progress, err
+			}
+			if upgraded {
+				progress.Upgraded++
+			}
+			progress.Scanned++
+			progress.Batch++
+			progress.Cursor = k
+		}
+		if len(keys) < room { //the stage ran out of records, the next one starts from its first
+			progress.Cursor = ""
+			progress.Stage = ""
+			if i+1 < len(stages) {
+				progress.Stage = stages[i+1].Kind
+			}
+		}
+	}
+	progress.Done = progress.Stage == ""
+
+	progressAsBytes, _ := json.Marshal(progress)
+	err = stub.PutState(key, progressAsBytes)
+	if err != nil {
+		return progress, err
+	}
+	return progress, nil
+}
+
+// stageIndex finds a stage by kind, -1 if there is none
+func stageIndex(stages []Stage, kind string) int {
+	for i, stage := range stages {
+		if stage.Kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// load reads the stored progress, nothing stored is a migration that never ran
+func load(stub shim.ChaincodeStubInterface, key string) (Progress, error) {
+	var progress Progress
+	progressAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return progress, errs.New(errs.Internal, "Failed to get migration progress")
+	}
+	if len(progressAsBytes) == 0 {
+		return progress, nil
+	}
+	err = json.Unmarshal(progressAsBytes, &progress)
+	if err != nil {
+		return progress, errs.New(errs.Internal, "Corrupt migration progress")
+	}
+	return progress, nil
+}
+
+func sameVersions(a map[string]int, b map[string]int) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for kind, version := range b {
+		if v, ok := a[kind]; !ok || v != version {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// mapStub keeps state in a map, enough for Run
+type mapStub struct {
+	shim.ChaincodeStubInterface
+	state map[string][]byte
+}
+
+func (s *mapStub) GetState(key string) ([]byte, error) { return s.state[key], nil }
+func (s *mapStub) PutState(key string, value []byte) error {
+	s.state[key] = value
+	return nil
+}
+
+func testRegistry() *Registry {
+	return NewRegistry("thing").
+		Register(0, Initial).
+		Register(1, func(r Record) error { //v2 renamed owner to user
+			var owner string
+			if err := r.Get("owner", &owner); err != nil {
+				return err
+			}
+			delete(r, "owner")
+			return r.Set("user", owner)
+		})
+}
+
+func TestUpgrade(t *testing.T) {
+	r := testRegistry()
+	if r.Current() != 2 || r.Kind() != "thing" {
+		t.Fatalf("registry = %s v%d", r.Kind(), r.Current())
+	}
+
+	upgraded, changed, err := r.Upgrade([]byte(`{"name":"t1","owner":"bob"}`))
+	if err != nil || !changed {
+		t.Fatalf("Upgrade = %s, %v, %v", upgraded, changed, err)
+	}
+	var thing struct {
+		Name    string `json:"name"`
+		User    string `json:"user"`
+		Version int    `json:"schema"`
+	}
+	if err := json.Unmarshal(upgraded, &thing); err != nil || thing.Name != "t1" || thing.User != "bob" || thing.Version != 2 {
+		t.Errorf("upgraded record = %s", upgraded)
+	}
+
+	current := []byte(`{"name":"t1","user":"bob","schema":2}`)
+	if got, changed, err := r.Upgrade(current); err != nil || changed || string(got) != string(current) {
+		t.Errorf("a current record should come back as it is, got %s, %v, %v", got, changed, err)
+	}
+	if _, _, err := r.Upgrade([]byte(`{"schema":3}`)); err == nil {
+		t.Error("records of a newer version should be refused")
+	}
+	if _, _, err := r.Upgrade([]byte(`{nope`)); err == nil {
+		t.Error("corrupt records should be refused")
+	}
+	failing := NewRegistry("broken").Register(0, func(Record) error { return errors.New("boom") })
+	if _, _, err := failing.Upgrade([]byte(`{}`)); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("a failing migration should fail the upgrade, got %v", err)
+	}
+}
+
+func TestRegisterOutOfOrder(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a migration out of order should panic")
+		}
+	}()
+	NewRegistry("thing").Register(1, Initial)
+}
+
+func TestRun(t *testing.T) {
+	r := testRegistry()
+	stub := &mapStub{state: map[string][]byte{}}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		stub.state[name] = []byte(`{"name":"` + name + `","owner":"bob"}`)
+	}
+	stub.state["c"] = []byte(`{"name":"c","user":"bob","schema":2}`) //already current
+	keysAfter := func(prefix string) func(shim.ChaincodeStubInterface, string, int) ([]string, error) {
+		return func(stub shim.ChaincodeStubInterface, after string, limit int) ([]string, error) {
+			var keys []string
+			for k := range stub.(*mapStub).state {
+				if strings.HasPrefix(k, prefix) && k > after && !strings.HasPrefix(k, "_") {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			if len(keys) > limit {
+				keys = keys[:limit]
+			}
+			return keys, nil
+		}
+	}
+	upgrade := func(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+		data, _ := stub.GetState(key)
+		upgraded, changed, err := r.Upgrade(data)
+		if err != nil || !changed {
+			return false, err
+		}
+		return true, stub.PutState(key, upgraded)
+	}
+	stages := []Stage{
+		{Kind: "early", Keys: keysAfter(""), Upgrade: upgrade},
+		{Kind: "none", Keys: keysAfter("z"), Upgrade: upgrade},
+	}
+
+	var progress Progress
+	var err error
+	for i := 0; i < 10 && !progress.Done; i++ {
+		progress, err = Run(stub, "_migration", []*Registry{r}, stages, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if progress.Batch > 2 {
+			t.Fatalf("batch of %d records, limit is 2", progress.Batch)
+		}
+	}
+	if !progress.Done || progress.Scanned != 5 || progress.Upgraded != 4 || progress.Versions["thing"] != 2 {
+		t.Fatalf("progress = %+v", progress)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if v, _ := VersionOf(stub.state[name]); v != 2 {
+			t.Errorf("%s is at version %d", name, v)
+		}
+	}
+
+	//a finished migration stays finished, until a new version ships
+	if progress, _ = Run(stub, "_migration", []*Registry{r}, stages, 2); !progress.Done || progress.Batch != 0 {
+		t.Errorf("progress after the migration finished = %+v", progress)
+	}
+	r.Register(2, Initial)
+	if progress, _ = Run(stub, "_migration", []*Registry{r}, stages, 2); progress.Done || progress.Upgraded != 2 || progress.Stage != "early" {
+		t.Errorf("a new version should start the migration over, got %+v", progress)
+	}
+}
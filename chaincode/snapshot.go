@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/snapshot"
+)
+
+// a snapshot holds the users, marbles and open trades, in that order so everything a record refers to comes
+// before it. Roles, rules, auctions, listings, coins and ownership histories stay with the ledger they belong to,
+// so a marble locked by an auction or listing is exported unlocked.
+var snapshotSources = []snapshot.Source{
+	{Kind: "user", Records: exportUsers},
+	{Kind: "marble", Records: exportMarbles},
+	{Kind: "trade", Records: exportTrades},
+}
+
+var snapshotImporters = map[string]snapshot.Importer{
+	"user":   importUser,
+	"marble": importMarble,
+	"trade":  importTrade,
+}
+
+func exportUsers(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	ids, err := idsAfter(stub, userStr, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := []snapshot.Line{}
+	for _, id := range ids {
+		user, err := getUser(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		userAsBytes, _ := json.Marshal(user)
+		lines = append(lines, snapshot.Line{Key: id, Record: userAsBytes})
+	}
+	return lines, nil
+}
+
+func exportMarbles(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	lines := []snapshot.Line{}
+	for len(lines) < limit {
+		room := limit - len(lines)
+		names, err := marblesAfter(stub, after, room)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			after = name
+			marble, err := getMarble(stub, name)
+			if err != nil && errs.CodeOf(err) == errs.NotFound { //stale index entry
+				continue
+			}
+			if err != nil {
+				return nil, errs.Prefix("Cannot export marble "+name+": ", err)
+			}
+			if marble.LockedBy != "" { //only trade locks travel with the snapshot
+				_, err = getTrade(stub, marble.LockedBy)
+				if err != nil && errs.CodeOf(err) != errs.NotFound {
+					return nil, err
+				}
+				if err != nil {
+					marble.LockedBy = ""
+				}
+			}
+			marble.Schema = marbleSchema.Current()
+			marbleAsBytes, _ := json.Marshal(marble)
+			lines = append(lines, snapshot.Line{Key: name, Record: marbleAsBytes})
+		}
+		if len(names) < room { //no more marbles
+			break
+		}
+	}
+	return lines, nil
+}
+
+func exportTrades(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	ids, err := tradesAfter(stub, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := []snapshot.Line{}
+	for _, id := range ids {
+		open, err := getTrade(stub, id)
+		if err != nil {
+			return nil, errs.Prefix("Cannot export trade "+id+": ", err)
+		}
+		tradeAsBytes, _ := json.Marshal(open)
+		lines = append(lines, snapshot.Line{Key: id, Record: tradeAsBytes})
+	}
+	return lines, nil
+}
+
+// upgradeImported brings a record of the snapshot up to the current version, a snapshot from a newer chaincode is refused
+func upgradeImported(registry *schema.Registry, record []byte) ([]byte, error) {
+	upgraded, _, err := registry.Upgrade(record)
+	if err != nil {
+		return nil, errs.New(errs.InvalidArgument, errs.From(err).Message)
+	}
+	return upgraded, nil
+}
+
+// importUser registers the user, or updates the display name of a user already registered
+func importUser(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	var user User
+	if json.Unmarshal(line.Record, &user) != nil {
+		return false, errs.New(errs.InvalidArgument, "Not a user record")
+	}
+	if user.ID == "" || user.ID != normalizeUserID(user.ID) || strings.ContainsAny(user.ID, " \t\r\n") || user.ID != line.Key {
+		return false, errs.New(errs.InvalidArgument, "User id must be the key, in lower case and without whitespace")
+	}
+	if strings.TrimSpace(user.Name) == "" {
+		return false, errs.New(errs.InvalidArgument, "User needs a display name")
+	}
+	existing, err := getUser(stub, user.ID)
+	if err == nil && existing == user {
+		return false, nil
+	}
+	if err != nil && errs.CodeOf(err) != errs.NotFound {
+		return false, err
+	}
+	return true, putUser(stub, user)
+}
+
+// importMarble creates the marble, or rewrites the marble already under its name and moves its index entries
+func importMarble(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	recordAsBytes, err := upgradeImported(marbleSchema, line.Record)
+	if err != nil {
+		return false, err
+	}
+	var marble Marble
+	if json.Unmarshal(recordAsBytes, &marble) != nil || marble.Name != line.Key {
+		return false, errs.New(errs.InvalidArgument, "Not a marble record")
+	}
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return false, err
+	}
+	err = rules.validName(marble.Name)
+	if err == nil {
+		_, err = rules.validColor(marble.Color)
+	}
+	if err == nil {
+		err = rules.validSize(marble.Size)
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = requireUser(stub, marble.User) //owners come earlier in the snapshot
+	if err != nil {
+		return false, err
+	}
+	marble.Schema = marbleSchema.Current()
+	if marble.LockedBy != "" { //a lock only holds for a trade already here, trades of later pages lock their marbles themselves
+		open, err := getTrade(stub, marble.LockedBy)
+		if err != nil && errs.CodeOf(err) != errs.NotFound {
+			return false, err
+		}
+		if err != nil || !open.escrows(marble.Name) {
+			marble.LockedBy = ""
+		}
+	}
+
+	existingAsBytes, err := stub.GetState(marble.Name)
+	if err != nil {
+		return false, errs.New(errs.Internal, "Failed to get marble "+marble.Name)
+	}
+	var existing Marble
+	if existingAsBytes != nil {
+		existing, err = parseMarble(marble.Name, existingAsBytes)
+		if err != nil {
+			return false, errs.New(errs.AlreadyExists, "Key "+marble.Name+" is already in use")
+		}
+		if existing == marble {
+			return false, nil
+		}
+		if existing.LockedBy != "" && existing.LockedBy != marble.LockedBy {
+			return false, errs.New(errs.Conflict, "Marble "+marble.Name+" is locked by "+existing.LockedBy)
+		}
+		err = unindexMarble(stub, existing)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = putMarble(stub, marble)
+	if err != nil {
+		return false, err
+	}
+	err = indexMarble(stub, marble)
+	if err != nil {
+		return false, err
+	}
+	if existingAsBytes == nil {
+		err = addToMarbleIndex(stub, marble.Name)
+		if err != nil {
+			return false, err
+		}
+		emit(stub, marbleCreated(marble))
+	} else if existing.User != marble.User {
+		emit(stub, marbleTransferred(marble.Name, existing.User, marble.User, reasonImport, ""))
+	}
+	if existing.User != marble.User {
+		err = recordOwnership(stub, marble.Name, existing.User, marble.User, reasonImport, "")
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// importTrade opens the trade, or replaces the trade already open under its id. Its escrowed marbles come earlier
+// in the snapshot and have to be the opener's, a marble imported before the trade was is locked for it here.
+func importTrade(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	recordAsBytes, err := upgradeImported(tradeSchema, line.Record)
+	if err != nil {
+		return false, err
+	}
+	var open AnOpenTrade
+	if json.Unmarshal(recordAsBytes, &open) != nil || open.ID == "" || open.ID != line.Key {
+		return false, errs.New(errs.InvalidArgument, "Not a trade record")
+	}
+	user, err := requireUser(stub, open.User)
+	if err != nil {
+		return false, err
+	}
+	if user != open.User {
+		return false, errs.New(errs.InvalidArgument, "Trade opener must be a user id, not "+open.User)
+	}
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return false, err
+	}
+	if len(open.Willing) == 0 {
+		return false, errs.New(errs.InvalidArgument, "Trade is not willing to give anything")
+	}
+	for _, d := range append([]Description{open.Want}, open.Willing...) {
+		if _, err = validateDescription(rules, d, 0); err != nil {
+			return false, errs.New(errs.InvalidArgument, errs.From(err).Message)
+		}
+		if d.Quantity < 0 {
+			return false, errs.New(errs.InvalidArgument, "Quantity must not be negative")
+		}
+	}
+	escrowed := map[string]bool{}
+	unlocked := []Marble{} //escrowed marbles still waiting for the trade
+	for _, name := range open.Escrow {
+		marble, err := getMarble(stub, name)
+		if err != nil {
+			return false, errs.Prefix("Escrowed marble "+name+": ", err)
+		}
+		if normalizeUserID(marble.User) != open.User || (marble.LockedBy != open.ID && marble.LockedBy != "") {
+			return false, errs.New(errs.Conflict, "Escrowed marble "+name+" is not "+open.User+"'s marble free for this trade")
+		}
+		if marble.LockedBy == "" {
+			unlocked = append(unlocked, marble)
+		}
+		escrowed[name] = true
+	}
+	open.Schema = tradeSchema.Current()
+
+	existing, err := getTrade(stub, open.ID)
+	if err != nil && errs.CodeOf(err) != errs.NotFound {
+		return false, err
+	}
+	if err == nil {
+		existingAsBytes, _ := json.Marshal(existing)
+		tradeAsBytes, _ := json.Marshal(open)
+		if bytes.Equal(existingAsBytes, tradeAsBytes) {
+			return false, nil
+		}
+		var released []string //marbles the trade held here but not in the snapshot
+		for _, name := range existing.Escrow {
+			if !escrowed[name] {
+				released = append(released, name)
+			}
+		}
+		err = unlockMarbles(stub, released, open.ID)
+		if err != nil {
+			return false, err
+		}
+		err = deleteTrade(stub, existing) //the want index entry may move
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, marble := range unlocked {
+		err = lockMarble(stub, marble, open.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, putTrade(stub, open)
+}
+
+// ============================================================================================================================
+// Export State (query) - a page of the snapshot of every user, marble and open trade, admin only
+// pass the bookmark of each page back until a page has none, the checksum of that page is the checksum of the ledger
+// ============================================================================================================================
+func (t *SimpleChaincode) export_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	pageSize := defaultPageSize
+	bookmark := ""
+
+	//   0*      1*
+	// "20", "bookmark"
+	if len(args) > 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting page size and bookmark")
+	}
+	if len(args) > 0 && args[0] != "" {
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			return nil, errs.Arg(0, "1st argument must be a page size between 1 and "+strconv.Itoa(maxPageSize))
+		}
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	err = t.authorizeAdmin(stub, "export state")
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := snapshot.Export(stub, snapshotSources, pageSize, bookmark)
+	if err != nil && errs.CodeOf(err) == errs.InvalidArgument { //a bookmark that points nowhere
+		return nil, errs.WithArg(err, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// ============================================================================================================================
+// Import State - write the records of export_state pages, admin only
+// every record is validated and a page whose checksum doesn't match is refused, importing a page twice changes nothing
+// ============================================================================================================================
+func (t *SimpleChaincode) import_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "{"kind":"user",...}\n{"kind":"page",...}\n"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting export_state pages")
+	}
+	err := t.authorizeAdmin(stub, "import state")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := snapshot.Import(stub, []byte(args[0]), snapshotImporters)
+	if err != nil && errs.CodeOf(err) == errs.InvalidArgument {
+		return nil, errs.WithArg(err, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("state imported", "records", strconv.Itoa(result.Records), "imported", strconv.Itoa(result.Imported),
+		"unchanged", strconv.Itoa(result.Unchanged))
+	return json.Marshal(result)
+}
@@ -0,0 +1,240 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package snapshot is the backup format of the marbles and scrutin chaincodes.
+//
+// A snapshot is JSON lines, one Line per record, in a fixed order so the same ledger always exports the same
+// snapshot. Exports are paged. Every page ends with a page line carrying the bookmark of the next page and the
+// checksum of every record up to the end of the page. The checksum chains from page to page, so the checksum on
+// the last page, the one without a bookmark, is the checksum of the whole ledger and a restored ledger exports
+// the same one.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// PageKind is the kind of the line closing every page
+const PageKind = "page"
+
+// Line is one line of a snapshot, a record or the page line
+type Line struct {
+	Kind     string          `json:"kind"`               //kind of record, or PageKind
+	Key      string          `json:"key,omitempty"`      //what the record is known by, its name or id
+	Record   json.RawMessage `json:"record,omitempty"`   //the record, at the schema version of the chaincode that exported it
+	Start    string          `json:"start,omitempty"`    //page line: checksum before the page's records
+	Checksum string          `json:"checksum,omitempty"` //page line: checksum after the page's records
+	Bookmark string          `json:"bookmark,omitempty"` //page line: pass back to get the next page, empty on the last page
+}
+
+// Chain adds a record to a running checksum, the checksum of no records is empty
+func Chain(checksum string, line Line) string {
+	record, _ := json.Marshal(Line{Kind: line.Kind, Key: line.Key, Record: line.Record}) //marshal compacts the record
+	sum := sha256.Sum256(append([]byte(checksum+"\n"), record...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Source lists the records of one kind in key order
+type Source struct {
+	Kind    string
+	Records func(stub shim.ChaincodeStubInterface, after string, limit int) ([]Line, error) //up to limit records after the key
+}
+
+// cursor is what a bookmark stands for, where the next page starts and the checksum so far
+type cursor struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Checksum string `json:"checksum"`
+}
+
+func (c cursor) bookmark() string {
+	cursorAsBytes, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(cursorAsBytes)
+}
+
+func parseBookmark(bookmark string) (cursor, error) {
+	var c cursor
+	cursorAsBytes, err := base64.URLEncoding.DecodeString(bookmark)
+	if err == nil {
+		err = json.Unmarshal(cursorAsBytes, &c)
+	}
+	if err != nil {
+		return c, errs.New(errs.InvalidArgument, "Not a snapshot bookmark: "+bookmark)
+	}
+	return c, nil
+}
+
+// Export reads the page of at most limit records that starts at the bookmark, an empty bookmark is the first page
+func Export(stub shim.ChaincodeStubInterface, sources []Source, limit int, bookmark string) ([]byte, error) {
+	at := cursor{}
+	if len(sources) > 0 {
+		at.Kind = sources[0].Kind
+	}
+	if bookmark != "" {
+		var err error
+		at, err = parseBookmark(bookmark)
+		if err != nil {
+			return nil, err
+		}
+	}
+	page := Line{Kind: PageKind, Start: at.Checksum}
+
+	var lines []Line
+	i := sourceIndex(sources, at.Kind)
+	if bookmark != "" && i < 0 {
+		return nil, errs.New(errs.InvalidArgument, "Not a snapshot bookmark: "+bookmark)
+	}
+	for i >= 0 && i < len(sources) && len(lines) < limit {
+		room := limit - len(lines)
+		records, err := sources[i].Records(stub, at.Key, room)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range records {
+			line.Kind = sources[i].Kind
+			at.Key = line.Key
+			at.Checksum = Chain(at.Checksum, line)
+			lines = append(lines, line)
+		}
+		if len(records) < room { //this kind is done, the next one starts from its first record
+			i++
+			at.Key = ""
+			if i < len(sources) {
+				at.Kind = sources[i].Kind
+			}
+		}
+	}
+	page.Checksum = at.Checksum
+	if i >= 0 && i < len(sources) {
+		page.Bookmark = at.bookmark()
+	}
+
+	var out bytes.Buffer
+	for _, line := range append(lines, page) {
+		lineAsBytes, _ := json.Marshal(line)
+		out.Write(lineAsBytes)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
+
+func sourceIndex(sources []Source, kind string) int {
+	for i, source := range sources {
+		if source.Kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// Decode reads the records of a snapshot, one page or several in a row. A page line has to match the records
+// before it and pick up where the page before it ended, so a snapshot that was cut short, reordered or edited
+// is refused before anything is written, and so is a record with no page line after it.
+func Decode(data []byte) ([]Line, error) {
+	var records []Line
+	pageStart := 0 //records before this one belong to earlier pages
+	pages := 0
+	last := "" //checksum the page before ended with
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var line Line
+		err := json.Unmarshal(text, &line)
+		if err != nil || line.Kind == "" {
+			return nil, errs.New(errs.InvalidArgument, "Line "+strconv.Itoa(n)+" is not a snapshot line")
+		}
+		if line.Kind != PageKind {
+			if line.Key == "" || len(line.Record) == 0 {
+				return nil, errs.New(errs.InvalidArgument, "Line "+strconv.Itoa(n)+" has no key or record")
+			}
+			records = append(records, line)
+			continue
+		}
+		if pages > 0 && line.Start != last {
+			return nil, errs.New(errs.InvalidArgument, "Page ending on line "+strconv.Itoa(n)+" does not follow the page before it")
+		}
+		expected := line.Start
+		for _, record := range records[pageStart:] {
+			expected = Chain(expected, record)
+		}
+		if expected != line.Checksum {
+			return nil, errs.New(errs.InvalidArgument, "Checksum mismatch on line "+strconv.Itoa(n)+", the page is incomplete or was changed")
+		}
+		pageStart = len(records)
+		pages++
+		last = line.Checksum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs.New(errs.InvalidArgument, "Failed to read snapshot: "+err.Error())
+	}
+	if pageStart < len(records) {
+		return nil, errs.New(errs.InvalidArgument, "Record "+records[pageStart].Key+" has no page line after it, the snapshot was cut short")
+	}
+	return records, nil
+}
+
+// Importer validates and stores one record, it reports false when the ledger already held the record as it is
+type Importer func(stub shim.ChaincodeStubInterface, line Line) (bool, error)
+
+// Result is what an import did
+type Result struct {
+	Records   int `json:"records"`   //records in the snapshot
+	Imported  int `json:"imported"`  //records written
+	Unchanged int `json:"unchanged"` //records the ledger already held as they are
+}
+
+// Import stores every record of a snapshot with the importer of its kind, importing the same snapshot twice
+// leaves the ledger as the first import did
+func Import(stub shim.ChaincodeStubInterface, data []byte, importers map[string]Importer) (Result, error) {
+	var result Result
+	records, err := Decode(data)
+	if err != nil {
+		return result, err
+	}
+	for i, line := range records {
+		importer, ok := importers[line.Kind]
+		if !ok {
+			return result, errs.New(errs.InvalidArgument, "Record "+strconv.Itoa(i+1)+" is of unknown kind "+line.Kind)
+		}
+		changed, err := importer(stub, line)
+		if err != nil {
+			return result, errs.Prefix(line.Kind+" "+line.Key+": ", err)
+		}
+		result.Records++
+		if changed {
+			result.Imported++
+		} else {
+			result.Unchanged++
+		}
+	}
+	return result, nil
+}
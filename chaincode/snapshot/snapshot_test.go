@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+// sliceSource serves sorted keys with a record naming each
+func sliceSource(kind string, keys ...string) Source {
+	sort.Strings(keys)
+	return Source{Kind: kind, Records: func(stub shim.ChaincodeStubInterface, after string, limit int) ([]Line, error) {
+		lines := []Line{}
+		for _, key := range keys {
+			if key > after && len(lines) < limit {
+				lines = append(lines, Line{Key: key, Record: json.RawMessage(`{"name":"` + key + `"}`)})
+			}
+		}
+		return lines, nil
+	}}
+}
+
+var testSources = []Source{sliceSource("user", "alice", "bob"), sliceSource("marble", "m1", "m2", "m3")}
+
+// exportAll pages through the sources and returns every page and the last page line
+func exportAll(t *testing.T, limit int) ([]byte, Line) {
+	t.Helper()
+	var all []byte
+	var last Line
+	for i := 0; i < 20; i++ {
+		page, err := Export(nil, testSources, limit, last.Bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, page...)
+		lines := strings.Split(strings.TrimSpace(string(page)), "\n")
+		if len(lines) > limit+1 {
+			t.Fatalf("page of %d lines, asked for %d records", len(lines), limit)
+		}
+		last = Line{}
+		json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+		if last.Kind != PageKind {
+			t.Fatalf("page does not end with a page line: %s", page)
+		}
+		if last.Bookmark == "" {
+			return all, last
+		}
+	}
+	t.Fatal("export never ended")
+	return nil, last
+}
+
+func TestExport(t *testing.T) {
+	whole, wholePage := exportAll(t, 100)
+	for _, limit := range []int{1, 2, 5} {
+		paged, last := exportAll(t, limit)
+		if last.Checksum != wholePage.Checksum {
+			t.Errorf("checksum in pages of %d = %s, in one page %s", limit, last.Checksum, wholePage.Checksum)
+		}
+		records, err := Decode(paged)
+		if err != nil {
+			t.Fatalf("pages of %d don't decode: %s", limit, err)
+		}
+		if len(records) != 5 || records[0].Kind != "user" || records[0].Key != "alice" || records[4].Kind != "marble" || records[4].Key != "m3" {
+			t.Errorf("records in pages of %d = %+v", limit, records)
+		}
+	}
+	if again, _ := exportAll(t, 100); !bytes.Equal(again, whole) {
+		t.Errorf("export is not deterministic:\n%s\n%s", whole, again)
+	}
+	if _, err := Export(nil, testSources, 2, "nope"); errs.CodeOf(err) != errs.InvalidArgument {
+		t.Errorf("export from a bad bookmark = %v", err)
+	}
+}
+
+func TestDecodeRefusesChangedSnapshots(t *testing.T) {
+	paged, _ := exportAll(t, 2)
+	lines := strings.SplitAfter(string(paged), "\n")
+
+	edited := strings.Replace(string(paged), `"name":"m2"`, `"name":"m9"`, 1)
+	dropped := strings.Join(append(append([]string{}, lines[:1]...), lines[2:]...), "") //first page lost a record
+	skipped := strings.Join(append(append([]string{}, lines[:3]...), lines[6:]...), "") //second page is missing
+	truncated := strings.Join(lines[:len(lines)-2], "")                                 //last page line is missing
+	bare := "{\"kind\":\"user\",\"key\":\"bob\",\"record\":{}}\n\n"                     //records need a page line after them
+	for name, data := range map[string]string{"edited": edited, "dropped": dropped, "skipped": skipped, "truncated": truncated,
+		"bare": bare, "garbage": "{nope\n"} {
+		if _, err := Decode([]byte(data)); errs.CodeOf(err) != errs.InvalidArgument {
+			t.Errorf("%s snapshot decoded, err %v", name, err)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	paged, _ := exportAll(t, 2)
+	importers := map[string]Importer{
+		"user": func(stub shim.ChaincodeStubInterface, line Line) (bool, error) {
+			return false, nil
+		},
+		"marble": func(stub shim.ChaincodeStubInterface, line Line) (bool, error) {
+			if line.Key == "m2" {
+				return false, errs.New(errs.Conflict, "taken")
+			}
+			return true, nil
+		},
+	}
+	_, err := Import(nil, paged, importers)
+	if err == nil || errs.CodeOf(err) != errs.Conflict || errs.From(err).Message != "marble m2: taken" {
+		t.Errorf("import = %v", err)
+	}
+
+	delete(importers, "marble")
+	if _, err = Import(nil, paged, importers); errs.CodeOf(err) != errs.InvalidArgument {
+		t.Errorf("import of an unknown kind = %v", err)
+	}
+
+	importers["marble"] = func(stub shim.ChaincodeStubInterface, line Line) (bool, error) { return true, nil }
+	result, err := Import(nil, paged, importers)
+	if err != nil || result != (Result{Records: 5, Imported: 3, Unchanged: 2}) {
+		t.Errorf("result = %+v, err %v", result, err)
+	}
+}
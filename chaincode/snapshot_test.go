@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/snapshot"
+)
+
+// exportState pages through export_state as the admin, returning every page and the checksum of the last one
+func exportState(t *testing.T, cc *SimpleChaincode, stub *memStub, pageSize string) ([]byte, string) {
+	t.Helper()
+	caller := stub.caller
+	defer stub.as(caller)
+	stub.as(testAdmin)
+
+	var all []byte
+	bookmark := ""
+	for i := 0; i < 100; i++ {
+		page, err := stub.query(cc, "export_state", pageSize, bookmark)
+		if err != nil {
+			t.Fatalf("export_state failed: %s", err)
+		}
+		all = append(all, page...)
+		lines := strings.Split(strings.TrimSpace(string(page)), "\n")
+		var last snapshot.Line
+		json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+		if last.Bookmark == "" {
+			return all, last.Checksum
+		}
+		bookmark = last.Bookmark
+	}
+	t.Fatal("export_state never ended")
+	return nil, ""
+}
+
+// seedSnapshotState gives bob an escrowed trade and alice a plain one on top of seedMarbles
+func seedSnapshotState(t *testing.T, cc *SimpleChaincode, stub *memStub) {
+	t.Helper()
+	seedMarbles(t, cc, stub)
+	mustInvokeAs(t, stub, cc, "bob", "open_trade", "bob", "green", "16", "escrow", "b1")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "red", "35", "green", "16")
+	mustInvokeAs(t, stub, cc, "alice", "update_user", "alice", "Alice Liddell")
+}
+
+func importResult(t *testing.T, res []byte) snapshot.Result {
+	t.Helper()
+	var result snapshot.Result
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("import_state returned %s: %s", res, err)
+	}
+	return result
+}
+
+func TestExportImportState(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedSnapshotState(t, cc, stub)
+	whole, checksum := exportState(t, cc, stub, "")
+	paged, pagedChecksum := exportState(t, cc, stub, "2")
+	if pagedChecksum != checksum {
+		t.Errorf("checksum in pages of 2 = %s, in one page %s", pagedChecksum, checksum)
+	}
+	if again, _ := exportState(t, cc, stub, ""); !bytes.Equal(again, whole) {
+		t.Errorf("export_state is not deterministic:\n%s\n%s", whole, again)
+	}
+	records, err := snapshot.Decode(whole)
+	if err != nil || len(records) != 9 { //4 users, 3 marbles, 2 trades
+		t.Fatalf("export_state = %s, err %v", whole, err)
+	}
+
+	//a ledger on another network gets the same state from the pages
+	cc2, stub2 := newTestChaincode(t)
+	stub2.as(testAdmin)
+	result := importResult(t, mustInvoke(t, stub2, cc2, "import_state", string(paged)))
+	if result != (snapshot.Result{Records: 9, Imported: 6, Unchanged: 3}) { //only alice's name differs from the users there
+		t.Errorf("import_state = %+v", result)
+	}
+	if restored, restoredChecksum := exportState(t, cc2, stub2, ""); restoredChecksum != checksum || !bytes.Equal(restored, whole) {
+		t.Errorf("restored ledger exports\n%s\nnot\n%s", restored, whole)
+	}
+	if b1 := storedMarble(t, stub2, "b1"); b1.LockedBy != tradeID(t, stub, 0) {
+		t.Errorf("b1 should still be escrowed, got %+v", b1)
+	}
+	if history := queryHistory(t, stub2, cc2, "b1"); len(history) != 1 || history[0].Reason != reasonImport || history[0].NewOwner != "bob" {
+		t.Errorf("b1 history = %+v", history)
+	}
+	res, _ := stub2.query(cc2, "marbles_by_owner", "bob")
+	if !strings.Contains(string(res), `"b2"`) {
+		t.Errorf("imported marbles should be indexed, marbles_by_owner bob = %s", res)
+	}
+	res, _ = stub2.query(cc2, "trades_by_opener", "alice")
+	if !strings.Contains(string(res), `"want":{"color":"red","size":35}`) {
+		t.Errorf("imported trades should be indexed, trades_by_opener alice = %s", res)
+	}
+
+	//importing again changes nothing
+	result = importResult(t, mustInvoke(t, stub2, cc2, "import_state", string(whole)))
+	if result != (snapshot.Result{Records: 9, Imported: 0, Unchanged: 9}) {
+		t.Errorf("second import_state = %+v", result)
+	}
+
+	//records that moved on are brought back, indexes and all
+	mustInvokeAs(t, stub2, cc2, "bob", "set_user", "b2", "carol")
+	mustInvokeAs(t, stub2, cc2, "bob", "remove_trade", tradeID(t, stub, 0))
+	result = importResult(t, mustInvoke(t, stub2, cc2, "import_state", string(whole)))
+	if result.Imported != 2 { //b2 and the trade, which locks b1 again
+		t.Errorf("import_state over changed records = %+v", result)
+	}
+	if restored, _ := exportState(t, cc2, stub2, ""); !bytes.Equal(restored, whole) {
+		t.Errorf("re-imported ledger exports\n%s\nnot\n%s", restored, whole)
+	}
+	res, _ = stub2.query(cc2, "marbles_by_owner", "carol")
+	if strings.Contains(string(res), `"b2"`) {
+		t.Errorf("b2 should have left carol's index, got %s", res)
+	}
+}
+
+func TestImportMarblePageBeforeTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedSnapshotState(t, cc, stub)
+	escrow := tradeID(t, stub, 0)
+	whole, _ := exportState(t, cc, stub, "")
+	pages := map[string][]string{} //pages of one record by kind
+	stub.as(testAdmin)
+	for bookmark, more := "", true; more; {
+		page, err := stub.query(cc, "export_state", "1", bookmark)
+		if err != nil {
+			t.Fatalf("export_state failed: %s", err)
+		}
+		records, err := snapshot.Decode(page)
+		if err != nil || len(records) > 1 {
+			t.Fatalf("export_state page = %s, err %v", page, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(page)), "\n")
+		var last snapshot.Line
+		json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+		if len(records) == 1 {
+			pages[records[0].Kind] = append(pages[records[0].Kind], string(page))
+		}
+		bookmark, more = last.Bookmark, last.Bookmark != ""
+	}
+
+	cc2, stub2 := newTestChaincode(t)
+	stub2.as(testAdmin)
+	for _, page := range append(pages["user"], pages["marble"]...) {
+		mustInvoke(t, stub2, cc2, "import_state", page)
+	}
+	if b1 := storedMarble(t, stub2, "b1"); b1.LockedBy != "" {
+		t.Errorf("b1 should wait unlocked for its trade, got %+v", b1)
+	}
+	mustInvokeAs(t, stub2, cc2, "bob", "set_user", "b1", "carol") //and nothing holds it in the meantime
+	mustInvokeAs(t, stub2, cc2, "carol", "set_user", "b1", "bob")
+
+	for _, page := range append(pages["marble"], pages["trade"]...) {
+		mustInvoke(t, stub2, cc2, "import_state", page)
+	}
+	if b1 := storedMarble(t, stub2, "b1"); b1.LockedBy != escrow {
+		t.Errorf("the trade should lock b1 when it arrives, got %+v", b1)
+	}
+	for _, page := range pages["marble"] { //now the lock holds
+		if result := importResult(t, mustInvoke(t, stub2, cc2, "import_state", page)); result.Unchanged != 1 {
+			t.Errorf("marble page imported again = %+v", result)
+		}
+	}
+	if restored, _ := exportState(t, cc2, stub2, ""); !bytes.Equal(restored, whole) {
+		t.Errorf("ledger imported page by page exports\n%s\nnot\n%s", restored, whole)
+	}
+}
+
+func TestExportStateUnlocksAuctionedMarbles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	startTestAuction(t, stub, cc, "2")
+	whole, _ := exportState(t, cc, stub, "")
+	if !strings.Contains(string(whole), `"name":"b1","color":"blue","size":16,"user":"bob","schema"`) {
+		t.Errorf("b1 should be exported without its auction lock:\n%s", whole)
+	}
+}
+
+func TestExportImportStateErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedSnapshotState(t, cc, stub)
+	whole, _ := exportState(t, cc, stub, "")
+
+	stub.as("bob")
+	if _, err := stub.query(cc, "export_state"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("export_state by bob = %v", err)
+	}
+	mustBeUnauthorized(t, stub, cc, "import_state", string(whole))
+	stub.as(testAdmin)
+	for _, args := range [][]string{{"0"}, {"x"}, {"201"}, {"1", "nope"}, {"1", "", "2"}} {
+		if _, err := stub.query(cc, "export_state", args...); errs.CodeOf(err) != errs.InvalidArgument {
+			t.Errorf("export_state%v = %v", args, err)
+		}
+	}
+	mustFail(t, stub, cc, "import_state")
+
+	cc2, stub2 := newTestChaincode(t)
+	stub2.as(testAdmin)
+	for name, data := range map[string]string{
+		"tampered":      strings.Replace(string(whole), `"size":35`, `"size":36`, 1),
+		"unknown owner": `{"kind":"marble","key":"z1","record":{"name":"z1","color":"blue","size":16,"user":"zed"}}`,
+		"bad color":     `{"kind":"marble","key":"z1","record":{"name":"z1","color":"plaid","size":16,"user":"bob"}}`,
+		"wrong key":     `{"kind":"marble","key":"z2","record":{"name":"z1","color":"blue","size":16,"user":"bob"}}`,
+		"newer schema":  `{"kind":"marble","key":"z1","record":{"name":"z1","color":"blue","size":16,"user":"bob","schema":99}}`,
+		"unknown kind":  `{"kind":"auction","key":"a","record":{}}`,
+		"bad user":      `{"kind":"user","key":"Zed","record":{"id":"Zed","name":"Zed"}}`,
+		"not escrowed":  `{"kind":"marble","key":"z1","record":{"name":"z1","color":"blue","size":16,"user":"bob"}}` + "\n" + `{"kind":"trade","key":"t1","record":{"id":"t1","user":"bob","want":{"color":"red","size":35},"willing":[{"color":"blue","size":16}],"escrow":["z1"]}}`,
+		"nothing given": `{"kind":"trade","key":"t1","record":{"id":"t1","user":"bob","want":{"color":"red","size":35},"willing":[]}}`,
+	} {
+		err := mustFail(t, stub2, cc2, "import_state", data)
+		if code := errs.CodeOf(err); code != errs.InvalidArgument && code != errs.NotFound && code != errs.Conflict {
+			t.Errorf("%s import_state = %v", name, err)
+		}
+	}
+	if _, err := stub2.query(cc2, "get_marble", "z1"); err == nil {
+		t.Error("a failed import_state should not leave marbles behind")
+	}
+
+	//a key taken by something other than a marble is not overwritten
+	stub2.state["b1"] = []byte("not a marble")
+	err := mustFail(t, stub2, cc2, "import_state", string(whole))
+	if errs.CodeOf(err) != errs.AlreadyExists || !strings.Contains(err.Error(), "marble b1") {
+		t.Errorf("import_state over a non marble = %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/events"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+// every open trade has its own key so trade transactions on different trades don't touch the same state,
+// _opentrades, the single key all trades used to share, is only read by the migration
+var tradeStr = "trade~id"                    //composite key type of open trades
+var tradeOpenerIndexStr = "opener~id"        //index of open trades by opener
+var tradeWantIndexStr = "want~color~size~id" //index of open trades by wanted color and size
+
+type TradePage struct {
+	Trades   []AnOpenTrade `json:"trades"`   //trades in this page, ordered by id
+	Bookmark string        `json:"bookmark"` //pass back to get the next page, empty when there are no more
+}
+
+func tradeKey(id string) (string, error) {
+	return createCompositeKey(tradeStr, []string{id})
+}
+
+// tradeIndexKeys are the index entries of a trade, opener and want never change so neither do they
+func tradeIndexKeys(open AnOpenTrade) ([]string, error) {
+	openerKey, err := createCompositeKey(tradeOpenerIndexStr, []string{normalizeUserID(open.User), open.tradeID()})
+	if err != nil {
+		return nil, err
+	}
+	wantKey, err := createCompositeKey(tradeWantIndexStr, []string{strings.ToLower(open.Want.Color), strconv.Itoa(open.Want.Size), open.tradeID()})
+	if err != nil {
+		return nil, err
+	}
+	return []string{openerKey, wantKey}, nil
+}
+
+// ============================================================================================================================
+// Get Trade - read an open trade by id
+// ============================================================================================================================
+func getTrade(stub shim.ChaincodeStubInterface, id string) (AnOpenTrade, error) {
+	var open AnOpenTrade
+	key, err := tradeKey(id)
+	if err != nil {
+		return open, err
+	}
+	tradeAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return open, errs.New(errs.Internal, "Failed to get trade "+id)
+	}
+	if tradeAsBytes == nil {
+		return open, errs.New(errs.NotFound, "Open trade not found: "+id)
+	}
+	open, err = parseTrade(tradeAsBytes)
+	if err != nil {
+		return open, errs.New(errs.Internal, "Corrupt trade record for "+id)
+	}
+	return open, nil
+}
+
+// parseTrade un stringifies a stored trade, records of older versions are read as the current one
+func parseTrade(tradeAsBytes []byte) (AnOpenTrade, error) {
+	var open AnOpenTrade
+	tradeAsBytes, _, err := tradeSchema.Upgrade(tradeAsBytes)
+	if err != nil {
+		return open, err
+	}
+	err = json.Unmarshal(tradeAsBytes, &open)
+	return open, err
+}
+
+// ============================================================================================================================
+// Put Trade - store an open trade and its index entries, also used to update one
+// ============================================================================================================================
+func putTrade(stub shim.ChaincodeStubInterface, open AnOpenTrade) error {
+	key, err := tradeKey(open.tradeID())
+	if err != nil {
+		return err
+	}
+	open.Schema = tradeSchema.Current()
+	jsonAsBytes, _ := json.Marshal(open)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return err
+	}
+	keys, err := tradeIndexKeys(open)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Delete Trade - remove an open trade and its index entries
+// ============================================================================================================================
+func deleteTrade(stub shim.ChaincodeStubInterface, open AnOpenTrade) error {
+	key, err := tradeKey(open.tradeID())
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	keys, err := tradeIndexKeys(open)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byOpening orders trades the way they were opened
+type byOpening []AnOpenTrade
+
+func (b byOpening) Len() int      { return len(b) }
+func (b byOpening) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byOpening) Less(i, j int) bool {
+	if b[i].Timestamp != b[j].Timestamp {
+		return b[i].Timestamp < b[j].Timestamp
+	}
+	return b[i].tradeID() < b[j].tradeID()
+}
+
+// ============================================================================================================================
+// Get All Trades - every open trade, in the order they were opened
+// ============================================================================================================================
+func getAllTrades(stub shim.ChaincodeStubInterface) (AllTrades, error) {
+	var trades AllTrades
+	iter, err := getStateByPartialCompositeKey(stub, tradeStr, []string{})
+	if err != nil {
+		return trades, errs.New(errs.Internal, "Failed to get open trades")
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		_, tradeAsBytes, err := iter.Next()
+		if err != nil {
+			return trades, errs.New(errs.Internal, "Failed to get open trades")
+		}
+		open, err := parseTrade(tradeAsBytes)
+		if err != nil {
+			return trades, errs.New(errs.Internal, "Corrupt trade record")
+		}
+		trades.OpenTrades = append(trades.OpenTrades, open)
+	}
+	sort.Stable(byOpening(trades.OpenTrades))
+	return trades, nil
+}
+
+// getTrades reads the trades with these ids, ids of trades that are gone are skipped
+func getTrades(stub shim.ChaincodeStubInterface, ids []string) ([]AnOpenTrade, error) {
+	trades := []AnOpenTrade{}
+	for _, id := range ids {
+		open, err := getTrade(stub, id)
+		if err != nil {
+			if errs.CodeOf(err) == errs.NotFound { //stale index entry
+				logFor(stub).Warning("skipping stale index entry", "trade", id)
+				continue
+			}
+			return nil, err
+		}
+		trades = append(trades, open)
+	}
+	sort.Stable(byOpening(trades))
+	return trades, nil
+}
+
+// ============================================================================================================================
+// Migrate Trades - move the trades of the legacy _opentrades key to their own keys, returns how many moved
+// ============================================================================================================================
+func migrateTrades(stub shim.ChaincodeStubInterface) (int, error) {
+	tradesAsBytes, err := stub.GetState(openTradesStr)
+	if err != nil {
+		return 0, errs.New(errs.Internal, "Failed to get legacy open trades")
+	}
+	if tradesAsBytes == nil {
+		return 0, nil
+	}
+	var legacy AllTrades
+	if len(tradesAsBytes) > 0 {
+		err = json.Unmarshal(tradesAsBytes, &legacy)
+		if err != nil {
+			return 0, errs.New(errs.Internal, "Corrupt legacy open trades")
+		}
+	}
+	for _, open := range legacy.OpenTrades {
+		open.ID = open.tradeID() //trades from before ids keep the timestamp clients know them by
+		err = putTrade(stub, open)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = stub.DelState(openTradesStr)
+	if err != nil {
+		return 0, err
+	}
+	if len(legacy.OpenTrades) > 0 {
+		logFor(stub).Info("trades migrated", "trades", strconv.Itoa(len(legacy.OpenTrades)))
+	}
+	return len(legacy.OpenTrades), nil
+}
+
+// ============================================================================================================================
+// Migrate Trades (invoke) - run the trade migration on a live ledger, operator only, init runs it too
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_trades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := t.authorizeRole(stub, roles.Operator, "migrate trades")
+	if err != nil {
+		return nil, err
+	}
+	moved, err := migrateTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.Itoa(moved)), nil
+}
+
+// ============================================================================================================================
+// List Open Trades (query) - return a page of open trades ordered by id, starting after the bookmark
+// ============================================================================================================================
+func (t *SimpleChaincode) list_open_trades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	pageSize := defaultPageSize
+	bookmark := ""
+
+	//   0*      1*
+	// "20", "bookmark"
+	if len(args) > 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting page size and bookmark")
+	}
+	if len(args) > 0 && args[0] != "" {
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			return nil, errs.Arg(0, "1st argument must be a page size between 1 and "+strconv.Itoa(maxPageSize))
+		}
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	startKey, err := createCompositeKey(tradeStr, []string{})
+	if err != nil {
+		return nil, err
+	}
+	endKey := startKey + string(maxUnicodeRuneValue)
+	if bookmark != "" {
+		startKey, err = tradeKey(bookmark)
+		if err != nil {
+			return nil, errs.WithArg(err, 1)
+		}
+	}
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get open trades")
+	}
+	defer iter.Close()
+
+	page := TradePage{Trades: []AnOpenTrade{}}
+	for iter.HasNext() {
+		_, tradeAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get open trades")
+		}
+		open, err := parseTrade(tradeAsBytes)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt trade record")
+		}
+		if open.tradeID() == bookmark { //the range starts at the bookmark itself
+			continue
+		}
+		if len(page.Trades) == pageSize { //there is at least one more
+			page.Bookmark = page.Trades[pageSize-1].tradeID()
+			break
+		}
+		page.Trades = append(page.Trades, open)
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// Trades By Opener (query) - every open trade of a user, read from the opener index
+// ============================================================================================================================
+func (t *SimpleChaincode) trades_by_opener(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	ids, err := indexedNames(stub, tradeOpenerIndexStr, []string{normalizeUserID(args[0])})
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get opener index")
+	}
+	trades, err := getTrades(stub, ids)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(trades)
+}
+
+// ============================================================================================================================
+// Trades By Want (query) - every open trade wanting a color and size, read from the want index
+// ============================================================================================================================
+func (t *SimpleChaincode) trades_by_want(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	// "blue", "16"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting color and size")
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errs.Arg(1, "2nd argument must be a numeric string")
+	}
+	ids, err := indexedNames(stub, tradeWantIndexStr, []string{strings.ToLower(strings.TrimSpace(args[0])), strconv.Itoa(size)})
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get want index")
+	}
+	trades, err := getTrades(stub, ids)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(trades)
+}
+
+// ============================================================================================================================
+// Clean Up Open Trades - recheck the trades of every owner who gave up marbles in this invocation
+// ============================================================================================================================
+// A trade only becomes impossible when its opener loses marbles, so transferMarble and Delete note the owners as they go
+// and only their trades are read off the opener index. Trades of everybody else are never read, an expired trade of an
+// owner who keeps their marbles stays until expire_trades sweeps it or somebody tries to perform it.
+func cleanTrades(stub shim.ChaincodeStubInterface) error {
+	return cleanTradesOf(stub, touchedOwners(stub))
+}
+
+// touchOwner notes an owner who gave up a marble in the running invocation
+func touchOwner(stub shim.ChaincodeStubInterface, owner string) {
+	es, ok := stub.(*eventStub)
+	if !ok { //outside of an invocation nobody cleans up after it
+		return
+	}
+	if es.touched == nil {
+		es.touched = map[string]bool{}
+	}
+	es.touched[normalizeUserID(owner)] = true
+}
+
+// touchedOwners are the owners who gave up a marble in the running invocation, in name order
+func touchedOwners(stub shim.ChaincodeStubInterface) []string {
+	es, ok := stub.(*eventStub)
+	if !ok { //outside of an invocation nothing is recorded
+		return nil
+	}
+	owners := []string{}
+	for owner := range es.touched {
+		if owner != "" {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// ============================================================================================================================
+// Clean Trades Of - make sure these owners' open trades are still possible, remove choices that are no longer possible,
+// remove trades that have no valid choices
+// ============================================================================================================================
+func cleanTradesOf(stub shim.ChaincodeStubInterface, owners []string) error {
+	log := logFor(stub)
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+
+	for _, owner := range owners {
+		ids, err := indexedNames(stub, tradeOpenerIndexStr, []string{owner})
+		if err != nil {
+			return errs.New(errs.Internal, "Failed to get opener index")
+		}
+		trades, err := getTrades(stub, ids)
+		if err != nil {
+			return err
+		}
+		log.Debug("cleaning open trades", "user", owner, "trades", strconv.Itoa(len(trades)))
+
+		var available map[Description]int //the owner's free marbles, read once and only if a trade needs them
+		for _, open := range trades {
+			var didWork = false //only trades that changed are written, the others stay untouched
+			if open.isExpired(now) {
+				didWork = true
+				open.Willing = nil
+			}
+
+			willing := []Description{}
+			for _, option := range open.Willing { //keep the options the opener can still give
+				possible := false
+				if len(open.Escrow) > 0 { //escrowed trades settle with their own marbles
+					_, e := openersMarbles4Trade(stub, open, option.Color, option.Size, option.count())
+					possible = e == nil
+				} else {
+					if available == nil {
+						available, err = availableMarbles(stub, owner)
+						if err != nil {
+							return err
+						}
+					}
+					possible = available[Description{Color: strings.ToLower(option.Color), Size: option.Size}] >= option.count()
+				}
+				if !possible {
+					log.Debug("dropping a trade option", "trade", open.tradeID(), "color", option.Color, "size", strconv.Itoa(option.Size))
+					didWork = true
+					continue
+				}
+				willing = append(willing, option)
+			}
+
+			if len(willing) == 0 {
+				err = releaseEscrow(stub, open) //whatever is still locked goes back to the owner
+				if err != nil {
+					return err
+				}
+				err = deleteTrade(stub, open)
+				if err != nil {
+					return err
+				}
+				reason := events.RemovedStale
+				if open.isExpired(now) {
+					reason = events.RemovedExpiry
+				}
+				emit(stub, tradeRemoved(open, reason))
+				log.Info("trade removed", "trade", open.tradeID(), "user", open.User, "reason", reason)
+			} else if didWork {
+				open.Willing = willing
+				err = putTrade(stub, open) //rewrite just this trade
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// availableMarbles counts the marbles a user could trade away by lower case color and size, escrowed marbles don't count
+func availableMarbles(stub shim.ChaincodeStubInterface, user string) (map[Description]int, error) {
+	names, err := marbleNamesByOwner(stub, user)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get owner index")
+	}
+	available := map[Description]int{}
+	for _, name := range names {
+		marbleAsBytes, err := stub.GetState(name)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get marble")
+		}
+		if marbleAsBytes == nil { //stale index entry
+			continue
+		}
+		marble, err := parseMarble(name, marbleAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		if marble.LockedBy != "" || normalizeUserID(marble.User) != user {
+			continue
+		}
+		available[Description{Color: strings.ToLower(marble.Color), Size: marble.Size}]++
+	}
+	return available, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+func queryTrades(t *testing.T, stub *memStub, cc *SimpleChaincode, function string, args ...string) []AnOpenTrade {
+	t.Helper()
+	res, err := stub.query(cc, function, args...)
+	if err != nil {
+		t.Fatalf("%s%v failed: %s", function, args, err)
+	}
+	var trades []AnOpenTrade
+	if err := json.Unmarshal(res, &trades); err != nil {
+		t.Fatalf("%s%v returned %s: %s", function, args, res, err)
+	}
+	return trades
+}
+
+func TestTradesHaveTheirOwnKeys(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	first := tradeID(t, stub, 0)
+
+	//a trade transaction only writes the trade it is about
+	stub.begin()
+	_, err := cc.Invoke(stub, "open_trade", []string{"bob", "white", "16", "red", "35"})
+	if err != nil {
+		t.Fatalf("open_trade failed: %s", err)
+	}
+	second := stub.txID
+	if _, ok := stub.pending[openTradesStr]; ok {
+		t.Error("open_trade should not write the legacy trade blob")
+	}
+	if _, ok := stub.pending[tradeKeyOf(t, first)]; ok {
+		t.Error("open_trade should not rewrite other trades")
+	}
+	stub.end(nil)
+
+	stub.begin()
+	_, err = cc.Invoke(stub, "remove_trade", []string{second})
+	if err != nil {
+		t.Fatalf("remove_trade failed: %s", err)
+	}
+	if _, ok := stub.pending[tradeKeyOf(t, first)]; ok {
+		t.Error("remove_trade should not rewrite other trades")
+	}
+	stub.end(nil)
+
+	if trades := getOpenTrades(t, stub); len(trades) != 1 || trades[0].ID != first {
+		t.Errorf("trades = %+v, want only %s", trades, first)
+	}
+}
+
+func TestMigrateTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.state[openTradesStr] = []byte(`{"open_trades":[` +
+		`{"user":"bob","timestamp":1475000000000,"want":{"color":"green","size":16},"willing":[{"color":"blue","size":16}]},` +
+		`{"id":"tx1","user":"bob","timestamp":1475000000001,"want":{"color":"white","size":16},"willing":[{"color":"red","size":35}]}]}`)
+
+	stub.as("bob")
+	mustBeUnauthorized(t, stub, cc, "migrate_trades")
+
+	//a redeploy migrates, and leaves nothing behind to migrate twice
+	mustInvokeAs(t, stub, cc, testAdmin, "init")
+	if _, ok := stub.state[openTradesStr]; ok {
+		t.Error("migration should remove the legacy blob")
+	}
+	trades := getOpenTrades(t, stub)
+	if len(trades) != 2 || trades[0].ID != "1475000000000" || trades[1].ID != "tx1" {
+		t.Fatalf("trades = %+v", trades)
+	}
+	if res := mustInvokeAs(t, stub, cc, testAdmin, "migrate_trades"); string(res) != "0" {
+		t.Errorf("second migration moved %s trades", res)
+	}
+	if got := queryTrades(t, stub, cc, "trades_by_want", "Green", "16"); len(got) != 1 || got[0].ID != "1475000000000" {
+		t.Errorf("migrated trades should be indexed, got %+v", got)
+	}
+
+	stub.state[openTradesStr] = []byte("{not json")
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "migrate_trades")
+}
+
+func TestListOpenTrades(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	for i := 0; i < 5; i++ {
+		mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	}
+
+	var seen []string
+	bookmark := ""
+	for pages := 0; pages < 10; pages++ {
+		res, err := stub.query(cc, "list_open_trades", "2", bookmark)
+		if err != nil {
+			t.Fatalf("list_open_trades failed: %s", err)
+		}
+		var page TradePage
+		if err := json.Unmarshal(res, &page); err != nil {
+			t.Fatalf("list_open_trades returned %s: %s", res, err)
+		}
+		if len(page.Trades) > 2 {
+			t.Fatalf("page of %d trades, want at most 2", len(page.Trades))
+		}
+		for _, open := range page.Trades {
+			seen = append(seen, open.ID)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if len(seen) != 5 {
+		t.Errorf("paged through %v, want 5 trades", seen)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i-1] >= seen[i] {
+			t.Errorf("trades out of order: %v", seen)
+		}
+	}
+
+	for _, args := range [][]string{{"0"}, {"x"}, {"201"}, {"1", "b", "c"}} {
+		if _, err := stub.query(cc, "list_open_trades", args...); err == nil {
+			t.Errorf("list_open_trades%q should fail", args)
+		}
+	}
+}
+
+func TestTradesByOpenerAndWant(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "white", "16", "red", "35")
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "open_trade", "alice", "blue", "16", "green", "16")
+
+	if got := queryTrades(t, stub, cc, "trades_by_opener", " Bob "); len(got) != 2 || got[0].Want.Color != "green" || got[1].Want.Color != "white" {
+		t.Errorf("bob's trades = %+v", got)
+	}
+	if got := queryTrades(t, stub, cc, "trades_by_want", "blue", "16"); len(got) != 1 || got[0].User != "alice" {
+		t.Errorf("trades wanting blue 16 = %+v", got)
+	}
+	if got := queryTrades(t, stub, cc, "trades_by_want", "blue", "35"); len(got) != 0 {
+		t.Errorf("trades wanting blue 35 = %+v", got)
+	}
+
+	//closed trades leave the indexes
+	mustInvoke(t, stub, cc, "remove_trade", tradeID(t, stub, 2))
+	if got := queryTrades(t, stub, cc, "trades_by_opener", "alice"); len(got) != 0 {
+		t.Errorf("alice's trades after remove = %+v", got)
+	}
+
+	if _, err := stub.query(cc, "trades_by_want", "blue"); err == nil {
+		t.Error("trades_by_want without a size should fail")
+	}
+	if _, err := stub.query(cc, "trades_by_want", "blue", "big"); err == nil {
+		t.Error("trades_by_want with a bad size should fail")
+	}
+}
+
+// openOtherTrades gives n more users a marble and an open trade for it, trades cleaning should never have to read
+func openOtherTrades(tb testing.TB, cc *SimpleChaincode, stub *memStub, n int) {
+	caller := stub.caller
+	defer stub.as(caller)
+	for i := 0; i < n; i++ {
+		user := "user" + strconv.Itoa(i)
+		stub.as(user) //users register themselves
+		for _, call := range [][]string{
+			{"register_user", user},
+			{"init_marble", "m" + strconv.Itoa(i), "red", "35", user},
+			{"open_trade", user, "green", "16", "red", "35"},
+		} {
+			if _, err := stub.invoke(cc, call[0], call[1:]...); err != nil {
+				tb.Fatalf("%s%v failed: %s", call[0], call[1:], err)
+			}
+		}
+	}
+}
+
+// readsToTransfer is how many reads giving away bob's red 35 takes, which makes his trade stale
+func readsToTransfer(t *testing.T, others int) int {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "red", "35")
+	openOtherTrades(t, cc, stub, others)
+
+	stub.as("bob")
+	before := stub.reads
+	mustInvoke(t, stub, cc, "set_user", "b2", "alice")
+	reads := stub.reads - before
+	if trades := getOpenTrades(t, stub); len(trades) != others {
+		t.Fatalf("bob's trade should be removed and the others kept, got %d trades", len(trades))
+	}
+	return reads
+}
+
+func TestCleanTradesOnlyReadsTouchedOwners(t *testing.T) {
+	small, large := readsToTransfer(t, 5), readsToTransfer(t, 50)
+	if small != large {
+		t.Errorf("a transfer read %d keys with 5 other trades and %d with 50", small, large)
+	}
+}
+
+func TestTouchedOwners(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.begin()
+	defer stub.end(nil)
+	es := &eventStub{ChaincodeStubInterface: stub}
+	touchOwner(es, "Bob")
+	touchOwner(es, "alice")
+	touchOwner(es, "bob")
+	emit(es, marbleTransferred("b2", "carol", "dave", reasonTransfer, "")) //events alone touch nobody
+	if got := touchedOwners(es); len(got) != 2 || got[0] != "alice" || got[1] != "bob" {
+		t.Errorf("touchedOwners = %v, want [alice bob]", got)
+	}
+	touchOwner(stub, "carol")
+	if got := touchedOwners(stub); len(got) != 0 {
+		t.Errorf("touchedOwners outside an invocation = %v", got)
+	}
+}
+
+func TestMovesTouchTheirOwners(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	stub.begin()
+	es := &eventStub{ChaincodeStubInterface: stub}
+	if err := transferMarble(es, "b1", "carol", reasonTransfer, ""); err != nil {
+		t.Fatalf("transferMarble failed: %s", err)
+	}
+	stub.end(nil)
+	stub.as("alice")
+	stub.begin()
+	deleted := &eventStub{ChaincodeStubInterface: stub}
+	if _, err := cc.Delete(deleted, []string{"a1"}); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	stub.end(nil)
+	if got := touchedOwners(es); len(got) != 1 || got[0] != "bob" {
+		t.Errorf("a transfer should touch its previous owner, got %v", got)
+	}
+	if got := touchedOwners(deleted); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("a delete should touch the owner, got %v", got)
+	}
+}
+
+func BenchmarkCleanTrades(b *testing.B) {
+	for _, others := range []int{10, 100, 1000} {
+		b.Run(strconv.Itoa(others)+"_other_trades", func(b *testing.B) {
+			cc, stub := new(SimpleChaincode), newMemStub()
+			stub.as(testAdmin)
+			if _, err := stub.deploy(cc); err != nil {
+				b.Fatal(err)
+			}
+			stub.as("bob")
+			for _, call := range [][]string{
+				{"register_user", "bob"},
+				{"init_marble", "b1", "blue", "16", "bob"},
+				{"init_marble", "b2", "blue", "16", "bob"},
+				{"open_trade", "bob", "green", "16", "blue", "16"},
+			} {
+				if _, err := stub.invoke(cc, call[0], call[1:]...); err != nil {
+					b.Fatalf("%s%v failed: %s", call[0], call[1:], err)
+				}
+			}
+			openOtherTrades(b, cc, stub, others)
+
+			//bob gives a marble away and keeps his trade, every other trade stays unread
+			stub.begin()
+			es := &eventStub{ChaincodeStubInterface: stub}
+			emit(es, marbleTransferred("b1", "bob", "alice", reasonTransfer, ""))
+			before := stub.reads
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := cleanTrades(es); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.Logf("%d reads per clean", (stub.reads-before)/b.N)
+			stub.end(nil)
+		})
+	}
+}
+
+func TestFailedCleanFailsTheInvocation(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	stub.failGet[tradeKeyOf(t, tradeID(t, stub, 0))] = true
+
+	_, err := stub.invoke(cc, "set_user", "b1", "alice")
+	mustFailWith(t, err, errs.Internal, -1)
+	if storedMarble(t, stub, "b1").User != "bob" {
+		t.Error("a transfer whose trades could not be cleaned should be rolled back")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+var userStr = "user~id" //composite key type of the user registry
+
+type User struct {
+	ID   string `json:"id"`   //canonical id, trimmed and lower case
+	Name string `json:"name"` //display name, as the user typed it
+}
+
+// ============================================================================================================================
+// Normalize User ID - the canonical form of a user id, "  Bob " and "bob" are the same user
+// ============================================================================================================================
+func normalizeUserID(id string) string {
+	return roles.NormalizeID(id)
+}
+
+func userKey(id string) (string, error) {
+	return createCompositeKey(userStr, []string{normalizeUserID(id)})
+}
+
+// ============================================================================================================================
+// Get User - read a registered user
+// ============================================================================================================================
+func getUser(stub shim.ChaincodeStubInterface, id string) (User, error) {
+	var user User
+	key, err := userKey(id)
+	if err != nil {
+		return user, err
+	}
+	userAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return user, errs.New(errs.Internal, "Failed to get user "+id)
+	}
+	if userAsBytes == nil {
+		return user, errs.New(errs.NotFound, "Unknown user: "+id)
+	}
+	err = json.Unmarshal(userAsBytes, &user)
+	if err != nil {
+		return user, errs.New(errs.Internal, "Corrupt user record for "+id)
+	}
+	return user, nil
+}
+
+// ============================================================================================================================
+// Require User - the canonical id of a registered user, or an error if nobody by that id is registered
+// ============================================================================================================================
+func requireUser(stub shim.ChaincodeStubInterface, id string) (string, error) {
+	user, err := getUser(stub, id)
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+func putUser(stub shim.ChaincodeStubInterface, user User) error {
+	key, err := userKey(user.ID)
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(user)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Register User - add a user to the registry, users register themselves or an admin registers them
+// ============================================================================================================================
+func (t *SimpleChaincode) register_user(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1*
+	// "bob", "Bob Smith"
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id and optional display name")
+	}
+	id := normalizeUserID(args[0])
+	if len(id) <= 0 {
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
+	}
+	if strings.ContainsAny(id, " \t\r\n") {
+		return nil, errs.Arg(0, "User id cannot contain whitespace")
+	}
+	name := strings.TrimSpace(args[0])
+	if len(args) > 1 && strings.TrimSpace(args[1]) != "" {
+		name = strings.TrimSpace(args[1])
+	}
+	err := t.guard().AuthorizeUserOrRole(stub, id, roles.Admin, "register user "+id)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := userKey(id)
+	if err != nil {
+		return nil, err
+	}
+	userAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get user "+id)
+	}
+	if userAsBytes != nil {
+		return nil, errs.New(errs.AlreadyExists, "This user already exists: "+id)
+	}
+
+	err = putUser(stub, User{ID: id, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Update User - change the display name of a user, only the user can do this
+// ============================================================================================================================
+func (t *SimpleChaincode) update_user(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0        1
+	// "bob", "Bobby"
+	if len(args) != 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id and display name")
+	}
+	if len(strings.TrimSpace(args[1])) <= 0 {
+		return nil, errs.Arg(1, "2nd argument must be a non-empty string")
+	}
+
+	user, err := getUser(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.authorizeUser(stub, user.ID, "update user "+user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Name = strings.TrimSpace(args[1])
+	err = putUser(stub, user)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get User (query) - return a registered user
+// ============================================================================================================================
+func (t *SimpleChaincode) get_user(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting user id")
+	}
+	user, err := getUser(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(user)
+}
+
+// ============================================================================================================================
+// List Users - return every registered user ordered by id
+// ============================================================================================================================
+func (t *SimpleChaincode) list_users(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	iter, err := getStateByPartialCompositeKey(stub, userStr, []string{})
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get users")
+	}
+	defer iter.Close()
+
+	users := []User{}
+	for iter.HasNext() {
+		_, userAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Failed to get users")
+		}
+		var user User
+		err = json.Unmarshal(userAsBytes, &user)
+		if err != nil {
+			return nil, errs.New(errs.Internal, "Corrupt user record")
+		}
+		users = append(users, user)
+	}
+	return json.Marshal(users)
+}
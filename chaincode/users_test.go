@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+func queryUser(t *testing.T, stub *memStub, cc *SimpleChaincode, id string) User {
+	t.Helper()
+	res, err := stub.query(cc, "get_user", id)
+	if err != nil {
+		t.Fatalf("get_user %s failed: %s", id, err)
+	}
+	var user User
+	if err := json.Unmarshal(res, &user); err != nil {
+		t.Fatalf("get_user %s returned %s: %s", id, res, err)
+	}
+	return user
+}
+
+func TestRegisterUser(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as("erin")
+	mustInvoke(t, stub, cc, "register_user", " Erin ")
+	if got := queryUser(t, stub, cc, "ERIN"); got != (User{ID: "erin", Name: "Erin"}) {
+		t.Errorf("erin = %+v", got)
+	}
+	mustInvokeAs(t, stub, cc, testAdmin, "register_user", "frank", "Frank Jones") //admins register anybody
+	if got := queryUser(t, stub, cc, "frank"); got.Name != "Frank Jones" {
+		t.Errorf("frank = %+v", got)
+	}
+
+	for _, args := range [][]string{{}, {""}, {"  "}, {"a b"}, {"erin"}, {"ERIN", "Other Erin"}, {"x", "y", "z"}, {"bad\x00id"}} {
+		if _, err := stub.invoke(cc, "register_user", args...); err == nil {
+			t.Errorf("register_user%v should fail", args)
+		}
+	}
+
+	//nobody squats an id they don't own
+	for _, caller := range []string{"alice", ""} {
+		stub.as(caller)
+		_, err := stub.invoke(cc, "register_user", "grace")
+		mustFailWith(t, err, errs.Unauthorized, -1)
+	}
+	if _, err := stub.query(cc, "get_user", "grace"); err == nil {
+		t.Error("grace should not be registered")
+	}
+
+	if _, err := stub.query(cc, "get_user", "nobody"); err == nil {
+		t.Error("get_user of an unknown user should fail")
+	}
+	if _, err := stub.query(cc, "get_user"); err == nil {
+		t.Error("get_user without args should fail")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as("alice")
+	err := mustFail(t, stub, cc, "update_user", "bob", "Robert")
+	if !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("unexpected error %s", err)
+	}
+	mustFail(t, stub, cc, "update_user", "nobody", "X")
+	mustFail(t, stub, cc, "update_user", "alice", " ")
+	mustFail(t, stub, cc, "update_user", "alice")
+
+	mustInvoke(t, stub, cc, "update_user", "Alice", "Alice Cooper")
+	if got := queryUser(t, stub, cc, "alice"); got != (User{ID: "alice", Name: "Alice Cooper"}) {
+		t.Errorf("alice = %+v", got)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvokeAs(t, stub, cc, "aaron", "register_user", "Aaron")
+
+	res, err := stub.query(cc, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []User
+	json.Unmarshal(res, &users)
+	var ids []string
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	if strings.Join(ids, ",") != "aaron,alice,bob,carol,dave" {
+		t.Errorf("list_users = %s", res)
+	}
+}
+
+func TestUnknownUsersAreRejected(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+	mustInvoke(t, stub, cc, "open_trade", "bob", "green", "16", "blue", "16")
+	id := tradeID(t, stub, 0)
+
+	mustFail(t, stub, cc, "init_marble", "m1", "blue", "16", "mallory")
+	stub.as("bob")
+	mustFail(t, stub, cc, "set_user", "b1", "mallory")
+	mustFail(t, stub, cc, "open_trade", "mallory", "green", "16", "blue", "16")
+	stub.as("alice")
+	mustFail(t, stub, cc, "perform_trade", id, "alice", "a1", "mallory", "blue", "16")
+	mustFail(t, stub, cc, "perform_trade", id, "mallory", "a1", "bob", "blue", "16")
+}
+
+func TestUserIDsAreNormalized(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedMarbles(t, cc, stub)
+
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "set_user", "b1", " Alice")
+	if got := storedMarble(t, stub, "b1").User; got != "alice" {
+		t.Errorf("b1 owner = %q, want alice", got)
+	}
+
+	mustInvoke(t, stub, cc, "open_trade", "BOB", "green", "16", "red", "35")
+	if got := getOpenTrades(t, stub)[0].User; got != "bob" {
+		t.Errorf("trade opener = %q, want bob", got)
+	}
+	id := tradeID(t, stub, 0)
+
+	stub.as("alice")
+	mustInvoke(t, stub, cc, "perform_trade", id, "ALICE", "a1", "Bob", "red", "35")
+	if storedMarble(t, stub, "b2").User != "alice" || storedMarble(t, stub, "a1").User != "bob" {
+		t.Error("trade between differently cased ids should go through")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+)
+
+var marbleRulesStr = "_marblerules" //name for the key/value that stores the marble validation rules
+
+type MarbleRules struct {
+	Colors        []string `json:"colors"`          //allowed colors, css color names in lower case
+	MinSize       int      `json:"min_size"`        //smallest marble size
+	MaxSize       int      `json:"max_size"`        //largest marble size
+	MaxNameLength int      `json:"max_name_length"` //longest marble name
+}
+
+// defaultMarbleRules match what the UI can create
+var defaultMarbleRules = MarbleRules{
+	Colors:        []string{"white", "black", "red", "green", "blue", "purple", "pink", "orange", "yellow"},
+	MinSize:       1,
+	MaxSize:       100,
+	MaxNameLength: 64,
+}
+
+// ============================================================================================================================
+// Get Marble Rules - the validation rules in use, the defaults until an admin sets others
+// ============================================================================================================================
+func getMarbleRules(stub shim.ChaincodeStubInterface) (MarbleRules, error) {
+	rulesAsBytes, err := stub.GetState(marbleRulesStr)
+	if err != nil {
+		return MarbleRules{}, errs.New(errs.Internal, "Failed to get marble rules")
+	}
+	if len(rulesAsBytes) == 0 {
+		return defaultMarbleRules, nil
+	}
+	var rules MarbleRules
+	err = json.Unmarshal(rulesAsBytes, &rules)
+	if err != nil {
+		return MarbleRules{}, errs.New(errs.Internal, "Corrupt marble rules")
+	}
+	return rules, nil
+}
+
+// check makes sure the rules themselves make sense
+func (r MarbleRules) check() error {
+	if len(r.Colors) == 0 {
+		return errs.New(errs.InvalidArgument, "Marble rules need at least one color")
+	}
+	for _, color := range r.Colors {
+		if color == "" || strings.Trim(color, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return errs.New(errs.InvalidArgument, "Marble rule colors must be lower case css color names: "+color)
+		}
+	}
+	if r.MinSize < 1 || r.MaxSize < r.MinSize {
+		return errs.New(errs.InvalidArgument, "Marble rules need 1 <= min_size <= max_size")
+	}
+	if r.MaxNameLength < 1 {
+		return errs.New(errs.InvalidArgument, "Marble rules need a max_name_length of at least 1")
+	}
+	return nil
+}
+
+// validName checks a marble name, letters, digits, '-', '_' and '.' starting with a letter or digit
+// "ttl" is taken, open_trade would read an escrowed marble of that name as the start of a time to live
+func (r MarbleRules) validName(name string) error {
+	if len(name) == 0 || len(name) > r.MaxNameLength {
+		return errs.New(errs.InvalidArgument, "Marble name must be 1 to "+strconv.Itoa(r.MaxNameLength)+" characters long")
+	}
+	if name == ttlMarker {
+		return errs.New(errs.InvalidArgument, "Marble name "+strconv.Quote(name)+" is reserved")
+	}
+	for i, c := range name {
+		alnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !alnum && (i == 0 || (c != '-' && c != '_' && c != '.')) {
+			return errs.New(errs.InvalidArgument, "Marble name may only hold letters, digits, '-', '_' and '.' and must start with a letter or digit: "+strconv.Quote(name))
+		}
+	}
+	return nil
+}
+
+// validColor normalizes a color and checks it is allowed
+func (r MarbleRules) validColor(color string) (string, error) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	for _, allowed := range r.Colors {
+		if color == allowed {
+			return color, nil
+		}
+	}
+	return "", errs.New(errs.InvalidArgument, "Color "+strconv.Quote(color)+" is not allowed, expecting one of "+strings.Join(r.Colors, ", "))
+}
+
+// validSize checks a size is within bounds
+func (r MarbleRules) validSize(size int) error {
+	if size < r.MinSize || size > r.MaxSize {
+		return errs.New(errs.InvalidArgument, "Size must be between "+strconv.Itoa(r.MinSize)+" and "+strconv.Itoa(r.MaxSize))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Validate Marble - build a marble from raw input, every field checked against the rules and the owner registered
+// errors blame the argument in init_marble's order, name color size user
+// ============================================================================================================================
+func validateMarble(stub shim.ChaincodeStubInterface, name string, color string, size string, user string) (Marble, error) {
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return Marble{}, err
+	}
+	return rules.validMarble(stub, name, color, size, user)
+}
+
+// validMarble is validateMarble against rules already read, batches read them once
+func (r MarbleRules) validMarble(stub shim.ChaincodeStubInterface, name string, color string, size string, user string) (Marble, error) {
+	var marble Marble
+	err := r.validName(name)
+	if err != nil {
+		return marble, errs.WithArg(err, 0)
+	}
+	marble.Name = name
+	marble.Color, err = r.validColor(color)
+	if err != nil {
+		return marble, errs.WithArg(err, 1)
+	}
+	marble.Size, err = strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		return marble, errs.Arg(2, "Size must be a numeric string")
+	}
+	err = r.validSize(marble.Size)
+	if err != nil {
+		return marble, errs.WithArg(err, 2)
+	}
+	marble.User, err = requireUser(stub, user)
+	if err != nil {
+		return marble, errs.WithArg(err, 3)
+	}
+	return marble, nil
+}
+
+// validateDescription checks the color and size of a trade description given as arguments arg and arg+1
+func validateDescription(rules MarbleRules, d Description, arg int) (Description, error) {
+	var err error
+	d.Color, err = rules.validColor(d.Color)
+	if err != nil {
+		return d, errs.WithArg(err, arg)
+	}
+	err = rules.validSize(d.Size)
+	if err != nil {
+		return d, errs.WithArg(err, arg+1)
+	}
+	return d, nil
+}
+
+// ============================================================================================================================
+// Set Marble Rules - replace the validation rules, admin only, marbles that already exist are left alone
+// ============================================================================================================================
+func (t *SimpleChaincode) set_marble_rules(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// '{"colors": ["red", "blue"], "min_size": 1, "max_size": 50, "max_name_length": 32}'
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting the rules as json")
+	}
+	err := t.authorizeAdmin(stub, "set marble rules")
+	if err != nil {
+		return nil, err
+	}
+	var rules MarbleRules
+	err = json.Unmarshal([]byte(args[0]), &rules)
+	if err != nil {
+		return nil, errs.Arg(0, "Marble rules are not valid json: "+err.Error())
+	}
+	err = putMarbleRules(stub, rules)
+	if err != nil {
+		return nil, errs.WithArg(err, 0)
+	}
+	return nil, nil
+}
+
+// putMarbleRules normalizes the colors, checks the rules and stores them
+func putMarbleRules(stub shim.ChaincodeStubInterface, rules MarbleRules) error {
+	for i := range rules.Colors {
+		rules.Colors[i] = strings.ToLower(strings.TrimSpace(rules.Colors[i]))
+	}
+	err := rules.check()
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(rules)
+	return stub.PutState(marbleRulesStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Marble Rules (query) - return the validation rules in use
+// ============================================================================================================================
+func (t *SimpleChaincode) get_marble_rules(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	rules, err := getMarbleRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rules)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInitMarbleValidation(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	//json breaking input is rejected instead of concatenated into state
+	bad := [][]string{
+		{`a"b`, "blue", "16", "bob"},
+		{"a\\b", "blue", "16", "bob"},
+		{"-a", "blue", "16", "bob"},
+		{"", "blue", "16", "bob"},
+		{strings.Repeat("a", 65), "blue", "16", "bob"},
+		{"a1", `blue","user":"eve`, "16", "bob"},
+		{"a1", "grey", "16", "bob"},
+		{"a1", "blue", "0", "bob"},
+		{"a1", "blue", "101", "bob"},
+		{"a1", "blue", "16x", "bob"},
+		{"a1", "blue", "16", "eve"},
+	}
+	for _, args := range bad {
+		if _, err := stub.invoke(cc, "init_marble", args...); err == nil {
+			t.Errorf("init_marble%q should fail", args)
+		}
+	}
+	if _, ok := stub.state["a1"]; ok {
+		t.Error("rejected marble was written")
+	}
+
+	//color, size and user are normalized
+	mustInvoke(t, stub, cc, "init_marble", "a1.x_2-b", " Blue ", " 16", " Bob ")
+	want := Marble{Name: "a1.x_2-b", Color: "blue", Size: 16, User: "bob", Schema: marbleSchema.Current()}
+	if got := storedMarble(t, stub, "a1.x_2-b"); got != want {
+		t.Errorf("marble = %+v, want %+v", got, want)
+	}
+
+	//names already holding other state are not overwritten
+	mustInvokeAs(t, stub, cc, testAdmin, "write", "taken", "something")
+	if _, err := stub.invoke(cc, "init_marble", "taken", "blue", "16", "bob"); err == nil {
+		t.Error("init_marble over a non-marble key should fail")
+	}
+	if string(stub.state["taken"]) != "something" {
+		t.Errorf("taken = %s", stub.state["taken"])
+	}
+}
+
+func TestMarbleRules(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "dave", "admin")
+	stub.as("dave")
+
+	res, err := stub.query(cc, "get_marble_rules")
+	if err != nil {
+		t.Fatalf("get_marble_rules failed: %s", err)
+	}
+	var rules MarbleRules
+	if err := json.Unmarshal(res, &rules); err != nil || !reflect.DeepEqual(rules, defaultMarbleRules) {
+		t.Fatalf("get_marble_rules = %s, %v", res, err)
+	}
+
+	stub.as("alice")
+	if _, err := stub.invoke(cc, "set_marble_rules", `{"colors":["grey"],"min_size":1,"max_size":5,"max_name_length":8}`); err == nil {
+		t.Error("set_marble_rules by a non admin should fail")
+	}
+	stub.as("dave")
+	for _, bad := range []string{
+		`not json`,
+		`{"colors":[],"min_size":1,"max_size":5,"max_name_length":8}`,
+		`{"colors":["gr ey"],"min_size":1,"max_size":5,"max_name_length":8}`,
+		`{"colors":["grey"],"min_size":6,"max_size":5,"max_name_length":8}`,
+		`{"colors":["grey"],"min_size":1,"max_size":5,"max_name_length":0}`,
+	} {
+		if _, err := stub.invoke(cc, "set_marble_rules", bad); err == nil {
+			t.Errorf("set_marble_rules %s should fail", bad)
+		}
+	}
+	mustInvoke(t, stub, cc, "set_marble_rules", `{"colors":[" Grey "],"min_size":1,"max_size":5,"max_name_length":8}`)
+
+	mustInvoke(t, stub, cc, "init_marble", "g1", "grey", "5", "bob")
+	for _, args := range [][]string{
+		{"b1", "blue", "5", "bob"},
+		{"g2", "grey", "6", "bob"},
+		{"g123456789", "grey", "5", "bob"},
+	} {
+		if _, err := stub.invoke(cc, "init_marble", args...); err == nil {
+			t.Errorf("init_marble%q should fail under the new rules", args)
+		}
+	}
+
+	//trades are held to the same rules
+	stub.as("bob")
+	if _, err := stub.invoke(cc, "open_trade", "bob", "blue", "5", "grey", "5"); err == nil {
+		t.Error("open_trade wanting a disallowed color should fail")
+	}
+	if _, err := stub.invoke(cc, "open_trade", "bob", "grey", "5", "grey", "9"); err == nil {
+		t.Error("open_trade willing a disallowed size should fail")
+	}
+	mustInvoke(t, stub, cc, "open_trade", "bob", "Grey", "4", "grey", "5")
+	if trade := getOpenTrades(t, stub)[0]; trade.Want.Color != "grey" {
+		t.Errorf("want = %+v", trade.Want)
+	}
+}
+
+func TestCorruptStateIsReported(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_marble", "b1", "blue", "16", "bob")
+
+	mustInvokeAs(t, stub, cc, testAdmin, "write", tradeKeyOf(t, "t1"), "{not json")
+	stub.as("bob")
+	if _, err := stub.invoke(cc, "remove_trade", "t1"); err == nil || !strings.Contains(err.Error(), "Corrupt") {
+		t.Errorf("remove_trade of a corrupt trade: %v", err)
+	}
+	if _, err := stub.invoke(cc, "expire_trades"); err == nil || !strings.Contains(err.Error(), "Corrupt") {
+		t.Errorf("expire_trades over a corrupt trade: %v", err)
+	}
+
+	mustInvokeAs(t, stub, cc, testAdmin, "write", marbleIndexStr, "{not json")
+	if _, err := stub.invoke(cc, "init_marble", "b2", "blue", "16", "bob"); err == nil {
+		t.Error("init_marble over a corrupt index should fail")
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+
+// guard checks callers against the role table, the checks and role functions are shared with the marbles chaincode
+func (t *SimpleChaincode) guard() roles.Guard {
+	return roles.Guard{Identity: t.Identity, Log: logFor}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+)
+
+var defaultLogLevel = logging.Info                   //log level until one is set
+var logger = logging.New(os.Stdout, defaultLogLevel) //lines from outside an invocation, every invocation derives its logger from it
+
+// logFor is the logger of the running invocation, the package logger outside of one
+func logFor(stub shim.ChaincodeStubInterface) *logging.Logger {
+	return logging.For(stub, logger)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+)
+
+var migrationStr = "_migration" //name for the key/value that stores how far migrate_state got
+var migrationBatch = 20         //scrutins migrate_state upgrades when no batch size is given
+var maxMigrationBatch = 200     //most scrutins one migrate_state upgrades
+
+// schema versions of the stored records, a struct that changes shape gets a migration registered here.
+// scrutins carry copies of their votes, so a new vote version needs a scrutin migration that upgrades the copies too
+var voteSchema = schema.NewRegistry("vote").
+	Register(0, schema.Initial)
+var scrutinSchema = schema.NewRegistry("scrutin").
+	Register(0, upgradeScrutinVotes)
+
+// upgradeScrutinVotes brings the votes a scrutin carries up to the current vote version
+func upgradeScrutinVotes(r schema.Record) error {
+	var votes []json.RawMessage
+	err := r.Get("votes", &votes)
+	if err != nil || votes == nil {
+		return err
+	}
+	for i := range votes {
+		votes[i], _, err = voteSchema.Upgrade(votes[i])
+		if err != nil {
+			return err
+		}
+	}
+	return r.Set("votes", votes)
+}
+
+// ============================================================================================================================
+// Read Scrutin - the scrutin stored under name at the current schema version, an unset name is an empty scrutin
+// ============================================================================================================================
+func readScrutin(stub shim.ChaincodeStubInterface, name string) (Scrutin, error) {
+	res := Scrutin{}
+	scrutinAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return res, errs.New(errs.Internal, "Failed to get scrutin name")
+	}
+	scrutinAsBytes, err = upgradeIfRecord(scrutinSchema, scrutinAsBytes)
+	if err != nil {
+		return res, err
+	}
+	if len(scrutinAsBytes) == 0 {
+		return res, nil
+	}
+	err = json.Unmarshal(scrutinAsBytes, &res) //un stringify it aka JSON.parse()
+	if err != nil {
+		return res, errs.New(errs.Internal, "Corrupt scrutin record for "+name)
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// Read Vote - the vote stored under name at the current schema version, an unset name is an empty vote
+// ============================================================================================================================
+func readVote(stub shim.ChaincodeStubInterface, name string) (AVote, error) {
+	res := AVote{}
+	voteAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return res, errs.New(errs.Internal, "Failed to get vote name")
+	}
+	voteAsBytes, err = upgradeIfRecord(voteSchema, voteAsBytes)
+	if err != nil {
+		return res, err
+	}
+	if len(voteAsBytes) == 0 {
+		return res, nil
+	}
+	err = json.Unmarshal(voteAsBytes, &res) //un stringify it aka JSON.parse()
+	if err != nil {
+		return res, errs.New(errs.Internal, "Corrupt vote record for "+name)
+	}
+	return res, nil
+}
+
+// upgradeIfRecord upgrades values that are json objects, other values are left for the caller to not recognize
+func upgradeIfRecord(registry *schema.Registry, recordAsBytes []byte) ([]byte, error) {
+	if _, err := schema.VersionOf(recordAsBytes); err != nil {
+		return recordAsBytes, nil
+	}
+	upgraded, _, err := registry.Upgrade(recordAsBytes)
+	return upgraded, err
+}
+
+// recordKind tells a scrutin from a vote stored under name, anything else is neither
+func recordKind(name string, valAsBytes []byte) string {
+	var probe struct {
+		Name        string  `json:"name"`
+		Description *string `json:"description"` //only scrutins have one
+	}
+	if json.Unmarshal(valAsBytes, &probe) != nil || probe.Name != name {
+		return ""
+	}
+	if probe.Description != nil {
+		return scrutinSchema.Kind()
+	}
+	return voteSchema.Kind()
+}
+
+// upgradeForRead brings a scrutin or vote read by its name up to the current version, other values come back as they are
+func upgradeForRead(name string, valAsBytes []byte) []byte {
+	var registry *schema.Registry
+	switch recordKind(name, valAsBytes) {
+	case scrutinSchema.Kind():
+		registry = scrutinSchema
+	case voteSchema.Kind():
+		registry = voteSchema
+	default:
+		return valAsBytes
+	}
+	upgraded, _, err := registry.Upgrade(valAsBytes)
+	if err != nil {
+		return valAsBytes
+	}
+	return upgraded
+}
+
+// putScrutin stores a scrutin, and the copies of votes it carries, at the current schema versions
+func putScrutin(stub shim.ChaincodeStubInterface, scrutin Scrutin) error {
+	scrutin.Schema = scrutinSchema.Current()
+	votes := make([]AVote, len(scrutin.Votes))
+	for i, vote := range scrutin.Votes {
+		vote.Schema = voteSchema.Current()
+		votes[i] = vote
+	}
+	if scrutin.Votes != nil {
+		scrutin.Votes = votes
+	}
+	jsonAsBytes, _ := json.Marshal(scrutin)
+	err := stub.PutState(scrutin.Name, jsonAsBytes)
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to store scrutin "+scrutin.Name)
+	}
+	return nil
+}
+
+// putVote stores a vote at the current schema version
+func putVote(stub shim.ChaincodeStubInterface, vote AVote) error {
+	vote.Schema = voteSchema.Current()
+	jsonAsBytes, _ := json.Marshal(vote)
+	err := stub.PutState(vote.Name, jsonAsBytes)
+	if err != nil {
+		return errs.New(errs.Internal, "Failed to store vote "+vote.Name)
+	}
+	return nil
+}
+
+// migrationStages upgrades the scrutins in name order, each with the votes it lists
+var migrationStages = []schema.Stage{
+	{Kind: "scrutin", Keys: scrutinsAfter, Upgrade: upgradeScrutin},
+}
+
+// getScrutinIndex reads the names of every scrutin, an unset index is empty
+func getScrutinIndex(stub shim.ChaincodeStubInterface) ([]string, error) {
+	scrutinsAsBytes, err := stub.GetState(scrutinIndexStr)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get scrutin index")
+	}
+	var scrutinIndex []string
+	if len(scrutinsAsBytes) == 0 {
+		return scrutinIndex, nil
+	}
+	err = json.Unmarshal(scrutinsAsBytes, &scrutinIndex) //un stringify it aka JSON.parse()
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Corrupt scrutin index")
+	}
+	return scrutinIndex, nil
+}
+
+func scrutinsAfter(stub shim.ChaincodeStubInterface, after string, limit int) ([]string, error) {
+	scrutinIndex, err := getScrutinIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(scrutinIndex)
+	start := sort.SearchStrings(scrutinIndex, after)
+	for start < len(scrutinIndex) && scrutinIndex[start] <= after {
+		start++
+	}
+	end := start + limit
+	if end > len(scrutinIndex) {
+		end = len(scrutinIndex)
+	}
+	return scrutinIndex[start:end], nil
+}
+
+// upgradeScrutin rewrites a scrutin and the votes it lists at the current versions, true if anything was rewritten
+func upgradeScrutin(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	upgraded, err := upgradeRecord(stub, scrutinSchema, name)
+	if err != nil {
+		return false, err
+	}
+	scrutin, err := readScrutin(stub, name)
+	if err != nil { //a scrutin that can't be upgraded was logged, nor can the votes it lists be found
+		return upgraded, nil
+	}
+	for _, vote := range scrutin.Votes {
+		voteUpgraded, err := upgradeRecord(stub, voteSchema, vote.Name)
+		if err != nil {
+			return false, err
+		}
+		upgraded = upgraded || voteUpgraded
+	}
+	return upgraded, nil
+}
+
+// upgradeRecord rewrites the record under key at the current version of its registry, records that can't be
+// upgraded are logged and left alone so one bad record doesn't hold up the rest
+func upgradeRecord(stub shim.ChaincodeStubInterface, registry *schema.Registry, key string) (bool, error) {
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errs.New(errs.Internal, "Failed to get "+registry.Kind()+" "+key)
+	}
+	if recordAsBytes == nil { //listed but never stored
+		return false, nil
+	}
+	upgraded, changed, err := registry.Upgrade(recordAsBytes)
+	if err != nil {
+		logFor(stub).Warning("skipping a record that can't be upgraded", registry.Kind(), key, "error", errs.From(err).Message)
+		return false, nil
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, stub.PutState(key, upgraded)
+}
+
+// ============================================================================================================================
+// Migrate State - upgrade the next batch of scrutins and their votes to the current schema versions, admin only
+// call it until the progress it returns is done, reads upgrade whatever it hasn't gotten to yet on the fly
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	batch := migrationBatch
+
+	//   0*
+	// "50"
+	if len(args) > 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting batch size")
+	}
+	if len(args) > 0 && args[0] != "" {
+		batch, err = strconv.Atoi(args[0])
+		if err != nil || batch <= 0 || batch > maxMigrationBatch {
+			return nil, errs.Arg(0, "1st argument must be a batch size between 1 and "+strconv.Itoa(maxMigrationBatch))
+		}
+	}
+	err = t.guard().Authorize(stub, roles.Admin, "migrate state")
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := schema.Run(stub, migrationStr, []*schema.Registry{scrutinSchema, voteSchema}, migrationStages, batch)
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("state migrated", "batch", strconv.Itoa(progress.Batch), "scanned", strconv.Itoa(progress.Scanned),
+		"upgraded", strconv.Itoa(progress.Upgraded), "done", strconv.FormatBool(progress.Done))
+	return json.Marshal(progress)
+}
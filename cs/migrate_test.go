@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+)
+
+// seedLegacyState stores scrutins and votes the way chaincode versions before schema versions did
+func seedLegacyState(stub *memStub) {
+	for _, name := range []string{"s1", "s2", "s3"} {
+		stub.state[name] = []byte(`{"name":"` + name + `","description":"lunch","user":"bob","votes":[{"name":"` + name + `-pizza","users":null,"timestamp":1,"count":0}]}`)
+		stub.state[name+"-pizza"] = []byte(`{"name":"` + name + `-pizza","users":["alice"],"timestamp":1,"count":1}`)
+	}
+	stub.state[scrutinIndexStr] = []byte(`["s1","s2","s3"]`)
+}
+
+func storedVersion(t *testing.T, stub *memStub, key string) int {
+	t.Helper()
+	version, err := schema.VersionOf(stub.state[key])
+	if err != nil {
+		t.Fatalf("%q holds %s: %s", key, stub.state[key], err)
+	}
+	return version
+}
+
+func TestLegacyRecordsAreReadUpgraded(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedLegacyState(stub)
+
+	res, err := stub.query(cc, "read", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Scrutin
+	json.Unmarshal(res, &s)
+	if s.Schema != scrutinSchema.Current() || len(s.Votes) != 1 || s.Votes[0].Schema != voteSchema.Current() {
+		t.Errorf("read of a legacy scrutin = %s", res)
+	}
+	res, _ = stub.query(cc, "read", "s1-pizza")
+	var v AVote
+	json.Unmarshal(res, &v)
+	if v.Schema != voteSchema.Current() || v.Count != 1 {
+		t.Errorf("read of a legacy vote = %s", res)
+	}
+
+	//writes store the current version
+	mustInvoke(t, stub, cc, "add_vote", "s1-pizza", "bob")
+	if vote := getVote(t, stub, "s1-pizza"); vote.Count != 2 || vote.Schema != voteSchema.Current() {
+		t.Errorf("vote after add_vote = %+v", vote)
+	}
+	mustInvoke(t, stub, cc, "init_vote", "s2", "s2-sushi")
+	if storedVersion(t, stub, "s2") != scrutinSchema.Current() || storedVersion(t, stub, "s2-sushi") != voteSchema.Current() {
+		t.Errorf("init_vote should store current versions, s2 = %s", stub.state["s2"])
+	}
+
+	//records written by a chaincode newer than this one are left alone
+	stub.state["s3-pizza"] = []byte(`{"name":"s3-pizza","schema":99}`)
+	err = mustFail(t, stub, cc, "add_vote", "s3-pizza", "bob")
+	if errs.CodeOf(err) != errs.Internal {
+		t.Errorf("add_vote on a newer record = %v", err)
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedLegacyState(stub)
+	mustFail(t, stub, cc, "migrate_state")
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "migrate_state", "0")
+	mustFail(t, stub, cc, "migrate_state", "1", "2")
+
+	var progress schema.Progress
+	for i := 0; i < 10 && !progress.Done; i++ {
+		res := mustInvoke(t, stub, cc, "migrate_state", "2")
+		if err := json.Unmarshal(res, &progress); err != nil {
+			t.Fatalf("migrate_state returned %s: %s", res, err)
+		}
+		if progress.Batch > 2 {
+			t.Fatalf("batch of %d scrutins, asked for 2", progress.Batch)
+		}
+	}
+	if !progress.Done || progress.Scanned != 3 || progress.Upgraded != 3 {
+		t.Fatalf("progress = %+v", progress)
+	}
+	for _, name := range []string{"s1", "s2", "s3"} {
+		if storedVersion(t, stub, name) != scrutinSchema.Current() || storedVersion(t, stub, name+"-pizza") != voteSchema.Current() {
+			t.Errorf("%s or its vote was not upgraded", name)
+		}
+		if votes := getScrutin(t, stub, name).Votes; len(votes) != 1 || votes[0].Schema != voteSchema.Current() {
+			t.Errorf("%s's copy of its vote was not upgraded: %+v", name, votes)
+		}
+	}
+
+	stub.failGet["s1"] = true
+	delete(stub.state, migrationStr) //start over
+	mustFail(t, stub, cc, "migrate_state")
+}
+
+func TestCorruptRecordsAreErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	stub.state["s1"] = []byte("not json")
+	stub.state["s1-pizza"] = []byte("not json")
+
+	for _, call := range [][]string{
+		{"init_vote", "s1", "s1-pizza"},
+		{"add_vote", "s1-pizza", "bob"},
+	} {
+		if err := mustFail(t, stub, cc, call[0], call[1:]...); errs.CodeOf(err) != errs.Internal {
+			t.Errorf("%s%v on a corrupt record = %v", call[0], call[1:], err)
+		}
+	}
+
+	stub.state[scrutinIndexStr] = []byte("not json")
+	if err := mustFail(t, stub, cc, "init_scrutin", "s2", "lunch", "bob"); errs.CodeOf(err) != errs.Internal {
+		t.Errorf("init_scrutin with a corrupt index = %v", err)
+	}
+	stub.state[openScrutinStr] = []byte("not json")
+	if err := mustFail(t, stub, cc, "open_scrutin", "s2", "bob"); errs.CodeOf(err) != errs.Internal {
+		t.Errorf("open_scrutin with corrupt views = %v", err)
+	}
+}
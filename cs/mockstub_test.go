@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// memStub - in-memory shim.ChaincodeStubInterface for running the chaincode without a peer
+// ============================================================================================================================
+// Writes are buffered per transaction and only land in the committed state when the call succeeds, the same way a
+// peer throws away the state delta of a failed invocation. Reads see the pending writes of the current transaction.
+// Stub methods the chaincode never calls are left to the embedded nil interface and will panic if used.
+type memStub struct {
+	shim.ChaincodeStubInterface
+
+	state   map[string][]byte //committed key/values
+	pending map[string][]byte //writes of the running tx, nil value means deleted
+	txNum   int
+	txID    string
+	txTime  time.Time
+	caller  string //username attribute of the caller's certificate, also sent as caller metadata
+
+	failGet map[string]bool //keys that make GetState fail
+	failPut map[string]bool //keys that make PutState/DelState fail
+}
+
+func newMemStub() *memStub {
+	return &memStub{
+		state:   map[string][]byte{},
+		pending: map[string][]byte{},
+		txTime:  time.Date(2016, time.October, 1, 12, 0, 0, 0, time.UTC),
+		failGet: map[string]bool{},
+		failPut: map[string]bool{},
+	}
+}
+
+// begin starts a new transaction, every transaction is one second after the last one
+func (s *memStub) begin() {
+	s.txNum++
+	s.txID = "tx" + strconv.Itoa(s.txNum)
+	s.txTime = s.txTime.Add(time.Second)
+	s.pending = map[string][]byte{}
+}
+
+// as makes the following transactions come from this user
+func (s *memStub) as(user string) *memStub {
+	s.caller = user
+	return s
+}
+
+func (s *memStub) GetCallerMetadata() ([]byte, error) {
+	if s.caller == "" {
+		return nil, nil
+	}
+	return []byte(s.caller), nil
+}
+
+func (s *memStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	if attributeName != "username" || s.caller == "" {
+		return nil, errors.New("mock certificate has no attribute " + attributeName)
+	}
+	return []byte(s.caller), nil
+}
+
+// end commits the pending writes, or drops them if the transaction failed
+func (s *memStub) end(err error) {
+	if err == nil {
+		for k, v := range s.pending {
+			if v == nil {
+				delete(s.state, k)
+			} else {
+				s.state[k] = v
+			}
+		}
+	}
+	s.pending = map[string][]byte{}
+}
+
+func (s *memStub) GetTxID() string {
+	return s.txID
+}
+
+func (s *memStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.txTime.Unix(), Nanos: int32(s.txTime.Nanosecond())}, nil
+}
+
+func (s *memStub) GetState(key string) ([]byte, error) {
+	if s.failGet[key] {
+		return nil, errors.New("mock GetState failure for " + key)
+	}
+	if v, ok := s.pending[key]; ok {
+		return v, nil
+	}
+	return s.state[key], nil
+}
+
+func (s *memStub) PutState(key string, value []byte) error {
+	if s.failPut[key] {
+		return errors.New("mock PutState failure for " + key)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.pending[key] = value
+	return nil
+}
+
+func (s *memStub) DelState(key string) error {
+	if s.failPut[key] {
+		return errors.New("mock DelState failure for " + key)
+	}
+	s.pending[key] = nil
+	return nil
+}
+
+// RangeQueryState iterates over the keys in [startKey, endKey] in key order
+func (s *memStub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	seen := map[string]bool{}
+	var keys []string
+	add := func(k string) {
+		if !seen[k] && k >= startKey && k <= endKey {
+			if v, _ := s.GetState(k); v != nil {
+				keys = append(keys, k)
+			}
+			seen[k] = true
+		}
+	}
+	for k := range s.pending {
+		add(k)
+	}
+	for k := range s.state {
+		add(k)
+	}
+	sort.Strings(keys)
+	return &memIterator{stub: s, keys: keys}, nil
+}
+
+type memIterator struct {
+	stub *memStub
+	keys []string
+}
+
+func (it *memIterator) HasNext() bool {
+	return len(it.keys) > 0
+}
+
+func (it *memIterator) Next() (string, []byte, error) {
+	if len(it.keys) == 0 {
+		return "", nil, errors.New("no more keys")
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	value, err := it.stub.GetState(key)
+	return key, value, err
+}
+
+func (it *memIterator) Close() error {
+	return nil
+}
+
+// ============================================================================================================================
+// Helpers - run a function as its own transaction
+// ============================================================================================================================
+func (s *memStub) invoke(cc shim.Chaincode, function string, args ...string) ([]byte, error) {
+	s.begin()
+	res, err := cc.Invoke(s, function, args)
+	s.end(err)
+	return res, err
+}
+
+func (s *memStub) query(cc shim.Chaincode, function string, args ...string) ([]byte, error) {
+	s.begin()
+	res, err := cc.Query(s, function, args)
+	s.end(errors.New("queries never commit"))
+	return res, err
+}
+
+func mustInvoke(t *testing.T, s *memStub, cc shim.Chaincode, function string, args ...string) []byte {
+	t.Helper()
+	res, err := s.invoke(cc, function, args...)
+	if err != nil {
+		t.Fatalf("%s%v failed: %s", function, args, err)
+	}
+	return res
+}
+
+// mustInvokeAs is mustInvoke from another caller, the stub's caller is back to the previous one afterwards
+func mustInvokeAs(t *testing.T, s *memStub, cc shim.Chaincode, user string, function string, args ...string) []byte {
+	t.Helper()
+	caller := s.caller
+	defer s.as(caller)
+	s.as(user)
+	return mustInvoke(t, s, cc, function, args...)
+}
+
+func mustFail(t *testing.T, s *memStub, cc shim.Chaincode, function string, args ...string) error {
+	t.Helper()
+	_, err := s.invoke(cc, function, args...)
+	if err == nil {
+		t.Fatalf("%s%v should have failed", function, args)
+	}
+	return err
+}
@@ -3,16 +3,18 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/logging"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
 )
 
 type SimpleChaincode struct {
+	Identity roles.Resolver //resolves who is calling, nil means the username attribute of the caller's certificate
 }
 
 var scrutinIndexStr = "_scrutinindex" //name for the key/value that will store a list of all known marbles
@@ -24,6 +26,7 @@ type Scrutin struct {
 	Description string  `json:"description"`
 	User        string  `json:"user"`
 	Votes       []AVote `json:"votes"`
+	Schema      int     `json:"schema"` //schema version of the record, set when it is stored
 }
 
 type AnOpenScrutin struct {
@@ -41,6 +44,7 @@ type AVote struct {
 	Users     []string `json:"users"`     //user who created the open trade order
 	Timestamp int64    `json:"timestamp"` //utc timestamp of creation
 	Count     int      `json:"count"`
+	Schema    int      `json:"schema"` //schema version of the record, set when it is stored
 }
 
 /*type AllVotes struct {
@@ -53,7 +57,7 @@ type AVote struct {
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		logger.Error("failed to start the scrutin chaincode", "error", err.Error())
 	}
 }
 
@@ -65,42 +69,47 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 1")
 	}
 
 	// Initialize the chaincode
 	Aval, err = strconv.Atoi(args[0])
 	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
+		return nil, errs.Arg(0, "Expecting integer value for asset holding")
 	}
 
 	// Write the state to the ledger
 	err = stub.PutState("abc", []byte(strconv.Itoa(Aval))) //making a test var "abc", I find it handy to read/write to it right away to test the network
 	if err != nil {
-		return nil, err
+		return nil, errs.Wrap(err)
 	}
 
 	var empty []string
 	jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to clear the index
 	err = stub.PutState(scrutinIndexStr, jsonAsBytes)
 	if err != nil {
-		return nil, err
+		return nil, errs.Wrap(err)
 	}
 
 	var views AllScrutinViews
 	jsonAsBytes, _ = json.Marshal(views) //clear the open trade struct
 	err = stub.PutState(openScrutinStr, jsonAsBytes)
 	if err != nil {
-		return nil, err
+		return nil, errs.Wrap(err)
 	}
 
 	/*var votes AllVotes
 	jsonAsBytes, _ = json.Marshal(votes) //clear the votes struct
 	err = stub.PutState(voteIndexStr, jsonAsBytes)
 	if err != nil {
-		return nil, err
+		return nil, errs.Wrap(err)
 	}*/
 
+	err = t.guard().RecordAdmin(stub) //whoever deploys runs the admin functions
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
 	return nil, nil
 }
 
@@ -108,7 +117,6 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 // Run - Our entry point for Invocations - [LEGACY] obc-peer 4/25/2016
 // ============================================================================================================================
 func (t *SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
 	return t.Invoke(stub, function, args)
 }
 
@@ -116,12 +124,29 @@ func (t *SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string,
 // Invoke - Our entry point for Invocations
 // ============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
+	ls := logging.Begin(stub, logger, function)
+	ls.Log.Debug("invoke", "args", strings.Join(args, ","))
+
+	res, err := t.dispatch(ls, function, args)
+	if err != nil {
+		err = errs.Wrap(err) //clients always get a coded error
+		ls.Log.Warning("invoke failed", "code", string(errs.CodeOf(err)), "error", errs.From(err).Message)
+		return nil, err
+	}
+	return res, nil
+}
+
+// dispatch routes an invocation to its function
+func (t *SimpleChaincode) dispatch(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
 	// Handle different functions
-	if function == "init" { //initialize the chaincode state, used as reset
+	if function == "init" { //initialize the chaincode state, used as reset, admin only
+		err := t.guard().Authorize(stub, roles.Admin, "reset the ledger")
+		if err != nil {
+			return nil, err
+		}
 		return t.Init(stub, "init", args)
-	} else if function == "write" { //writes a value to the chaincode state
+	} else if function == "write" { //writes a value to the chaincode state, admin only
 		return t.Write(stub, args)
 	} else if function == "init_scrutin" { //create a new marble
 		return t.init_scrutin(stub, args)
@@ -131,6 +156,18 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.init_vote(stub, args)
 	} else if function == "add_vote" { //create a new marble
 		return t.add_vote(stub, args)
+	} else if function == "set_log_level" { //change how much the chaincode logs, operator only
+		return logging.SetLevel(stub, args, func() error {
+			return t.guard().Authorize(stub, roles.Operator, "set the log level")
+		})
+	} else if function == "grant_role" { //give a user the operator or admin role, admin only
+		return t.guard().GrantRole(stub, args)
+	} else if function == "revoke_role" { //make a user a plain user again, admin only
+		return t.guard().RevokeRole(stub, args)
+	} else if function == "migrate_state" { //upgrade a batch of stored records to the current schema versions, admin only
+		return t.migrate_state(stub, args)
+	} else if function == "import_state" { //write records of export_state pages, admin only
+		return t.import_state(stub, args)
 	} /*else if function == "perform_view" { //forfill an open trade order
 		res, err := t.perform_view(stub, args)
 		cleanScrutins(stub) //lets clean just in case
@@ -138,45 +175,60 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 	} else if function == "remove_view" { //cancel an open trade order
 		return t.remove_view(stub, args)
 	}*/
-	fmt.Println("invoke did not find func: " + function) //error
-
-	return nil, errors.New("Received unknown function invocation")
+	return nil, errs.New(errs.InvalidArgument, "Received unknown function invocation")
 }
 
 // ============================================================================================================================
 // Query - Our entry point for Queries
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	ls := logging.Begin(stub, logger, function)
+	ls.Log.Debug("query", "args", strings.Join(args, ","))
+
+	res, err := t.query(ls, function, args)
+	if err != nil {
+		err = errs.Wrap(err) //clients always get a coded error
+		ls.Log.Debug("query failed", "code", string(errs.CodeOf(err)), "error", errs.From(err).Message)
+		return nil, err
+	}
+	return res, nil
+}
+
+// query routes a query to its function
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
 	// Handle different functions
 	if function == "read" { //read a variable
 		return t.read(stub, args)
+	} else if function == "get_log_level" { //how much the chaincode logs
+		return logging.GetLevel(stub, defaultLogLevel)
+	} else if function == "get_role" { //the role of a user
+		return t.guard().GetRole(stub, args)
+	} else if function == "export_state" { //page through a snapshot of every scrutin, vote and view, admin only
+		return t.export_state(stub, args)
 	}
-	fmt.Println("query did not find func: " + function) //error
 
-	return nil, errors.New("Received unknown function query")
+	return nil, errs.New(errs.InvalidArgument, "Received unknown function query")
 }
 
 // ============================================================================================================================
 // Read - read a variable from chaincode state
 // ============================================================================================================================
 func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
+	var name string
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting name of the var to query")
 	}
 
 	name = args[0]
 	valAsbytes, err := stub.GetState(name) //get the var from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, errs.New(errs.Internal, "Failed to get state for "+name)
 	}
 
-	return valAsbytes, nil //send it onward
+	return upgradeForRead(name, valAsbytes), nil //send it onward
 }
 
 // ============================================================================================================================
@@ -185,14 +237,17 @@ func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string // Entities
 	var err error
-	fmt.Println("running write()")
 
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 2. name of the variable and value to set")
 	}
 
 	name = args[0] //rename for funsies
 	value = args[1]
+	err = t.guard().Authorize(stub, roles.Admin, "write "+name) //raw writes can overwrite anything, including the roles
+	if err != nil {
+		return nil, err
+	}
 	err = stub.PutState(name, []byte(value)) //write the variable into the chaincode state
 	if err != nil {
 		return nil, err
@@ -207,19 +262,18 @@ func (t *SimpleChaincode) init_scrutin(stub shim.ChaincodeStubInterface, args []
 	var err error
 	// "nameSccrutin", "descriptionScrutin", "User"
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 3")
 	}
 
 	//input sanitation
-	fmt.Println("- start init scrutin")
 	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return nil, errs.Arg(1, "2nd argument must be a non-empty string")
 	}
 	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+		return nil, errs.Arg(2, "3rd argument must be a non-empty string")
 	}
 
 	name := args[0]
@@ -228,16 +282,12 @@ func (t *SimpleChaincode) init_scrutin(stub shim.ChaincodeStubInterface, args []
 	var votes []AVote
 
 	//check if scrutin already exists
-	scrutinAsBytes, err := stub.GetState(name)
+	res, err := readScrutin(stub, name)
 	if err != nil {
-		return nil, errors.New("Failed to get scrutin name")
+		return nil, err
 	}
-	res := Scrutin{}
-	json.Unmarshal(scrutinAsBytes, &res)
 	if res.Name == name {
-		fmt.Println("This scrutin arleady exists: " + name)
-		fmt.Println(res)
-		return nil, errors.New("This scrutin arleady exists") //all stop a marble by this name exists
+		return nil, errs.New(errs.AlreadyExists, "This scrutin arleady exists") //all stop a marble by this name exists
 	}
 
 	//build the marble json string manually
@@ -246,27 +296,26 @@ func (t *SimpleChaincode) init_scrutin(stub shim.ChaincodeStubInterface, args []
 	res.Votes = votes
 	res.User = user
 
-	jsonsAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(name, jsonsAsBytes) //rewrite the marble with id as key
+	err = putScrutin(stub, res) //rewrite the marble with id as key
 	if err != nil {
 		return nil, err
 	}
 
 	//get the marble index
-	scrutinsAsBytes, err := stub.GetState(scrutinIndexStr)
+	scrutinIndex, err := getScrutinIndex(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get scrutin index")
+		return nil, err
 	}
-	var scrutinIndex []string
-	json.Unmarshal(scrutinsAsBytes, &scrutinIndex) //un stringify it aka JSON.parse()
 
 	//append
 	scrutinIndex = append(scrutinIndex, name) //add marble name to index list
-	fmt.Println("! scrutin index: ", scrutinIndex)
 	jsonAsBytes, _ := json.Marshal(scrutinIndex)
 	err = stub.PutState(scrutinIndexStr, jsonAsBytes) //store name of marble
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to store scrutin index")
+	}
 
-	fmt.Println("- end init scrutin")
+	logFor(stub).Info("scrutin created", "scrutin", name, "user", user)
 	return nil, nil
 }
 
@@ -277,64 +326,62 @@ func (t *SimpleChaincode) init_vote(stub shim.ChaincodeStubInterface, args []str
 	var err error
 	// "nameScrutin", "nameVote"
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	//input sanitation
-	fmt.Println("- start init vote")
 	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return nil, errs.Arg(1, "2nd argument must be a non-empty string")
 	}
 
 	nameScrutin := args[0]
 	nameVote := args[1]
 
 	//check if scrutin already exists
-	voteAsBytes, err := stub.GetState(nameVote)
+	res, err := readVote(stub, nameVote)
 	if err != nil {
-		return nil, errors.New("Failed to get vote name")
+		return nil, err
 	}
-	res := AVote{}
-	json.Unmarshal(voteAsBytes, &res)
 	if res.Name == nameVote {
-		fmt.Println("This Vote arleady exists: " + nameVote)
-		fmt.Println(res)
-		return nil, errors.New("This vote arleady exists") //all stop a marble by this name exists
+		return nil, errs.New(errs.AlreadyExists, "This vote arleady exists") //all stop a marble by this name exists
+	}
+
+	//the scrutin the option is for
+	scrutin, err := readScrutin(stub, nameScrutin)
+	if err != nil {
+		return nil, err
+	}
+	if scrutin.Name != nameScrutin {
+		return nil, errs.New(errs.NotFound, "Scrutin not found: "+nameScrutin)
 	}
 
 	var users []string
 
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
+	}
+
 	res.Name = nameVote
 	res.Users = users
-	res.Timestamp = makeTimestamp() //use timestamp as an ID
+	res.Timestamp = timestamp //tx timestamp, the same on every peer
 	res.Count = 0
 
-	jsonsAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(nameVote, jsonsAsBytes) //rewrite the marble with id as key
+	err = putVote(stub, res) //rewrite the marble with id as key
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("Vote added")
 
-	//Get the scrutin and add the vote option
-	scrutinAsBytes, err := stub.GetState(nameScrutin)
+	//Update scrutin by adding vote option
+	scrutin.Votes = append(scrutin.Votes, res)
+	err = putScrutin(stub, scrutin) //store name of marble
 	if err != nil {
-		return nil, errors.New("Failed to get scrutin name")
-	}
-	scrutin := Scrutin{}
-	json.Unmarshal(scrutinAsBytes, &scrutin)
-	if scrutin.Name == nameScrutin {
-		//Update scrutin by adding vote option
-		scrutin.Votes = append(scrutin.Votes, res)
-		scrutinUAsBytes, _ := json.Marshal(scrutin)
-		err = stub.PutState(nameScrutin, scrutinUAsBytes) //store name of marble
-		fmt.Println("scrutin updated")
-
+		return nil, err
 	}
-	fmt.Println("- end init vote")
+	logFor(stub).Info("vote option created", "scrutin", nameScrutin, "vote", nameVote)
 	return nil, nil
 
 }
@@ -345,36 +392,34 @@ func (t *SimpleChaincode) init_vote(stub shim.ChaincodeStubInterface, args []str
 func (t *SimpleChaincode) open_scrutin(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	//	0        1      2     3      4      5       6
-	//["bob", "blue", "16", "red", "16"] *"blue", "35*
+	//   0      1
+	// "s1", "bob"
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting like 3")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting scrutin name and user")
+	}
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, errs.New(errs.Internal, "Failed to get transaction timestamp")
 	}
 
 	open := AnOpenScrutin{}
 	open.Name = args[0]
 	open.User = args[1]
-	open.Timestamp = makeTimestamp() //use timestamp as an ID
-	fmt.Println("- start open trade")
-	jsonAsBytes, _ := json.Marshal(open)
-	err = stub.PutState("_debug1", jsonAsBytes)
-
+	open.Timestamp = timestamp //tx timestamp, the same on every peer
 	//get the open trade struct
-	opensAsBytes, err := stub.GetState(openScrutinStr)
+	views, err := getViews(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get openscrutin")
+		return nil, err
 	}
-	var views = AllScrutinViews{}
-	json.Unmarshal(opensAsBytes, &views) //un stringify it aka JSON.parse()
 
 	views.OpenScrutins = append(views.OpenScrutins, open) //append to open trades
-	fmt.Println("! appended open to trades")
-	jsonAsBytes, _ = json.Marshal(views)
+	jsonAsBytes, _ := json.Marshal(views)
 	err = stub.PutState(openScrutinStr, jsonAsBytes) //rewrite open orders
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("- end open trade")
+	logFor(stub).Info("scrutin opened", "scrutin", open.Name, "user", open.User)
 	return nil, nil
 }
 
@@ -385,37 +430,47 @@ func (t *SimpleChaincode) add_vote(stub shim.ChaincodeStubInterface, args []stri
 	var err error
 	// "nameVote", "nameUser"
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	//input sanitation
-	fmt.Println("- start init vote")
 	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+		return nil, errs.Arg(0, "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return nil, errs.Arg(1, "2nd argument must be a non-empty string")
 	}
 
 	nameVote := args[0]
 	nameUser := args[1]
 
-	voteAsBytes, err := stub.GetState(nameVote)
+	vote, err := readVote(stub, nameVote)
 	if err != nil {
-		return nil, errors.New("Failed to get vote name")
-	}
-	vote := AVote{}
-	json.Unmarshal(voteAsBytes, &vote)
-	if vote.Name == nameVote {
-		vote.Users = append(vote.Users, nameUser)
-		vote.Count = vote.Count + 1
-		voteUAsBytes, _ := json.Marshal(vote)
-		err = stub.PutState(nameVote, voteUAsBytes) //store name of marble
-		fmt.Println("vote updated")
-	}
-	fmt.Println("- end updated vote")
+		return nil, err
+	}
+	if vote.Name != nameVote {
+		return nil, errs.New(errs.NotFound, "Vote not found: "+nameVote)
+	}
+	vote.Users = append(vote.Users, nameUser)
+	vote.Count = vote.Count + 1
+	err = putVote(stub, vote) //store name of marble
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("vote added", "vote", nameVote, "user", nameUser)
 	return nil, nil
 }
-func makeTimestamp() int64 {
-	return time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
+
+// ============================================================================================================================
+// Get Tx Timestamp - the timestamp of the running transaction in ms, the same on every peer
+// ============================================================================================================================
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	if ts == nil {
+		return 0, errs.New(errs.Internal, "Transaction has no timestamp")
+	}
+	return ts.Seconds*1000 + int64(ts.Nanos)/int64(time.Millisecond), nil
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+)
+
+// newTestChaincode deploys the chaincode on a fresh in-memory stub, testAdmin deploys it and so is its admin
+func newTestChaincode(t *testing.T) (*SimpleChaincode, *memStub) {
+	t.Helper()
+	cc := new(SimpleChaincode)
+	stub := newMemStub()
+	stub.as(testAdmin)
+	stub.begin()
+	_, err := cc.Init(stub, "init", []string{"99"})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	stub.as("")
+	return cc, stub
+}
+
+var testAdmin = "root" //deploys the chaincode in newTestChaincode
+
+func getScrutin(t *testing.T, stub *memStub, name string) Scrutin {
+	t.Helper()
+	var s Scrutin
+	if err := json.Unmarshal(stub.state[name], &s); err != nil {
+		t.Fatalf("scrutin %s is not valid json: %s", name, err)
+	}
+	return s
+}
+
+func getVote(t *testing.T, stub *memStub, name string) AVote {
+	t.Helper()
+	var v AVote
+	if err := json.Unmarshal(stub.state[name], &v); err != nil {
+		t.Fatalf("vote %s is not valid json: %s", name, err)
+	}
+	return v
+}
+
+func storedScrutinIndex(t *testing.T, stub *memStub) []string {
+	t.Helper()
+	var index []string
+	if err := json.Unmarshal(stub.state[scrutinIndexStr], &index); err != nil {
+		t.Fatalf("scrutin index is not valid json: %s", err)
+	}
+	return index
+}
+
+func getOpenScrutins(t *testing.T, stub *memStub) []AnOpenScrutin {
+	t.Helper()
+	var views AllScrutinViews
+	if err := json.Unmarshal(stub.state[openScrutinStr], &views); err != nil {
+		t.Fatalf("open scrutins are not valid json: %s", err)
+	}
+	return views.OpenScrutins
+}
+
+func TestInit(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	if string(stub.state["abc"]) != "99" {
+		t.Errorf("abc = %q, want 99", stub.state["abc"])
+	}
+	if len(storedScrutinIndex(t, stub)) != 0 || len(getOpenScrutins(t, stub)) != 0 {
+		t.Error("init should leave an empty index and no open scrutins")
+	}
+
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "init")
+	mustFail(t, stub, cc, "init", "abc")
+
+	mustInvoke(t, stub, cc, "init_scrutin", "s1", "lunch", "bob")
+	mustInvoke(t, stub, cc, "open_scrutin", "s1", "bob")
+	mustInvoke(t, stub, cc, "init", "1")
+	if len(storedScrutinIndex(t, stub)) != 0 || len(getOpenScrutins(t, stub)) != 0 {
+		t.Error("init through invoke should reset the index and open scrutins")
+	}
+
+	stub.failPut[scrutinIndexStr] = true
+	mustFail(t, stub, cc, "init", "1")
+	delete(stub.failPut, scrutinIndexStr)
+	stub.failPut[openScrutinStr] = true
+	mustFail(t, stub, cc, "init", "1")
+	delete(stub.failPut, openScrutinStr)
+	stub.failPut["abc"] = true
+	mustFail(t, stub, cc, "init", "1")
+}
+
+func TestRunAndUnknownFunctions(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as(testAdmin)
+	stub.begin()
+	_, err := cc.Run(stub, "write", []string{"k", "v"})
+	stub.end(err)
+	if err != nil || string(stub.state["k"]) != "v" {
+		t.Errorf("Run should dispatch to Invoke, err=%v k=%q", err, stub.state["k"])
+	}
+
+	mustFail(t, stub, cc, "no_such_function")
+	mustFail(t, stub, cc, "perform_view")
+	if _, err := stub.query(cc, "no_such_function"); err == nil {
+		t.Error("unknown query should fail")
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "write", "k")
+	mustInvoke(t, stub, cc, "write", "k", "v")
+	res, err := stub.query(cc, "read", "k")
+	if err != nil || string(res) != "v" {
+		t.Errorf("read k = %q, %v", res, err)
+	}
+	if _, err := stub.query(cc, "read"); err == nil {
+		t.Error("read without args should fail")
+	}
+	stub.failGet["k"] = true
+	if _, err := stub.query(cc, "read", "k"); err == nil {
+		t.Error("read should surface GetState failures")
+	}
+	stub.failPut["k"] = true
+	mustFail(t, stub, cc, "write", "k", "w")
+}
+
+func TestInitScrutin(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustInvoke(t, stub, cc, "init_scrutin", "s1", "Where To Lunch", "Bob")
+	want := Scrutin{Name: "s1", Description: "where to lunch", User: "bob", Schema: scrutinSchema.Current()}
+	if got := getScrutin(t, stub, "s1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("scrutin = %+v, want %+v", got, want)
+	}
+	if index := storedScrutinIndex(t, stub); !reflect.DeepEqual(index, []string{"s1"}) {
+		t.Errorf("index = %v, want [s1]", index)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"too few args", []string{"s2", "lunch"}},
+		{"empty name", []string{"", "lunch", "bob"}},
+		{"empty description", []string{"s2", "", "bob"}},
+		{"empty user", []string{"s2", "lunch", ""}},
+		{"duplicate", []string{"s1", "dinner", "alice"}},
+	}
+	for _, c := range cases {
+		if _, err := stub.invoke(cc, "init_scrutin", c.args...); err == nil {
+			t.Errorf("%s: init_scrutin%v should fail", c.name, c.args)
+		}
+	}
+
+	stub.failGet["s2"] = true
+	mustFail(t, stub, cc, "init_scrutin", "s2", "lunch", "bob")
+	stub.failPut["s3"] = true
+	mustFail(t, stub, cc, "init_scrutin", "s3", "lunch", "bob")
+	delete(stub.failPut, "s3")
+	stub.failPut[scrutinIndexStr] = true
+	if err := mustFail(t, stub, cc, "init_scrutin", "s3", "lunch", "bob"); errs.CodeOf(err) != errs.Internal {
+		t.Errorf("init_scrutin with a failing index write = %v", err)
+	}
+	stub.failGet[scrutinIndexStr] = true
+	mustFail(t, stub, cc, "init_scrutin", "s4", "lunch", "bob")
+}
+
+func TestInitVote(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_scrutin", "s1", "lunch", "bob")
+
+	mustInvoke(t, stub, cc, "init_vote", "s1", "pizza")
+	vote := getVote(t, stub, "pizza")
+	if vote.Name != "pizza" || vote.Count != 0 || len(vote.Users) != 0 {
+		t.Errorf("unexpected vote %+v", vote)
+	}
+	if vote.Timestamp != stub.txTime.Unix()*1000 {
+		t.Errorf("timestamp should come from the transaction, got %d", vote.Timestamp)
+	}
+	if votes := getScrutin(t, stub, "s1").Votes; len(votes) != 1 || votes[0].Name != "pizza" {
+		t.Errorf("vote option should be added to the scrutin, votes = %+v", votes)
+	}
+
+	//an unknown scrutin takes no options
+	if err := mustFail(t, stub, cc, "init_vote", "nope", "sushi"); errs.CodeOf(err) != errs.NotFound {
+		t.Errorf("init_vote for an unknown scrutin = %v, want not found", err)
+	}
+	if _, ok := stub.state["sushi"]; ok {
+		t.Error("init_vote for an unknown scrutin should not create the vote")
+	}
+
+	mustFail(t, stub, cc, "init_vote", "s1")
+	mustFail(t, stub, cc, "init_vote", "", "tacos")
+	mustFail(t, stub, cc, "init_vote", "s1", "")
+	mustFail(t, stub, cc, "init_vote", "s1", "pizza")
+
+	stub.failGet["tacos"] = true
+	mustFail(t, stub, cc, "init_vote", "s1", "tacos")
+	delete(stub.failGet, "tacos")
+	stub.failPut["tacos"] = true
+	mustFail(t, stub, cc, "init_vote", "s1", "tacos")
+	delete(stub.failPut, "tacos")
+	stub.failPut["s1"] = true
+	if err := mustFail(t, stub, cc, "init_vote", "s1", "tacos"); errs.CodeOf(err) != errs.Internal {
+		t.Errorf("init_vote with a failing scrutin write = %v", err)
+	}
+	delete(stub.failPut, "s1")
+	stub.failGet["s1"] = true
+	mustFail(t, stub, cc, "init_vote", "s1", "tacos")
+}
+
+func TestOpenScrutin(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+
+	mustInvoke(t, stub, cc, "open_scrutin", "s1", "bob")
+	open := getOpenScrutins(t, stub)
+	if len(open) != 1 || open[0].Name != "s1" || open[0].User != "bob" {
+		t.Errorf("unexpected open scrutins %+v", open)
+	}
+	if open[0].Timestamp != stub.txTime.Unix()*1000 {
+		t.Errorf("timestamp should come from the transaction, got %d", open[0].Timestamp)
+	}
+
+	mustFail(t, stub, cc, "open_scrutin", "s1")
+	mustFail(t, stub, cc, "open_scrutin", "s1", "bob", "x")
+
+	stub.failGet[openScrutinStr] = true
+	mustFail(t, stub, cc, "open_scrutin", "s2", "bob")
+	delete(stub.failGet, openScrutinStr)
+	stub.failPut[openScrutinStr] = true
+	mustFail(t, stub, cc, "open_scrutin", "s2", "bob")
+}
+
+func TestAddVote(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_scrutin", "s1", "lunch", "bob")
+	mustInvoke(t, stub, cc, "init_vote", "s1", "pizza")
+
+	mustInvoke(t, stub, cc, "add_vote", "pizza", "bob")
+	mustInvoke(t, stub, cc, "add_vote", "pizza", "alice")
+	vote := getVote(t, stub, "pizza")
+	if vote.Count != 2 || !reflect.DeepEqual(vote.Users, []string{"bob", "alice"}) {
+		t.Errorf("unexpected vote %+v", vote)
+	}
+
+	//voting for an unknown option fails
+	if err := mustFail(t, stub, cc, "add_vote", "sushi", "bob"); errs.CodeOf(err) != errs.NotFound {
+		t.Errorf("add_vote for an unknown option = %v, want not found", err)
+	}
+	if _, ok := stub.state["sushi"]; ok {
+		t.Error("add_vote should not create votes")
+	}
+
+	mustFail(t, stub, cc, "add_vote", "pizza")
+	mustFail(t, stub, cc, "add_vote", "", "bob")
+	mustFail(t, stub, cc, "add_vote", "pizza", "")
+	stub.failPut["pizza"] = true
+	if err := mustFail(t, stub, cc, "add_vote", "pizza", "carol"); errs.CodeOf(err) != errs.Internal {
+		t.Errorf("add_vote with a failing write = %v", err)
+	}
+	delete(stub.failPut, "pizza")
+	stub.failGet["pizza"] = true
+	mustFail(t, stub, cc, "add_vote", "pizza", "bob")
+}
+
+func TestErrorCodes(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "init_scrutin", "s1", "lunch", "bob")
+	stub.failPut["s2"] = true //ledger failures are INTERNAL
+
+	code := func(err error) (errs.Code, int) {
+		t.Helper()
+		e, ok := errs.Parse(err.Error())
+		if !ok {
+			t.Fatalf("error is not coded: %s", err)
+		}
+		if e.Arg == nil {
+			return e.Code, -1
+		}
+		return e.Code, *e.Arg
+	}
+	cases := []struct {
+		err  error
+		code errs.Code
+		arg  int
+	}{
+		{mustFail(t, stub, cc, "fly"), errs.InvalidArgument, -1},
+		{mustFail(t, stub, cc, "init_scrutin", "s2"), errs.InvalidArgument, -1},
+		{mustFail(t, stub, cc, "init_scrutin", "s2", "", "bob"), errs.InvalidArgument, 1},
+		{mustFail(t, stub, cc, "init_scrutin", "s1", "lunch", "bob"), errs.AlreadyExists, -1},
+		{mustFail(t, stub, cc, "init", "x"), errs.Unauthorized, -1}, //only admins reset
+		{mustFail(t, stub.as(testAdmin), cc, "init", "x"), errs.InvalidArgument, 0},
+		{mustFail(t, stub, cc, "init_scrutin", "s2", "dinner", "bob"), errs.Internal, -1},
+	}
+	for i, c := range cases {
+		if got, arg := code(c.err); got != c.code || arg != c.arg {
+			t.Errorf("case %d: got %s arg %d, want %s arg %d: %s", i, got, arg, c.code, c.arg, c.err)
+		}
+	}
+
+	//read no longer hides a json blob in the message
+	stub.failGet["s1"] = true
+	_, err := stub.query(cc, "read", "s1")
+	if got, _ := code(err); got != errs.Internal {
+		t.Errorf("read error = %s", err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	mustInvoke(t, stub, cc, "open_scrutin", "s1", "bob")
+	if _, ok := stub.state["_debug1"]; ok {
+		t.Error("open_scrutin should not write _debug1")
+	}
+
+	mustFail(t, stub, cc, "set_log_level", "loud")
+	mustFail(t, stub, cc, "set_log_level", "warning")
+	mustInvokeAs(t, stub, cc, testAdmin, "grant_role", "carol", "operator")
+	mustInvokeAs(t, stub, cc, "carol", "set_log_level", "warning")
+	res, err := stub.query(cc, "get_log_level")
+	if err != nil || string(res) != "warning" {
+		t.Errorf("get_log_level = %s, %v", res, err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	role := func(user string) roles.Role {
+		t.Helper()
+		res, err := stub.query(cc, "get_role", user)
+		var assignment roles.Assignment
+		if err != nil || json.Unmarshal(res, &assignment) != nil {
+			t.Fatalf("get_role %s = %s, %v", user, res, err)
+		}
+		return assignment.Role
+	}
+	if got := role(testAdmin); got != roles.Admin {
+		t.Errorf("%s is %s, want admin", testAdmin, got)
+	}
+
+	//write and init are admin only, anonymous callers included
+	for _, user := range []string{"", "bob"} {
+		stub.as(user)
+		mustFail(t, stub, cc, "write", "k", "v")
+		mustFail(t, stub, cc, "write", roles.Key, `{"bob":"admin"}`)
+		mustFail(t, stub, cc, "init", "1")
+		mustFail(t, stub, cc, "grant_role", "bob", "admin")
+	}
+	if _, ok := stub.state["k"]; ok {
+		t.Error("denied write landed in state")
+	}
+
+	stub.as(testAdmin)
+	mustFail(t, stub, cc, "grant_role", "bob", "boss")
+	mustInvoke(t, stub, cc, "grant_role", " Bob ", "admin")
+	if got := role("bob"); got != roles.Admin {
+		t.Errorf("bob is %s, want admin", got)
+	}
+	stub.as("bob")
+	mustInvoke(t, stub, cc, "write", "k", "v")
+	mustInvoke(t, stub, cc, "revoke_role", testAdmin)
+	if got := role(testAdmin); got != roles.User {
+		t.Errorf("%s is %s after revoke, want user", testAdmin, got)
+	}
+	mustFail(t, stub, cc, "revoke_role", "bob") //the last admin stays
+}
+
+func TestNobodyClaimsAnAnonymousDeploy(t *testing.T) {
+	cc, stub := new(SimpleChaincode), newMemStub()
+	stub.begin()
+	_, err := cc.Init(stub, "init", []string{"99"})
+	stub.end(err)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+
+	stub.as("mallory")
+	if err := mustFail(t, stub, cc, "init", "1"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("init without an admin = %v, want unauthorized", err)
+	}
+	table, err := roles.Load(stub)
+	if err != nil || table.Count(roles.Admin) != 0 {
+		t.Errorf("roles = %v, %v, want no admin", table, err)
+	}
+}
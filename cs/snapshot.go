@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/roles"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/schema"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/snapshot"
+)
+
+var snapshotPageSize = 20     //records export_state returns when no page size is given
+var maxSnapshotPageSize = 200 //most records one export_state returns
+
+// a snapshot holds the scrutins, the votes they list and the open scrutin views, in that order. Views are known
+// by their place in the list, so a ledger restored from empty exports the same snapshot. Roles stay behind.
+var snapshotSources = []snapshot.Source{
+	{Kind: "scrutin", Records: exportScrutins},
+	{Kind: "vote", Records: exportVotes},
+	{Kind: "view", Records: exportViews},
+}
+
+var snapshotImporters = map[string]snapshot.Importer{
+	"scrutin": importScrutin,
+	"vote":    importVote,
+	"view":    importView,
+}
+
+func exportScrutins(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	lines := []snapshot.Line{}
+	for len(lines) < limit {
+		room := limit - len(lines)
+		names, err := scrutinsAfter(stub, after, room)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			after = name
+			scrutin, err := readScrutin(stub, name)
+			if err != nil {
+				return nil, errs.Prefix("Cannot export scrutin "+name+": ", err)
+			}
+			if scrutin.Name != name { //listed but never stored
+				continue
+			}
+			scrutinAsBytes, _ := json.Marshal(scrutin)
+			lines = append(lines, snapshot.Line{Key: name, Record: scrutinAsBytes})
+		}
+		if len(names) < room { //no more scrutins
+			break
+		}
+	}
+	return lines, nil
+}
+
+// exportVotes reads the votes the scrutins list, votes have no index of their own
+func exportVotes(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	scrutinIndex, err := getScrutinIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	for _, name := range scrutinIndex {
+		scrutin, err := readScrutin(stub, name)
+		if err != nil {
+			return nil, errs.Prefix("Cannot export scrutin "+name+": ", err)
+		}
+		for _, vote := range scrutin.Votes {
+			if vote.Name > after {
+				listed[vote.Name] = true
+			}
+		}
+	}
+	names := []string{}
+	for name := range listed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []snapshot.Line{}
+	for _, name := range names {
+		if len(lines) == limit {
+			break
+		}
+		vote, err := readVote(stub, name)
+		if err != nil {
+			return nil, errs.Prefix("Cannot export vote "+name+": ", err)
+		}
+		if vote.Name != name { //only the scrutin's copy exists
+			continue
+		}
+		voteAsBytes, _ := json.Marshal(vote)
+		lines = append(lines, snapshot.Line{Key: name, Record: voteAsBytes})
+	}
+	return lines, nil
+}
+
+func exportViews(stub shim.ChaincodeStubInterface, after string, limit int) ([]snapshot.Line, error) {
+	start := 0
+	if after != "" {
+		i, err := strconv.Atoi(after)
+		if err != nil || i < 0 {
+			return nil, errs.New(errs.InvalidArgument, "Not a view position: "+after)
+		}
+		start = i + 1
+	}
+	views, err := getViews(stub)
+	if err != nil {
+		return nil, err
+	}
+	lines := []snapshot.Line{}
+	for i := start; i < len(views.OpenScrutins) && len(lines) < limit; i++ {
+		viewAsBytes, _ := json.Marshal(views.OpenScrutins[i])
+		lines = append(lines, snapshot.Line{Key: strconv.Itoa(i), Record: viewAsBytes})
+	}
+	return lines, nil
+}
+
+// getViews reads the open scrutin views, an unset list is empty
+func getViews(stub shim.ChaincodeStubInterface) (AllScrutinViews, error) {
+	var views AllScrutinViews
+	opensAsBytes, err := stub.GetState(openScrutinStr)
+	if err != nil {
+		return views, errs.New(errs.Internal, "Failed to get openscrutin")
+	}
+	if len(opensAsBytes) == 0 {
+		return views, nil
+	}
+	err = json.Unmarshal(opensAsBytes, &views) //un stringify it aka JSON.parse()
+	if err != nil {
+		return views, errs.New(errs.Internal, "Corrupt openscrutin")
+	}
+	return views, nil
+}
+
+// readImported brings a record of the snapshot up to the current version and checks it is stored under its name,
+// a snapshot from a newer chaincode is refused
+func readImported(registry *schema.Registry, line snapshot.Line, v interface{}) error {
+	upgraded, _, err := registry.Upgrade(line.Record)
+	if err != nil {
+		return errs.New(errs.InvalidArgument, errs.From(err).Message)
+	}
+	if recordKind(line.Key, upgraded) != registry.Kind() || json.Unmarshal(upgraded, v) != nil {
+		return errs.New(errs.InvalidArgument, "Not a "+registry.Kind()+" record named "+line.Key)
+	}
+	return nil
+}
+
+// keyInUse refuses to overwrite a key that holds something other than a record of the kind being imported
+func keyInUse(stub shim.ChaincodeStubInterface, name string, kind string) (bool, error) {
+	valAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return false, errs.New(errs.Internal, "Failed to get "+kind+" "+name)
+	}
+	if valAsBytes == nil {
+		return false, nil
+	}
+	if recordKind(name, valAsBytes) != kind {
+		return true, errs.New(errs.AlreadyExists, "Key "+name+" is already in use")
+	}
+	return true, nil
+}
+
+// importScrutin creates the scrutin, or rewrites the scrutin already under its name
+func importScrutin(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	var scrutin Scrutin
+	err := readImported(scrutinSchema, line, &scrutin)
+	if err != nil {
+		return false, err
+	}
+	if scrutin.Description == "" || scrutin.User == "" {
+		return false, errs.New(errs.InvalidArgument, "Scrutin needs a description and a user")
+	}
+	for _, vote := range scrutin.Votes {
+		if vote.Name == "" {
+			return false, errs.New(errs.InvalidArgument, "Scrutin lists a vote without a name")
+		}
+	}
+	exists, err := keyInUse(stub, scrutin.Name, scrutinSchema.Kind())
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		existing, err := readScrutin(stub, scrutin.Name)
+		if err != nil {
+			return false, err
+		}
+		existingAsBytes, _ := json.Marshal(existing)
+		scrutinAsBytes, _ := json.Marshal(scrutin)
+		if bytes.Equal(existingAsBytes, scrutinAsBytes) {
+			return false, nil
+		}
+	}
+	err = putScrutin(stub, scrutin)
+	if err != nil {
+		return false, err
+	}
+
+	scrutinIndex, err := getScrutinIndex(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range scrutinIndex {
+		if name == scrutin.Name {
+			return true, nil
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(append(scrutinIndex, scrutin.Name))
+	return true, stub.PutState(scrutinIndexStr, jsonAsBytes)
+}
+
+// importVote creates the vote, or rewrites the vote already under its name
+func importVote(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	var vote AVote
+	err := readImported(voteSchema, line, &vote)
+	if err != nil {
+		return false, err
+	}
+	if vote.Count != len(vote.Users) {
+		return false, errs.New(errs.InvalidArgument, "Vote count "+strconv.Itoa(vote.Count)+" does not match its "+strconv.Itoa(len(vote.Users))+" users")
+	}
+	exists, err := keyInUse(stub, vote.Name, voteSchema.Kind())
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		existing, err := readVote(stub, vote.Name)
+		if err != nil {
+			return false, err
+		}
+		existingAsBytes, _ := json.Marshal(existing)
+		voteAsBytes, _ := json.Marshal(vote)
+		if bytes.Equal(existingAsBytes, voteAsBytes) {
+			return false, nil
+		}
+	}
+	return true, putVote(stub, vote)
+}
+
+// importView puts the view at its place in the open scrutin list, views come in order so the list only grows at its end
+func importView(stub shim.ChaincodeStubInterface, line snapshot.Line) (bool, error) {
+	var view AnOpenScrutin
+	if json.Unmarshal(line.Record, &view) != nil || view.Name == "" || view.User == "" {
+		return false, errs.New(errs.InvalidArgument, "Not a view record")
+	}
+	views, err := getViews(stub)
+	if err != nil {
+		return false, err
+	}
+	i, err := strconv.Atoi(line.Key)
+	if err != nil || i < 0 || i > len(views.OpenScrutins) {
+		return false, errs.New(errs.InvalidArgument, "View position must be between 0 and "+strconv.Itoa(len(views.OpenScrutins)))
+	}
+	if i < len(views.OpenScrutins) {
+		if views.OpenScrutins[i] == view {
+			return false, nil
+		}
+		views.OpenScrutins[i] = view
+	} else {
+		views.OpenScrutins = append(views.OpenScrutins, view)
+	}
+	jsonAsBytes, _ := json.Marshal(views)
+	return true, stub.PutState(openScrutinStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Export State (query) - a page of the snapshot of every scrutin, vote and open scrutin view, admin only
+// pass the bookmark of each page back until a page has none, the checksum of that page is the checksum of the ledger
+// ============================================================================================================================
+func (t *SimpleChaincode) export_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	pageSize := snapshotPageSize
+	bookmark := ""
+
+	//   0*      1*
+	// "20", "bookmark"
+	if len(args) > 2 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting page size and bookmark")
+	}
+	if len(args) > 0 && args[0] != "" {
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 || pageSize > maxSnapshotPageSize {
+			return nil, errs.Arg(0, "1st argument must be a page size between 1 and "+strconv.Itoa(maxSnapshotPageSize))
+		}
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	err = t.guard().Authorize(stub, roles.Admin, "export state")
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := snapshot.Export(stub, snapshotSources, pageSize, bookmark)
+	if err != nil && errs.CodeOf(err) == errs.InvalidArgument { //a bookmark that points nowhere
+		return nil, errs.WithArg(err, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// ============================================================================================================================
+// Import State - write the records of export_state pages, admin only
+// every record is validated and a page whose checksum doesn't match is refused, importing a page twice changes nothing
+// ============================================================================================================================
+func (t *SimpleChaincode) import_state(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "{"kind":"scrutin",...}\n{"kind":"page",...}\n"
+	if len(args) != 1 {
+		return nil, errs.New(errs.InvalidArgument, "Incorrect number of arguments. Expecting export_state pages")
+	}
+	err := t.guard().Authorize(stub, roles.Admin, "import state")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := snapshot.Import(stub, []byte(args[0]), snapshotImporters)
+	if err != nil && errs.CodeOf(err) == errs.InvalidArgument {
+		return nil, errs.WithArg(err, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logFor(stub).Info("state imported", "records", strconv.Itoa(result.Records), "imported", strconv.Itoa(result.Imported),
+		"unchanged", strconv.Itoa(result.Unchanged))
+	return json.Marshal(result)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/errs"
+	"gopkg.in/ibm-blockchain/marbles.v2/chaincode/snapshot"
+)
+
+// exportState pages through export_state as the admin, returning every page and the checksum of the last one
+func exportState(t *testing.T, cc *SimpleChaincode, stub *memStub, pageSize string) ([]byte, string) {
+	t.Helper()
+	stub.as(testAdmin)
+	var all []byte
+	bookmark := ""
+	for i := 0; i < 100; i++ {
+		page, err := stub.query(cc, "export_state", pageSize, bookmark)
+		if err != nil {
+			t.Fatalf("export_state failed: %s", err)
+		}
+		all = append(all, page...)
+		lines := strings.Split(strings.TrimSpace(string(page)), "\n")
+		var last snapshot.Line
+		json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+		if last.Bookmark == "" {
+			return all, last.Checksum
+		}
+		bookmark = last.Bookmark
+	}
+	t.Fatal("export_state never ended")
+	return nil, ""
+}
+
+func seedScrutins(t *testing.T, cc *SimpleChaincode, stub *memStub) {
+	t.Helper()
+	mustInvoke(t, stub, cc, "init_scrutin", "lunch", "where to eat", "bob")
+	mustInvoke(t, stub, cc, "init_scrutin", "dinner", "what to cook", "alice")
+	mustInvoke(t, stub, cc, "init_vote", "lunch", "pizza")
+	mustInvoke(t, stub, cc, "init_vote", "lunch", "sushi")
+	mustInvoke(t, stub, cc, "init_vote", "dinner", "soup")
+	mustInvoke(t, stub, cc, "add_vote", "pizza", "carol")
+	mustInvoke(t, stub, cc, "open_scrutin", "lunch", "bob")
+}
+
+func TestExportImportState(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedScrutins(t, cc, stub)
+	whole, checksum := exportState(t, cc, stub, "")
+	paged, pagedChecksum := exportState(t, cc, stub, "2")
+	if pagedChecksum != checksum {
+		t.Errorf("checksum in pages of 2 = %s, in one page %s", pagedChecksum, checksum)
+	}
+	records, err := snapshot.Decode(whole)
+	if err != nil || len(records) != 6 { //2 scrutins, 3 votes, 1 view
+		t.Fatalf("export_state = %s, err %v", whole, err)
+	}
+
+	cc2, stub2 := newTestChaincode(t)
+	stub2.as(testAdmin)
+	res := mustInvoke(t, stub2, cc2, "import_state", string(paged))
+	var result snapshot.Result
+	json.Unmarshal(res, &result)
+	if result != (snapshot.Result{Records: 6, Imported: 6}) {
+		t.Errorf("import_state = %s", res)
+	}
+	if restored, restoredChecksum := exportState(t, cc2, stub2, ""); restoredChecksum != checksum || !bytes.Equal(restored, whole) {
+		t.Errorf("restored ledger exports\n%s\nnot\n%s", restored, whole)
+	}
+	if index := storedScrutinIndex(t, stub2); len(index) != 2 {
+		t.Errorf("scrutin index = %v", index)
+	}
+	if vote := getVote(t, stub2, "pizza"); vote.Count != 1 || vote.Users[0] != "carol" {
+		t.Errorf("pizza = %+v", vote)
+	}
+
+	//importing again changes nothing, a vote that moved on is brought back
+	mustInvoke(t, stub2, cc2, "add_vote", "pizza", "dave")
+	res = mustInvoke(t, stub2, cc2, "import_state", string(whole))
+	json.Unmarshal(res, &result)
+	if result != (snapshot.Result{Records: 6, Imported: 1, Unchanged: 5}) {
+		t.Errorf("second import_state = %s", res)
+	}
+	if views := getOpenScrutins(t, stub2); len(views) != 1 {
+		t.Errorf("views after a second import = %+v", views)
+	}
+}
+
+func TestExportImportStateErrors(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	seedScrutins(t, cc, stub)
+	whole, _ := exportState(t, cc, stub, "")
+
+	stub.as("bob")
+	if _, err := stub.query(cc, "export_state"); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("export_state by bob = %v", err)
+	}
+	if err := mustFail(t, stub, cc, "import_state", string(whole)); errs.CodeOf(err) != errs.Unauthorized {
+		t.Errorf("import_state by bob = %v", err)
+	}
+	stub.as(testAdmin)
+	for _, args := range [][]string{{"0"}, {"201"}, {"1", "nope"}} {
+		if _, err := stub.query(cc, "export_state", args...); errs.CodeOf(err) != errs.InvalidArgument {
+			t.Errorf("export_state%v = %v", args, err)
+		}
+	}
+
+	cc2, stub2 := newTestChaincode(t)
+	stub2.as(testAdmin)
+	stub2.state["taken"] = []byte(`{"name":"taken","users":[],"count":0}`)
+	for name, data := range map[string]string{
+		"tampered":    strings.Replace(string(whole), `"carol"`, `"mallory"`, 1),
+		"bad count":   `{"kind":"vote","key":"v","record":{"name":"v","users":["bob"],"count":5}}`,
+		"wrong key":   `{"kind":"vote","key":"v","record":{"name":"w","users":[],"count":0}}`,
+		"no user":     `{"kind":"scrutin","key":"s","record":{"name":"s","description":"d","user":""}}`,
+		"vote's key":  `{"kind":"scrutin","key":"taken","record":{"name":"taken","description":"d","user":"bob"}}`,
+		"view gap":    `{"kind":"view","key":"3","record":{"name":"s","user":"bob","timestamp":1}}`,
+		"newer vote":  `{"kind":"vote","key":"v","record":{"name":"v","users":[],"count":0,"schema":99}}`,
+		"unknown one": `{"kind":"ballot","key":"b","record":{}}`,
+	} {
+		err := mustFail(t, stub2, cc2, "import_state", data)
+		if code := errs.CodeOf(err); code != errs.InvalidArgument && code != errs.AlreadyExists {
+			t.Errorf("%s import_state = %v", name, err)
+		}
+	}
+}
@@ -238,7 +238,7 @@ $(document).on('ready', function() {
 		var msg = 	{
 						type: 'perform_trade',
 						v: 2,
-						id: bag.trades[i].timestamp.toString(),
+						id: trade_id(bag.trades[i]),
 						opener:{											//marble he is giving up
 							user: bag.trades[i].user,
 							color: bag.trades[i].willing[x].color,
@@ -269,13 +269,13 @@ $(document).on('ready', function() {
 	});
 	
 	$(document).on('click', '.removeTrade', function(){
-		var trade = find_trade($(this).attr('trade_timestamp'));
+		var trade = find_trade($(this).attr('trade_id'));
 		$(this).parent().parent().addClass('invalid');
 		console.log('trade', trade);
 		var msg = 	{
 						type: 'remove_trade',
 						v: 2,
-						id: trade.timestamp.toString(),
+						id: trade_id(trade),
 					};
 		ws.send(JSON.stringify(msg));
 	});
@@ -305,9 +305,14 @@ function sizeMe(mm){
 	return size;
 }
 
-function find_trade(timestamp){
+function trade_id(trade){									//trades opened before ids existed use their timestamp
+	if(trade.id) return trade.id;
+	return trade.timestamp.toString();
+}
+
+function find_trade(id){
 	for(var i in bag.trades){
-		if(bag.trades[i].timestamp){
+		if(trade_id(bag.trades[i]) == id){
 			return bag.trades[i];
 		}
 	}
@@ -506,7 +511,7 @@ function build_my_trades(trades){
 				html +=		'<p>1 <span class="fa fa-2x fa-circle ' + trades[i].willing[x].color + '"></span>&nbsp; &nbsp;' + sizeMe(trades[i].willing[x].size) + '</p>';
 			}
 			html += 	'</td>';
-			html +=		'<td><span class="fa fa-remove removeTrade" trade_timestamp="' + trades[i].timestamp + '"></span></td>';
+			html +=		'<td><span class="fa fa-remove removeTrade" trade_id="' + trade_id(trades[i]) + '"></span></td>';
 			html += '</tr>';
 		}
 	}
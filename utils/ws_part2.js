@@ -10,6 +10,27 @@ module.exports.setup = function(sdk, cc){
 	chaincode = cc;
 };
 
+//page through list_open_trades, calls back with the same {open_trades: [...]} json _opentrades used to hold
+module.exports.get_open_trades = function(cb){
+	var open_trades = [];
+	get_page('');
+
+	function get_page(bookmark){
+		chaincode.query.list_open_trades(['200', bookmark], function(e, page){
+			if(e != null) return cb(e);
+			try{
+				page = JSON.parse(page);
+			}
+			catch(e){
+				return cb(e);
+			}
+			open_trades = open_trades.concat(page.trades || []);
+			if(page.bookmark) get_page(page.bookmark);											//there is more, get the next page
+			else cb(null, JSON.stringify({open_trades: open_trades}));
+		});
+	}
+};
+
 module.exports.process_msg = function(ws, data){
 	if(data.v === 2){																						//only look at messages for part 2
 		if(data.type == 'create'){
@@ -57,7 +78,7 @@ module.exports.process_msg = function(ws, data){
 		}
 		else if(data.type == 'get_open_trades'){
 			console.log('get open trades msg');
-			chaincode.query.read(['_opentrades'], cb_got_trades);
+			module.exports.get_open_trades(cb_got_trades);
 		}
 		else if(data.type == 'perform_trade'){
 			console.log('perform trade msg');